@@ -7,11 +7,15 @@ package cli
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/jcjones/ocsp-l2-cache/fetcher"
@@ -20,11 +24,13 @@ import (
 	"github.com/jcjones/ocsp-l2-cache/storage"
 
 	blog "github.com/letsencrypt/boulder/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ocsp"
 )
 
 type Responder struct {
-	issuer       storage.Issuer
-	responderUrl url.URL
+	issuer storage.Issuer
+	urls   []url.URL
 }
 
 // CLI holds state for a run of the tool; use the Run method to execute it. Can
@@ -34,35 +40,208 @@ type CLI struct {
 	identifier         string
 	listenAddr         string
 	healthListenAddr   string
+	adminListenAddr    string
+	adminToken         string
 	redisAddr          string
-	redisTxTimeout     time.Duration
+	redisClusterAddrs  []string
+	redisSentinelAddrs []string
+	redisMasterName    string
+	redisOptions       storage.RedisOptions
 	deadline           time.Duration
 	lifespan           time.Duration
+	minimumCacheLife   time.Duration
+	ttlRules           map[int]repo.TTLRule
+	staleLifespan      time.Duration
+	revalidateStale    bool
+	fetchLeaseLife     time.Duration
+	fetchLeaseWait     time.Duration
+	maxClockSkew       time.Duration
+	legacyKeyFallback  bool
+	popularity         bool
+	memoryCacheEntries int
+	memoryCacheLife    time.Duration
+	cacheEncoding      repo.Encoding
 	upstreamResponders []Responder
+	issuerCerts        map[string]*x509.Certificate
+	headerPolicies     map[string]repo.HeaderPolicy
+	headerPolicy       repo.HeaderPolicy
+	transports         map[string]fetcher.TransportOptions
+	transport          fetcher.TransportOptions
+	requestOptions     map[string]fetcher.RequestOptions
+	weights            map[string][]int
+	request            fetcher.RequestOptions
+	retry              fetcher.RetryOptions
+	health             fetcher.HealthOptions
+	breaker            fetcher.BreakerOptions
+	warmConcurrency    int
+	warmRate           float64
+	refreshWindow      time.Duration
+	refreshOptions     repo.RefreshOptions
 }
 
 // New constructs a Command Line Interface handler. Use its methods to configure
 // it, then call the Run method to get a result.
 func New() *CLI {
-	return &CLI{}
+	return &CLI{
+		minimumCacheLife: time.Hour,
+		maxClockSkew:     repo.DefaultMaxClockSkew,
+		cacheEncoding:    repo.DefaultEncoding,
+		ttlRules:         make(map[int]repo.TTLRule),
+		issuerCerts:      make(map[string]*x509.Certificate),
+		headerPolicies:   make(map[string]repo.HeaderPolicy),
+		headerPolicy:     repo.DefaultHeaderPolicy,
+		transports:       make(map[string]fetcher.TransportOptions),
+		transport:        fetcher.DefaultTransportOptions,
+		requestOptions:   make(map[string]fetcher.RequestOptions),
+		weights:          make(map[string][]int),
+		request:          fetcher.DefaultRequestOptions,
+		retry:            fetcher.DefaultRetryOptions,
+		health:           fetcher.DefaultHealthOptions,
+		breaker:          fetcher.DefaultBreakerOptions,
+		popularity:       true,
+		warmConcurrency:  1,
+	}
 }
 
-// WithUpstreamResponder sets the URL of the upstream responder to query.
-func (cli *CLI) WithUpstreamResponder(issuerId string, respUrl string) *CLI {
-	rurl, err := url.Parse(respUrl)
+// WithUpstreamResponder sets the URL of the upstream responder to query. Give
+// several URLs, separated by commas, to fail over from one to the next.
+func (cli *CLI) WithUpstreamResponder(issuerId string, respUrls string) *CLI {
+	issuer, err := storage.NewIssuerFromHexKeyId(issuerId)
 	if err != nil {
 		panic(err)
 	}
+	r := Responder{issuer: *issuer}
+	for _, respUrl := range strings.Split(respUrls, ",") {
+		rurl, err := url.Parse(strings.TrimSpace(respUrl))
+		if err != nil {
+			panic(err)
+		}
+		r.urls = append(r.urls, *rurl)
+	}
+
+	cli.upstreamResponders = append(cli.upstreamResponders, r)
+	return cli
+}
+
+// WithUpstreamWeights picks the first of an issuer's upstream URLs to try at
+// random, in proportion to the weights, one per URL in the same order, rather
+// than trying them in order.
+func (cli *CLI) WithUpstreamWeights(issuerId string, weights []int) *CLI {
 	issuer, err := storage.NewIssuerFromHexKeyId(issuerId)
 	if err != nil {
 		panic(err)
 	}
-	r := Responder{
-		issuer:       *issuer,
-		responderUrl: *rurl,
+	cli.weights[issuer.String()] = weights
+	return cli
+}
+
+// responderWeights returns the weight of each of the responder's URLs, and
+// whether they were set, or a weight of one for each if not.
+func (cli *CLI) responderWeights(r Responder) ([]int, bool) {
+	weights, ok := cli.weights[r.issuer.String()]
+	if ok && len(weights) == len(r.urls) {
+		return weights, true
+	}
+	weights = make([]int, len(r.urls))
+	for i := range weights {
+		weights[i] = 1
 	}
+	return weights, false
+}
 
-	cli.upstreamResponders = append(cli.upstreamResponders, r)
+// WithUpstreamHealth sets when an issuer's upstream responders are ejected for
+// failing, to be tried after the others.
+func (cli *CLI) WithUpstreamHealth(opts fetcher.HealthOptions) *CLI {
+	cli.health = opts
+	return cli
+}
+
+// WithIssuerCertificate sets the PEM-encoded certificate of an issuer, against
+// which responses from its upstream responder are verified before caching.
+func (cli *CLI) WithIssuerCertificate(issuerId string, certPem []byte) *CLI {
+	issuer, err := storage.NewIssuerFromHexKeyId(issuerId)
+	if err != nil {
+		panic(err)
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil || block.Type != "CERTIFICATE" {
+		panic(fmt.Sprintf("No PEM certificate for issuer %s", issuerId))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		panic(err)
+	}
+
+	cli.issuerCerts[issuer.String()] = cert
+	return cli
+}
+
+// WithHeaderPolicy sets what to do with the HTTP caching headers from an
+// issuer's upstream responder, overriding the default header policy.
+func (cli *CLI) WithHeaderPolicy(issuerId string, policy repo.HeaderPolicy) *CLI {
+	issuer, err := storage.NewIssuerFromHexKeyId(issuerId)
+	if err != nil {
+		panic(err)
+	}
+	cli.headerPolicies[issuer.String()] = policy
+	return cli
+}
+
+// WithDefaultHeaderPolicy sets what to do with the HTTP caching headers from
+// upstream responders without a header policy of their own.
+func (cli *CLI) WithDefaultHeaderPolicy(policy repo.HeaderPolicy) *CLI {
+	cli.headerPolicy = policy
+	return cli
+}
+
+// WithTransport tunes the connections to an issuer's upstream responder,
+// overriding the default transport options.
+func (cli *CLI) WithTransport(issuerId string, opts fetcher.TransportOptions) *CLI {
+	issuer, err := storage.NewIssuerFromHexKeyId(issuerId)
+	if err != nil {
+		panic(err)
+	}
+	cli.transports[issuer.String()] = opts
+	return cli
+}
+
+// WithDefaultTransport tunes the connections to upstream responders without
+// transport options of their own.
+func (cli *CLI) WithDefaultTransport(opts fetcher.TransportOptions) *CLI {
+	cli.transport = opts
+	return cli
+}
+
+// WithRequestOptions sets how OCSP requests are sent to an issuer's upstream
+// responder, with GET or POST, overriding the default request options.
+func (cli *CLI) WithRequestOptions(issuerId string, opts fetcher.RequestOptions) *CLI {
+	issuer, err := storage.NewIssuerFromHexKeyId(issuerId)
+	if err != nil {
+		panic(err)
+	}
+	cli.requestOptions[issuer.String()] = opts
+	return cli
+}
+
+// WithDefaultRequestOptions sets how OCSP requests are sent to upstream
+// responders without request options of their own.
+func (cli *CLI) WithDefaultRequestOptions(opts fetcher.RequestOptions) *CLI {
+	cli.request = opts
+	return cli
+}
+
+// WithRetries sets how upstream fetches are retried after failures, and
+// hedged when slow.
+func (cli *CLI) WithRetries(opts fetcher.RetryOptions) *CLI {
+	cli.retry = opts
+	return cli
+}
+
+// WithCircuitBreaker sets when fetches from a failing upstream responder stop
+// being sent, to fail at once or be answered with stale responses. A zero
+// error rate disables the circuit breakers.
+func (cli *CLI) WithCircuitBreaker(opts fetcher.BreakerOptions) *CLI {
+	cli.breaker = opts
 	return cli
 }
 
@@ -87,17 +266,172 @@ func (cli *CLI) WithHealthListenAddr(addr string) *CLI {
 	return cli
 }
 
-func (cli *CLI) WithRedis(addr string, txTimeout time.Duration) *CLI {
+// WithAdminListenAddr serves the admin API on addr, to clients presenting the
+// token. An empty addr disables the admin API.
+func (cli *CLI) WithAdminListenAddr(addr string, token string) *CLI {
+	cli.adminListenAddr = addr
+	cli.adminToken = token
+	return cli
+}
+
+// WithRedis uses the Redis server at addr, connecting with the given options
+// for credentials, database and TLS.
+func (cli *CLI) WithRedis(addr string, opts storage.RedisOptions) *CLI {
 	cli.redisAddr = addr
-	cli.redisTxTimeout = txTimeout
+	cli.redisOptions = opts
 	return cli
 }
 
+// WithRedisCluster uses a Redis Cluster, discovered from the nodes at addrs,
+// instead of a single Redis server.
+func (cli *CLI) WithRedisCluster(addrs []string, opts storage.RedisOptions) *CLI {
+	cli.redisClusterAddrs = addrs
+	cli.redisOptions = opts
+	return cli
+}
+
+// WithRedisSentinel uses the Redis master named masterName, as found by the
+// Sentinels at sentinelAddrs, instead of a fixed Redis server.
+func (cli *CLI) WithRedisSentinel(masterName string, sentinelAddrs []string, opts storage.RedisOptions) *CLI {
+	cli.redisMasterName = masterName
+	cli.redisSentinelAddrs = sentinelAddrs
+	cli.redisOptions = opts
+	return cli
+}
+
+// WithCacheLifespan sets the longest a response is fresh once fetched. It is
+// the cap for the default TTL rule.
 func (cli *CLI) WithCacheLifespan(responseLifespan time.Duration) *CLI {
 	cli.lifespan = responseLifespan
 	return cli
 }
 
+// WithMinimumCacheLife sets the shortest a response is fresh once fetched, so
+// long as it is still before its NextUpdate. It is the floor for the default
+// TTL rule.
+func (cli *CLI) WithMinimumCacheLife(minimumCacheLife time.Duration) *CLI {
+	cli.minimumCacheLife = minimumCacheLife
+	return cli
+}
+
+// DefaultTTLRule is the TTL rule used for any status without its own.
+func (cli *CLI) DefaultTTLRule() repo.TTLRule {
+	return repo.TTLRule{
+		Fraction: repo.DefaultTTLFraction,
+		MaxLife:  cli.lifespan,
+		MinLife:  cli.minimumCacheLife,
+	}
+}
+
+// WithTTLRule overrides the TTL rule for responses of the given status, one of
+// ocsp.Good, ocsp.Revoked or ocsp.Unknown.
+func (cli *CLI) WithTTLRule(status int, rule repo.TTLRule) *CLI {
+	cli.ttlRules[status] = rule
+	return cli
+}
+
+// TTLPolicy assembles the configured TTL rules.
+func (cli *CLI) TTLPolicy() repo.TTLPolicy {
+	policy := repo.NewTTLPolicy(cli.DefaultTTLRule())
+	if rule, ok := cli.ttlRules[ocsp.Good]; ok {
+		policy.Good = rule
+	}
+	if rule, ok := cli.ttlRules[ocsp.Revoked]; ok {
+		policy.Revoked = rule
+	}
+	if rule, ok := cli.ttlRules[ocsp.Unknown]; ok {
+		policy.Unknown = rule
+	}
+	return policy
+}
+
+// WithStaleLifespan keeps responses cached for up to staleLifespan past the
+// end of their fresh lifespan, but never past their NextUpdate. Stale
+// responses are served when upstream fails; if revalidate is set, they are
+// also served immediately while being refreshed in the background. A zero
+// staleLifespan disables stale serving.
+func (cli *CLI) WithStaleLifespan(staleLifespan time.Duration, revalidate bool) *CLI {
+	cli.staleLifespan = staleLifespan
+	cli.revalidateStale = revalidate
+	return cli
+}
+
+// WithFetchLease coordinates upstream fetches with other instances sharing the
+// same Redis: only the holder of a serial's lease, which lasts up to
+// leaseLife, fetches it while the others wait up to maxWait for the result. A
+// zero leaseLife disables the lease.
+func (cli *CLI) WithFetchLease(leaseLife time.Duration, maxWait time.Duration) *CLI {
+	cli.fetchLeaseLife = leaseLife
+	cli.fetchLeaseWait = maxWait
+	return cli
+}
+
+// WithMaxClockSkew sets how far the upstream responders' clocks may be from
+// ours before their responses are rejected as not yet valid, or expired.
+func (cli *CLI) WithMaxClockSkew(maxSkew time.Duration) *CLI {
+	cli.maxClockSkew = maxSkew
+	return cli
+}
+
+// WithMemoryCache keeps up to maxEntries responses in memory in front of Redis.
+// Entries are kept no longer than they are in Redis, and no longer than
+// maxLife if it is set, which bounds how long it takes to notice responses
+// written by other instances. Zero maxEntries disables the memory cache.
+func (cli *CLI) WithMemoryCache(maxEntries int, maxLife time.Duration) *CLI {
+	cli.memoryCacheEntries = maxEntries
+	cli.memoryCacheLife = maxLife
+	return cli
+}
+
+// WithCacheEncoding sets how responses are encoded in the cache. Entries in
+// any encoding are read regardless.
+func (cli *CLI) WithCacheEncoding(encoding repo.Encoding) *CLI {
+	cli.cacheEncoding = encoding
+	return cli
+}
+
+// WithLegacyKeyFallback looks for responses under the serial-only cache keys
+// of earlier versions when they aren't found under their current key. Disable
+// it once MigrateKeys has run, to save a cache lookup per miss.
+func (cli *CLI) WithLegacyKeyFallback(fallback bool) *CLI {
+	cli.legacyKeyFallback = fallback
+	return cli
+}
+
+// WithPopularityTracking sets whether requests are counted per serial, so that
+// refreshing and warming fetch the most requested first.
+func (cli *CLI) WithPopularityTracking(enabled bool) *CLI {
+	cli.popularity = enabled
+	return cli
+}
+
+// WithWarming bounds how hard warming the cache works upstream: no more than
+// concurrency fetches at once, starting no more than rate per second. A zero
+// rate leaves only the concurrency bound.
+func (cli *CLI) WithWarming(concurrency int, rate float64) *CLI {
+	cli.warmConcurrency = concurrency
+	cli.warmRate = rate
+	return cli
+}
+
+// WithProactiveRefresh refetches entries requested within the last window
+// shortly before they go stale, as set by opts. Only one of the instances
+// sharing a Redis refreshes at a time. A zero interval disables refreshing.
+func (cli *CLI) WithProactiveRefresh(window time.Duration, opts repo.RefreshOptions) *CLI {
+	cli.refreshWindow = window
+	cli.refreshOptions = opts
+	return cli
+}
+
+func (cli *CLI) warmOptions(force bool) repo.WarmOptions {
+	return repo.WarmOptions{
+		Concurrency: cli.warmConcurrency,
+		Rate:        cli.warmRate,
+		Deadline:    cli.deadline,
+		Force:       force,
+	}
+}
+
 func (cli *CLI) WithConnectionDeadline(deadline time.Duration) *CLI {
 	cli.deadline = deadline
 	return cli
@@ -110,8 +444,9 @@ func (cli *CLI) Check(ctx context.Context) error {
 	if len(cli.upstreamResponders) < 1 {
 		return fmt.Errorf("Must set upstream URL")
 	}
-	if cli.redisAddr == "" || cli.redisTxTimeout == 0 {
-		return fmt.Errorf("Must set Redis address and transaction timeout")
+	err := cli.checkRedis()
+	if err != nil {
+		return err
 	}
 	if cli.lifespan == 0 {
 		return fmt.Errorf("Must set a response lifespan")
@@ -122,44 +457,317 @@ func (cli *CLI) Check(ctx context.Context) error {
 	if cli.identifier == "" {
 		return fmt.Errorf("Must set an identifier")
 	}
+	if cli.adminListenAddr != "" && cli.adminToken == "" {
+		return fmt.Errorf("Must set an admin token to serve the admin API")
+	}
+	responders := make(map[string]bool, len(cli.upstreamResponders))
+	for _, r := range cli.upstreamResponders {
+		responders[r.issuer.String()] = true
+	}
+	var certIssuers, policyIssuers, transportIssuers, requestIssuers, weightIssuers []string
+	for issuer := range cli.issuerCerts {
+		certIssuers = append(certIssuers, issuer)
+	}
+	for issuer := range cli.headerPolicies {
+		policyIssuers = append(policyIssuers, issuer)
+	}
+	for issuer := range cli.transports {
+		transportIssuers = append(transportIssuers, issuer)
+	}
+	for issuer := range cli.requestOptions {
+		requestIssuers = append(requestIssuers, issuer)
+	}
+	for issuer := range cli.weights {
+		weightIssuers = append(weightIssuers, issuer)
+	}
+	for _, setting := range []struct {
+		label   string
+		issuers []string
+	}{
+		{"Issuer certificates", certIssuers},
+		{"Header policies", policyIssuers},
+		{"Transport options", transportIssuers},
+		{"Request options", requestIssuers},
+		{"Upstream weights", weightIssuers},
+	} {
+		err := checkIssuersHaveResponders(responders, setting.label, setting.issuers)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range cli.upstreamResponders {
+		weights, ok := cli.weights[r.issuer.String()]
+		if ok && len(weights) != len(r.urls) {
+			return fmt.Errorf("Upstream weights for %s number %d, for %d URLs", r.issuer.String(), len(weights), len(r.urls))
+		}
+	}
 	return nil
 }
 
-// Run the command, obeying the context.
-func (cli *CLI) Run(ctx context.Context) error {
-	err := cli.Check(ctx)
-	if err != nil {
-		return err
+// checkIssuersHaveResponders errors for the first of the issuers, which the
+// labelled setting names, without one of the responders.
+func checkIssuersHaveResponders(responders map[string]bool, label string, issuers []string) error {
+	sort.Strings(issuers)
+	for _, issuer := range issuers {
+		if !responders[issuer] {
+			return fmt.Errorf("%s are set for %s, which has no upstream responder", label, issuer)
+		}
 	}
+	return nil
+}
 
-	cli.logger.Infof("Connecting to Redis cache at %s, timeout %s", cli.redisAddr, cli.redisTxTimeout)
+func (cli *CLI) checkRedis() error {
+	modes := 0
+	if len(cli.redisClusterAddrs) > 0 {
+		modes++
+	}
+	if len(cli.redisSentinelAddrs) > 0 {
+		modes++
+		if cli.redisMasterName == "" {
+			return fmt.Errorf("Must set the Redis Sentinel master name")
+		}
+	}
+	if modes == 0 && cli.redisAddr == "" {
+		return fmt.Errorf("Must set Redis address and transaction timeout")
+	}
+	if modes > 1 {
+		return fmt.Errorf("Must choose only one of Redis Cluster or Sentinel")
+	}
+	if cli.redisOptions.TxTimeout == 0 {
+		return fmt.Errorf("Must set Redis address and transaction timeout")
+	}
+	return nil
+}
 
+func (cli *CLI) connectCache(ctx context.Context) (*storage.RedisCache, error) {
 	startCtx, cancelFunc := context.WithTimeout(ctx, time.Second)
+	defer cancelFunc()
+
+	opts := cli.redisOptions
+	settings := fmt.Sprintf("timeout %s, db %d, user %q, password set: %v, TLS: %v",
+		opts.TxTimeout, opts.DB, opts.Username, opts.Password != "", opts.TLSConfig != nil)
+
+	switch {
+	case len(cli.redisClusterAddrs) > 0:
+		cli.logger.Infof("Connecting to Redis Cluster at %v, %s", cli.redisClusterAddrs, settings)
+		return storage.NewRedisClusterCache(startCtx, cli.redisClusterAddrs, opts)
+	case len(cli.redisSentinelAddrs) > 0:
+		cli.logger.Infof("Connecting to Redis master %s through Sentinels at %v, %s", cli.redisMasterName, cli.redisSentinelAddrs, settings)
+		return storage.NewRedisSentinelCache(startCtx, cli.redisMasterName, cli.redisSentinelAddrs, opts)
+	default:
+		cli.logger.Infof("Connecting to Redis cache at %s, %s", cli.redisAddr, settings)
+		return storage.NewRedisCache(startCtx, cli.redisAddr, opts)
+	}
+}
 
-	remoteCache, err := storage.NewRedisCache(startCtx, cli.redisAddr, cli.redisTxTimeout)
+// newStore connects to the cache and builds the store of responses, with the
+// configured upstream responders.
+func (cli *CLI) newStore(ctx context.Context) (storage.RemoteCache, *repo.OcspStore, error) {
+	redisCache, err := cli.connectCache(ctx)
 	if err != nil {
-		cancelFunc()
-		return err
+		return nil, nil, err
 	}
-	cancelFunc()
+	var remoteCache storage.RemoteCache = redisCache
+	if cli.memoryCacheEntries > 0 {
+		cli.logger.Infof("Keeping up to %d responses in memory, for up to %s", cli.memoryCacheEntries, cli.memoryCacheLife)
+		memoryCache, err := storage.NewMemoryCache(redisCache, cli.memoryCacheEntries, cli.memoryCacheLife)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = memoryCache.ShareInvalidations(ctx, redisCache)
+		if err != nil {
+			return nil, nil, err
+		}
+		remoteCache = memoryCache
+	}
+
+	ttlPolicy := cli.TTLPolicy()
+	cli.logger.Infof("TTL policy good: %+v revoked: %+v unknown: %+v", ttlPolicy.Good, ttlPolicy.Revoked, ttlPolicy.Unknown)
 
-	store := repo.NewOcspStore(cli.logger, remoteCache, cli.lifespan, time.Hour)
+	store := repo.NewOcspStore(cli.logger, remoteCache, ttlPolicy)
+	store.SetMaxClockSkew(cli.maxClockSkew)
+	cli.logger.Infof("Encoding cached responses with %s", cli.cacheEncoding)
+	store.SetEncoding(cli.cacheEncoding)
+	if cli.staleLifespan > 0 {
+		cli.logger.Infof("Serving stale responses for up to %s, revalidate in background: %v", cli.staleLifespan, cli.revalidateStale)
+		store.EnableStaleServing(cli.staleLifespan, cli.revalidateStale)
+	}
+	if cli.fetchLeaseLife > 0 {
+		cli.logger.Infof("Coordinating upstream fetches with lease life %s, wait %s", cli.fetchLeaseLife, cli.fetchLeaseWait)
+		store.EnableFetchLease(cli.identifier, cli.fetchLeaseLife, cli.fetchLeaseWait)
+	}
+	if !cli.popularity {
+		cli.logger.Infof("Not tracking the popularity of serials")
+		store.DisablePopularityTracking()
+	}
+	if cli.legacyKeyFallback {
+		cli.logger.Infof("Falling back to legacy cache keys")
+		store.EnableLegacyKeyFallback()
+	}
+	if cli.refreshOptions.Interval > 0 {
+		cli.logger.Infof("Tracking requests over the last %s for refreshing", cli.refreshWindow)
+		store.EnableAccessTracking(cli.refreshWindow)
+	}
 
+	cli.logger.Infof("Retrying upstream fetches: %+v, ejecting failing responders: %+v, circuit breakers: %+v", cli.retry, cli.health, cli.breaker)
 	for _, r := range cli.upstreamResponders {
-		upstreamFetcher, err := fetcher.NewUpstreamFetcher(r.responderUrl, cli.identifier)
+		transport, ok := cli.transports[r.issuer.String()]
+		if !ok {
+			transport = cli.transport
+		}
+		cli.logger.Infof("Transport for issuer %s: %+v", r.issuer, transport)
+		request, ok := cli.requestOptions[r.issuer.String()]
+		if !ok {
+			request = cli.request
+		}
+		cli.logger.Infof("Requests for issuer %s: method %s, GET paths up to %d, %s encoding", r.issuer, request.Method, request.MaxGetLength, request.Encoding)
+		weights, weighted := cli.responderWeights(r)
+		order := fetcher.OrderPriority
+		if weighted {
+			order = fetcher.OrderWeighted
+		}
+		group := fetcher.NewUpstreamGroup(order, cli.health)
+		for i, u := range r.urls {
+			upstreamFetcher, err := fetcher.NewUpstreamFetcherWithTransport(u, cli.identifier, transport)
+			if err != nil {
+				return nil, nil, err
+			}
+			upstreamFetcher.SetRequestOptions(request)
+			upstreamFetcher.SetRetryOptions(cli.retry)
+			upstreamFetcher.SetBreakerOptions(cli.breaker, cli.logger)
+			err = group.Add(upstreamFetcher, weights[i])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err = store.AddGroupForIssuer(r.issuer, group)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+		headerPolicy, ok := cli.headerPolicies[r.issuer.String()]
+		if !ok {
+			headerPolicy = cli.headerPolicy
 		}
-		err = store.AddFetcherForIssuer(r.issuer, upstreamFetcher)
+		cli.logger.Infof("Header policy for issuer %s: %s", r.issuer, headerPolicy)
+		store.SetHeaderPolicy(r.issuer, headerPolicy)
+		issuerCert, ok := cli.issuerCerts[r.issuer.String()]
+		if !ok {
+			cli.logger.Warningf("No certificate for issuer %s, its responses won't be verified", r.issuer)
+			continue
+		}
+		err = store.AddIssuerCertificate(r.issuer, issuerCert)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return remoteCache, store, nil
+}
+
+// MigrateKeys rewrites responses cached under the legacy serial-only keys to
+// the current issuer and serial keys. With dryRun set, it only reports what it
+// would do.
+func (cli *CLI) MigrateKeys(ctx context.Context, dryRun bool) error {
+	err := cli.checkRedis()
+	if err != nil {
+		return err
+	}
+
+	remoteCache, err := cli.connectCache(ctx)
+	if err != nil {
+		return err
+	}
+
+	stats, err := repo.MigrateLegacyKeys(ctx, cli.logger, remoteCache, dryRun)
+	cli.logger.Infof("Key migration (dry run: %v) scanned %d, migrated %d, skipped %d, failed %d",
+		dryRun, stats.Scanned, stats.Migrated, stats.Skipped, stats.Failed)
+	if err != nil {
+		return err
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("Failed to migrate %d keys", stats.Failed)
+	}
+	return nil
+}
+
+// Warm fetches and caches the responses for the source's targets, skipping
+// those already cached and fresh unless force is set.
+func (cli *CLI) Warm(ctx context.Context, source repo.WarmSource, force bool) error {
+	if len(cli.upstreamResponders) < 1 {
+		return fmt.Errorf("Must set upstream URL")
+	}
+	err := cli.checkRedis()
+	if err != nil {
+		return err
+	}
+	if cli.lifespan == 0 {
+		return fmt.Errorf("Must set a response lifespan")
+	}
+	if cli.deadline == 0 {
+		return fmt.Errorf("Must set a query deadline")
+	}
+
+	_, store, err := cli.newStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	opts := cli.warmOptions(force)
+	cli.logger.Infof("Warming with concurrency %d, rate %v/s, force: %v", opts.Concurrency, opts.Rate, force)
+	stats, err := store.Warm(ctx, source, opts)
+	cli.logger.Infof("Warming read %d, warmed %d, fresh %d, skipped %d, failed %d",
+		stats.Read, stats.Warmed, stats.Fresh, stats.Skipped, stats.Failed)
+	if err != nil {
+		return err
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("Failed to warm %d serials", stats.Failed)
+	}
+	return nil
+}
+
+// Run the command, obeying the context.
+func (cli *CLI) Run(ctx context.Context) error {
+	err := cli.Check(ctx)
+	if err != nil {
+		return err
+	}
+
+	remoteCache, store, err := cli.newStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Proactive refresh
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	if cli.refreshOptions.Interval > 0 {
+		opts := cli.refreshOptions
+		if opts.Deadline == 0 {
+			opts.Deadline = cli.deadline
+		}
+		scheduler, err := store.NewRefreshScheduler(cli.identifier, opts)
 		if err != nil {
 			return err
 		}
+		cli.logger.Infof("Refreshing every %s up to %s ahead, jitter %s, concurrency %d, rate %v/s",
+			opts.Interval, opts.Ahead, opts.Jitter, opts.Concurrency, opts.Rate)
+		go scheduler.Run(refreshCtx)
 	}
+	go store.RunPopularityDecay(refreshCtx)
 
 	// Health monitoring
 	hc := server.NewHealthCheck(cli.logger, remoteCache)
 	healthHandler := http.NewServeMux()
 	healthHandler.HandleFunc("/", hc.HandleQuery)
+	healthHandler.Handle("/metrics", promhttp.Handler())
+	healthHandler.Handle("/upstreams", server.NewUpstreamsHandler(cli.logger, store))
+	if cli.adminToken != "" && cli.popularity {
+		popularityApi, err := server.NewPopularityAPI(cli.logger, store, cli.adminToken)
+		if err != nil {
+			return err
+		}
+		healthHandler.Handle("/popularity", popularityApi)
+	}
 
 	healthServer := &http.Server{
 		Handler: healthHandler,
@@ -171,6 +779,26 @@ func (cli *CLI) Run(ctx context.Context) error {
 		}
 	}()
 
+	// Administration
+	var adminServer *http.Server
+	if cli.adminListenAddr != "" {
+		adminApi, err := server.NewAdminAPI(cli.logger, store, cli.adminToken, cli.deadline)
+		if err != nil {
+			return err
+		}
+		adminApi.SetWarmOptions(cli.warmOptions(false))
+		adminServer = &http.Server{
+			Handler: adminApi,
+			Addr:    cli.adminListenAddr,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				cli.logger.Errf("Couldn't start admin server: %v", err)
+			}
+		}()
+		cli.logger.Infof("Admin API Serving on %v", adminServer.Addr)
+	}
+
 	// Web-client interaction
 	frontEnd, err := server.NewOcspFrontEnd(cli.logger, store, cli.deadline)
 	if err != nil {
@@ -190,8 +818,12 @@ func (cli *CLI) Run(ctx context.Context) error {
 		cli.logger.Infof("Signal caught, HTTP server shutting down.")
 
 		// We received an interrupt signal, shut down.
+		stopRefresh()
 		_ = ocspServer.Shutdown(ctx)
 		_ = healthServer.Shutdown(ctx)
+		if adminServer != nil {
+			_ = adminServer.Shutdown(ctx)
+		}
 		done <- true
 	}()
 
@@ -200,7 +832,10 @@ func (cli *CLI) Run(ctx context.Context) error {
 	cli.logger.Infof("OCSP Serving on %v, Health Serving on %v", ocspServer.Addr, healthServer.Addr)
 
 	for _, r := range cli.upstreamResponders {
-		cli.logger.Infof("Responder key ID: %s url: %s", r.issuer, r.responderUrl.String())
+		weights, _ := cli.responderWeights(r)
+		for i, u := range r.urls {
+			cli.logger.Infof("Responder key ID: %s url: %s weight: %d", r.issuer, u.String(), weights[i])
+		}
 	}
 
 	if err := ocspServer.ListenAndServe(); err != http.ErrServerClosed {
@@ -6,9 +6,22 @@ package cli
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	"golang.org/x/crypto/ocsp"
 )
 
 const (
@@ -49,6 +62,34 @@ func TestRunWithoutRedis(t *testing.T) {
 	}
 }
 
+func TestCheckRedisModes(t *testing.T) {
+	t.Parallel()
+	base := func() *CLI {
+		return New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+			WithCacheLifespan(time.Hour).
+			WithIdentifier("test").
+			WithConnectionDeadline(time.Second).
+			WithListenAddr(":12345")
+	}
+
+	if err := base().WithRedisCluster([]string{"a:6379", "b:6379"}, storage.RedisOptions{TxTimeout: time.Second}).Check(context.TODO()); err != nil {
+		t.Errorf("Cluster: %v", err)
+	}
+	if err := base().WithRedisSentinel("mymaster", []string{"a:26379"}, storage.RedisOptions{TxTimeout: time.Second}).Check(context.TODO()); err != nil {
+		t.Errorf("Sentinel: %v", err)
+	}
+	if err := base().WithRedisSentinel("", []string{"a:26379"}, storage.RedisOptions{TxTimeout: time.Second}).Check(context.TODO()); err == nil {
+		t.Error("Expected an error for Sentinel without a master name")
+	}
+	if err := base().WithRedisCluster([]string{"a:6379"}, storage.RedisOptions{TxTimeout: time.Second}).
+		WithRedisSentinel("mymaster", []string{"a:26379"}, storage.RedisOptions{TxTimeout: time.Second}).Check(context.TODO()); err == nil {
+		t.Error("Expected an error for both Cluster and Sentinel")
+	}
+	if err := base().WithRedisCluster([]string{"a:6379"}, storage.RedisOptions{}).Check(context.TODO()); err == nil {
+		t.Error("Expected an error without a transaction timeout")
+	}
+}
+
 func TestCheck(t *testing.T) {
 	t.Parallel()
 	setting, ok := os.LookupEnv("RedisHost")
@@ -60,7 +101,7 @@ func TestCheck(t *testing.T) {
 	err := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
 		WithCacheLifespan(time.Hour).
 		WithIdentifier("test").
-		WithRedis(setting, time.Hour).
+		WithRedis(setting, storage.RedisOptions{TxTimeout: time.Hour}).
 		WithConnectionDeadline(time.Second).
 		WithListenAddr(":12345").
 		WithHealthListenAddr(":23456").Check(context.TODO())
@@ -68,3 +109,178 @@ func TestCheck(t *testing.T) {
 		t.Fatalf("Got an error: %v", err)
 	}
 }
+
+func TestTTLPolicy(t *testing.T) {
+	t.Parallel()
+	revoked := repo.TTLRule{Fraction: 1.0, MaxLife: 96 * time.Hour, MinLife: time.Hour}
+	c := New().WithCacheLifespan(12*time.Hour).
+		WithMinimumCacheLife(5*time.Minute).
+		WithTTLRule(ocsp.Revoked, revoked)
+
+	policy := c.TTLPolicy()
+	expected := repo.TTLRule{Fraction: repo.DefaultTTLFraction, MaxLife: 12 * time.Hour, MinLife: 5 * time.Minute}
+	if policy.Good != expected || policy.Unknown != expected {
+		t.Errorf("Expected default rule %+v, got %+v", expected, policy)
+	}
+	if policy.Revoked != revoked {
+		t.Errorf("Expected revoked rule %+v, got %+v", revoked, policy.Revoked)
+	}
+}
+
+func testCertificatePEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test issuer"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestIssuerCertificateWithoutResponder(t *testing.T) {
+	t.Parallel()
+	err := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+		WithIssuerCertificate("0000000000000000000000000000000000000000", testCertificatePEM(t)).
+		WithCacheLifespan(time.Hour).
+		WithIdentifier("test").
+		WithRedis("localhost:6379", storage.RedisOptions{TxTimeout: time.Hour}).
+		WithConnectionDeadline(time.Second).
+		WithListenAddr(":12345").Check(context.TODO())
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestIssuerCertificateNotPEM(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic")
+		}
+	}()
+	New().WithIssuerCertificate(fakeIssuerKeyId, []byte("not a certificate"))
+}
+
+func TestHeaderPolicyWithoutResponder(t *testing.T) {
+	t.Parallel()
+	c := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+		WithCacheLifespan(time.Hour).
+		WithIdentifier("test").
+		WithRedis("localhost:6379", storage.RedisOptions{TxTimeout: time.Hour}).
+		WithConnectionDeadline(time.Second).
+		WithListenAddr(":12345")
+	if err := c.WithHeaderPolicy(fakeIssuerKeyId, repo.HeaderPolicyRequire).Check(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WithHeaderPolicy("0000000000000000000000000000000000000000", repo.HeaderPolicyPassthrough).Check(context.TODO()); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestUpstreamResponderURLs(t *testing.T) {
+	t.Parallel()
+	c := New().WithUpstreamResponder(fakeIssuerKeyId, "http://a.example, http://b.example/ocsp")
+	r := c.upstreamResponders[0]
+	if len(r.urls) != 2 || r.urls[0].String() != "http://a.example" || r.urls[1].String() != "http://b.example/ocsp" {
+		t.Errorf("Unexpected responder %+v", r)
+	}
+	if weights, weighted := c.responderWeights(r); weighted || len(weights) != 2 || weights[0] != 1 || weights[1] != 1 {
+		t.Errorf("Expected unweighted URLs, got %v", weights)
+	}
+
+	c.WithUpstreamWeights(fakeIssuerKeyId, []int{1, 3})
+	if weights, weighted := c.responderWeights(r); !weighted || weights[0] != 1 || weights[1] != 3 {
+		t.Errorf("Expected weights 1 and 3, got %v", weights)
+	}
+}
+
+func TestUpstreamWeightsChecked(t *testing.T) {
+	t.Parallel()
+	c := New().WithUpstreamResponder(fakeIssuerKeyId, "http://a.example,http://b.example").
+		WithCacheLifespan(time.Hour).
+		WithIdentifier("test").
+		WithRedis("localhost:6379", storage.RedisOptions{TxTimeout: time.Hour}).
+		WithConnectionDeadline(time.Second).
+		WithListenAddr(":12345")
+	if err := c.WithUpstreamWeights(fakeIssuerKeyId, []int{3, 1}).Check(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WithUpstreamWeights(fakeIssuerKeyId, []int{3}).Check(context.TODO()); err == nil {
+		t.Error("Expected an error for a weight short")
+	}
+	c.WithUpstreamWeights(fakeIssuerKeyId, []int{3, 1})
+	if err := c.WithUpstreamWeights("0000000000000000000000000000000000000000", []int{1}).Check(context.TODO()); err == nil {
+		t.Error("Expected an error for weights without a responder")
+	}
+}
+
+func TestTransportWithoutResponder(t *testing.T) {
+	t.Parallel()
+	c := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+		WithCacheLifespan(time.Hour).
+		WithIdentifier("test").
+		WithRedis("localhost:6379", storage.RedisOptions{TxTimeout: time.Hour}).
+		WithConnectionDeadline(time.Second).
+		WithListenAddr(":12345")
+	if err := c.WithTransport(fakeIssuerKeyId, fetcher.DefaultTransportOptions).Check(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WithTransport("0000000000000000000000000000000000000000", fetcher.DefaultTransportOptions).Check(context.TODO()); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestRequestOptionsWithoutResponder(t *testing.T) {
+	t.Parallel()
+	c := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+		WithCacheLifespan(time.Hour).
+		WithIdentifier("test").
+		WithRedis("localhost:6379", storage.RedisOptions{TxTimeout: time.Hour}).
+		WithConnectionDeadline(time.Second).
+		WithListenAddr(":12345")
+	if err := c.WithRequestOptions(fakeIssuerKeyId, fetcher.DefaultRequestOptions).Check(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WithRequestOptions("0000000000000000000000000000000000000000", fetcher.DefaultRequestOptions).Check(context.TODO()); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestAdminListenAddrWithoutToken(t *testing.T) {
+	t.Parallel()
+	c := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+		WithCacheLifespan(time.Hour).
+		WithIdentifier("test").
+		WithRedis("localhost:6379", storage.RedisOptions{TxTimeout: time.Hour}).
+		WithConnectionDeadline(time.Second).
+		WithListenAddr(":12345")
+	if err := c.WithAdminListenAddr(":12346", "").Check(context.TODO()); err == nil {
+		t.Fatal("Expected error")
+	}
+	if err := c.WithAdminListenAddr(":12346", "secret").Check(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWarmWithoutConfiguration(t *testing.T) {
+	t.Parallel()
+	source := repo.SerialSource(strings.NewReader(""))
+	if err := New().Warm(context.TODO(), source, false); err == nil {
+		t.Error("Expected an error without upstream responders")
+	}
+	err := New().WithUpstreamResponder(fakeIssuerKeyId, "localhost/path").
+		WithCacheLifespan(time.Hour).
+		WithConnectionDeadline(time.Second).
+		Warm(context.TODO(), source, false)
+	if err == nil {
+		t.Error("Expected an error without Redis")
+	}
+}
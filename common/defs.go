@@ -11,6 +11,8 @@ const (
 	HeaderLastModified = "Last-Modified"
 	HeaderExpires      = "Expires"
 	HeaderContentType  = "Content-Type"
+	HeaderAge          = "Age"
+	HeaderWarning      = "Warning"
 	MimeOcspResponse   = "application/ocsp-response"
 	MimeOcspRequest    = "application/ocsp-request"
 )
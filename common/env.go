@@ -5,7 +5,9 @@ package common
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,6 +32,46 @@ func GetEnvDuration(name string, def time.Duration) time.Duration {
 	return dur
 }
 
+func GetEnvBool(name string, def bool) bool {
+	setting, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(setting)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+func GetEnvInt(name string, def int) int {
+	setting, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(setting)
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// GetEnvSecret reads a secret from the file named by the variable name+"File",
+// if that is set, so that secrets needn't be placed in the environment.
+// Otherwise it reads the variable name itself. Trailing newlines are dropped
+// from files.
+func GetEnvSecret(name string, def string) (string, error) {
+	path, ok := os.LookupEnv(name + "File")
+	if !ok {
+		return GetEnvString(name, def), nil
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Reading %sFile: %v", name, err)
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
 func GetEnvMap(name string) (map[string]string, error) {
 	var nilmap map[string]string
 
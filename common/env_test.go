@@ -5,7 +5,9 @@
 package common
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -49,6 +51,52 @@ func TestEnvDuration(t *testing.T) {
 	}
 }
 
+func TestEnvInt(t *testing.T) {
+	t.Parallel()
+
+	x := GetEnvInt("TestEnvInt", 10)
+	if x != 10 {
+		t.Errorf("Expected default, got %v", x)
+	}
+
+	_ = os.Setenv("TestEnvInt", "5000")
+
+	x = GetEnvInt("TestEnvInt", 10)
+	if x != 5000 {
+		t.Errorf("Expected 5000, got %v", x)
+	}
+
+	_ = os.Setenv("TestEnvInt", "lots")
+
+	x = GetEnvInt("TestEnvInt", 10)
+	if x != 10 {
+		t.Errorf("Expected default for garbage, got %v", x)
+	}
+}
+
+func TestEnvBool(t *testing.T) {
+	t.Parallel()
+
+	x := GetEnvBool("TestEnvBool", true)
+	if x != true {
+		t.Errorf("Expected default, got %v", x)
+	}
+
+	_ = os.Setenv("TestEnvBool", "false")
+
+	x = GetEnvBool("TestEnvBool", true)
+	if x != false {
+		t.Errorf("Expected false, got %v", x)
+	}
+
+	_ = os.Setenv("TestEnvBool", "maybe")
+
+	x = GetEnvBool("TestEnvBool", true)
+	if x != true {
+		t.Errorf("Expected default for unparseable value, got %v", x)
+	}
+}
+
 func TestEnvMap(t *testing.T) {
 	t.Parallel()
 
@@ -105,3 +153,38 @@ func TestEnvMap(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestEnvSecret(t *testing.T) {
+	t.Parallel()
+
+	x, err := GetEnvSecret("TestEnvSecret", "default")
+	if err != nil || x != "default" {
+		t.Errorf("Expected default, got %v %v", x, err)
+	}
+
+	_ = os.Setenv("TestEnvSecret", "from-env")
+
+	x, err = GetEnvSecret("TestEnvSecret", "default")
+	if err != nil || x != "from-env" {
+		t.Errorf("Expected from-env, got %v %v", x, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "secret")
+	err = ioutil.WriteFile(path, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Setenv("TestEnvSecretFile", path)
+
+	x, err = GetEnvSecret("TestEnvSecret", "default")
+	if err != nil || x != "from-file" {
+		t.Errorf("Expected the file to win, got %v %v", x, err)
+	}
+
+	_ = os.Setenv("TestEnvSecretFile", path+".missing")
+
+	_, err = GetEnvSecret("TestEnvSecret", "default")
+	if err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
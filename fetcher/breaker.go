@@ -0,0 +1,249 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+// ErrBreakerOpen fails fetches from a responder whose circuit breaker is open,
+// without sending them.
+var ErrBreakerOpen = errors.New("Circuit breaker open")
+
+// BreakerState is whether a circuit breaker lets fetches through.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every fetch through, counting failures
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a few trial fetches through, to see whether the
+	// responder recovered
+	BreakerHalfOpen
+	// BreakerOpen fails every fetch without sending it
+	BreakerOpen
+)
+
+var breakerStateNames = map[BreakerState]string{
+	BreakerClosed:   "closed",
+	BreakerHalfOpen: "half_open",
+	BreakerOpen:     "open",
+}
+
+func (s BreakerState) String() string {
+	name, ok := breakerStateNames[s]
+	if !ok {
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+	return name
+}
+
+type BreakerOptions struct {
+	// ErrorRate opens the breaker once this fraction of the fetches in a
+	// window fail. Zero disables the breaker.
+	ErrorRate float64
+	// MinRequests is how many fetches a window needs before the breaker opens
+	MinRequests int
+	// Window is how long failures are counted for before starting over
+	Window time.Duration
+	// OpenFor is how long the breaker stays open before trying the responder
+	OpenFor time.Duration
+	// Trials is how many fetches the half-open breaker lets through. If they
+	// all succeed it closes, and if any fails it opens again.
+	Trials int
+}
+
+var DefaultBreakerOptions = BreakerOptions{
+	ErrorRate:   0.5,
+	MinRequests: 20,
+	Window:      10 * time.Second,
+	OpenFor:     30 * time.Second,
+	Trials:      1,
+}
+
+// ParseBreakerOptions reads options from settings with the keys "errorRate",
+// "minRequests", "window", "openFor" and "trials", as produced by
+// common.GetEnvMap. Missing keys keep the value in def.
+func ParseBreakerOptions(settings map[string]string, def BreakerOptions) (BreakerOptions, error) {
+	opts := def
+	for k, v := range settings {
+		var err error
+		switch k {
+		case "errorRate":
+			opts.ErrorRate, err = strconv.ParseFloat(v, 64)
+			if err == nil && (opts.ErrorRate < 0 || opts.ErrorRate > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "minRequests":
+			opts.MinRequests, err = strconv.Atoi(v)
+		case "window":
+			opts.Window, err = time.ParseDuration(v)
+		case "openFor":
+			opts.OpenFor, err = time.ParseDuration(v)
+		case "trials":
+			opts.Trials, err = strconv.Atoi(v)
+			if err == nil && opts.Trials < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return def, fmt.Errorf("Breaker option %s=%s: %v", k, v, err)
+		}
+	}
+	return opts, nil
+}
+
+// SetBreakerOptions sets when the fetcher stops sending fetches to a failing
+// responder, logging each change of state. Set it before the fetcher is in
+// use.
+func (uf *UpstreamFetcher) SetBreakerOptions(opts BreakerOptions, logger blog.Logger) {
+	if opts.ErrorRate <= 0 {
+		uf.breaker = nil
+		return
+	}
+	uf.breaker = newCircuitBreaker(opts, uf.Responder(), logger, time.Now())
+}
+
+// BreakerState returns the state of the fetcher's circuit breaker, which is
+// always closed without one.
+func (uf *UpstreamFetcher) BreakerState(now time.Time) BreakerState {
+	if uf.breaker == nil {
+		return BreakerClosed
+	}
+	return uf.breaker.State(now)
+}
+
+type circuitBreaker struct {
+	opts      BreakerOptions
+	responder string
+	logger    blog.Logger
+
+	mu          sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	trials      int
+	successes   int
+}
+
+func newCircuitBreaker(opts BreakerOptions, responder string, logger blog.Logger, now time.Time) *circuitBreaker {
+	upstreamBreakerState.WithLabelValues(responder).Set(float64(BreakerClosed))
+	return &circuitBreaker{
+		opts:        opts,
+		responder:   responder,
+		logger:      logger,
+		windowStart: now,
+	}
+}
+
+func (b *circuitBreaker) State(now time.Time) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	return b.state
+}
+
+// Allow tells whether a fetch may be sent now. Each allowed fetch must be
+// followed by a call to Record.
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.trials+b.successes >= b.opts.Trials {
+			return false
+		}
+		b.trials++
+		return true
+	}
+	return false
+}
+
+// Record counts how an allowed fetch went. Fetches the caller canceled say
+// nothing of the responder, and only free their trial.
+func (b *circuitBreaker) Record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	canceled := errors.Is(err, context.Canceled)
+
+	switch b.state {
+	case BreakerClosed:
+		if canceled {
+			return
+		}
+		if now.Sub(b.windowStart) >= b.opts.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if err != nil {
+			b.failures++
+		}
+		if b.requests >= b.opts.MinRequests && float64(b.failures) >= b.opts.ErrorRate*float64(b.requests) {
+			b.open(now)
+		}
+	case BreakerHalfOpen:
+		if b.trials > 0 {
+			b.trials--
+		}
+		switch {
+		case canceled:
+		case err != nil:
+			b.open(now)
+		default:
+			b.successes++
+			if b.successes >= b.opts.Trials {
+				b.setState(BreakerClosed)
+				b.windowStart = now
+				b.requests = 0
+				b.failures = 0
+			}
+		}
+	}
+}
+
+// advance half-opens the breaker once it was open long enough.
+func (b *circuitBreaker) advance(now time.Time) {
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		b.setState(BreakerHalfOpen)
+		b.trials = 0
+		b.successes = 0
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.openUntil = now.Add(b.opts.OpenFor)
+	b.setState(BreakerOpen)
+}
+
+func (b *circuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case BreakerOpen:
+		b.logger.Warningf("Circuit breaker for %s %s, failing fetches until %s", b.responder, state, b.openUntil.Format(time.RFC3339))
+	default:
+		b.logger.Infof("Circuit breaker for %s %s", b.responder, state)
+	}
+	b.state = state
+	upstreamBreakerState.WithLabelValues(b.responder).Set(float64(state))
+	upstreamBreakerTransitions.WithLabelValues(b.responder, state.String()).Inc()
+}
@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blog "github.com/letsencrypt/boulder/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseBreakerOptions(t *testing.T) {
+	t.Parallel()
+	opts, err := ParseBreakerOptions(map[string]string{
+		"errorRate":   "0.25",
+		"minRequests": "10",
+		"window":      "1m",
+		"openFor":     "5s",
+		"trials":      "3",
+	}, DefaultBreakerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BreakerOptions{0.25, 10, time.Minute, 5 * time.Second, 3}
+	if opts != expected {
+		t.Errorf("Expected %+v, got %+v", expected, opts)
+	}
+
+	for _, bad := range []map[string]string{
+		{"errorRate": "2"},
+		{"minRequests": "some"},
+		{"trials": "0"},
+		{"unknown": "1"},
+	} {
+		_, err := ParseBreakerOptions(bad, DefaultBreakerOptions)
+		if err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+	logger := blog.NewMock()
+	responder := "http://ocsp.example.com/TestCircuitBreaker"
+	now := time.Now()
+	b := newCircuitBreaker(BreakerOptions{ErrorRate: 0.5, MinRequests: 4, Window: time.Minute, OpenFor: 10 * time.Second, Trials: 2}, responder, logger, now)
+	failure := errors.New("down")
+	record := func(err error) {
+		t.Helper()
+		if !b.Allow(now) {
+			t.Fatalf("Expected the breaker to allow a fetch while %s", b.State(now))
+		}
+		b.Record(err, now)
+	}
+
+	// Too few fetches to tell, and canceled ones don't count
+	record(failure)
+	record(failure)
+	record(context.Canceled)
+	record(nil)
+	if b.State(now) != BreakerClosed {
+		t.Fatalf("Expected the breaker closed, got %s", b.State(now))
+	}
+	record(failure)
+	if b.State(now) != BreakerOpen || b.Allow(now) {
+		t.Fatalf("Expected the breaker open at 3 failures of 4, got %s", b.State(now))
+	}
+	if state := testutil.ToFloat64(upstreamBreakerState.WithLabelValues(responder)); state != float64(BreakerOpen) {
+		t.Errorf("Expected the state metric open, got %f", state)
+	}
+
+	// Half-open lets the trials through, one at a time
+	now = now.Add(10 * time.Second)
+	if b.State(now) != BreakerHalfOpen {
+		t.Fatalf("Expected the breaker half-open, got %s", b.State(now))
+	}
+	if !b.Allow(now) || !b.Allow(now) || b.Allow(now) {
+		t.Error("Expected the half-open breaker to allow 2 trials")
+	}
+	b.Record(context.Canceled, now)
+	if !b.Allow(now) {
+		t.Error("Expected a canceled trial to free its place")
+	}
+	b.Record(nil, now)
+	b.Record(nil, now)
+	if b.State(now) != BreakerClosed {
+		t.Fatalf("Expected the breaker closed after the trials succeeded, got %s", b.State(now))
+	}
+
+	// Failures from past windows are forgotten
+	for i := 0; i < 3; i++ {
+		record(failure)
+	}
+	now = now.Add(time.Minute)
+	record(nil)
+	record(nil)
+	record(failure)
+	if b.State(now) != BreakerClosed {
+		t.Fatalf("Expected the breaker closed in a new window, got %s", b.State(now))
+	}
+	record(failure)
+	if b.State(now) != BreakerOpen {
+		t.Fatalf("Expected the breaker open at 2 failures of 4, got %s", b.State(now))
+	}
+
+	// A failed trial opens it again
+	now = now.Add(10 * time.Second)
+	record(failure)
+	if b.State(now) != BreakerOpen || b.State(now.Add(9*time.Second)) != BreakerOpen {
+		t.Errorf("Expected the breaker open again, got %s", b.State(now))
+	}
+
+	if count := testutil.ToFloat64(upstreamBreakerTransitions.WithLabelValues(responder, "open")); count != 3 {
+		t.Errorf("Expected 3 transitions to open, got %f", count)
+	}
+	if logs := logger.GetAllMatching("Circuit breaker for " + responder); len(logs) != 6 {
+		t.Errorf("Expected each change of state logged, got %v", logs)
+	}
+}
+
+func TestFetchBreakerOpen(t *testing.T) {
+	t.Parallel()
+	fr := newFailingResponder(t, unavailable, unavailable)
+	f := newRetryingFetcher(t, fr.url, RetryOptions{})
+	f.SetBreakerOptions(BreakerOptions{ErrorRate: 1, MinRequests: 2, Window: time.Hour, OpenFor: time.Hour, Trials: 1}, blog.NewMock())
+
+	for i := 0; i < 2; i++ {
+		_, _, err := f.Fetch(context.Background(), []byte{})
+		if class := errorClass(err); class != ErrorClassStatus {
+			t.Errorf("Expected the upstream's error, got %v", err)
+		}
+	}
+	if f.BreakerState(time.Now()) != BreakerOpen {
+		t.Fatalf("Expected the breaker open, got %s", f.BreakerState(time.Now()))
+	}
+
+	_, _, err := f.Fetch(context.Background(), []byte{})
+	if !errors.Is(err, ErrBreakerOpen) || errorClass(err) != ErrorClassBreakerOpen {
+		t.Errorf("Expected ErrBreakerOpen, got %v", err)
+	}
+	if fr.Hits() != 2 {
+		t.Errorf("Expected no request while the breaker is open, got %d", fr.Hits())
+	}
+	if count := testutil.ToFloat64(upstreamErrors.WithLabelValues(f.Responder(), ErrorClassBreakerOpen)); count != 1 {
+		t.Errorf("Expected the fast failure counted, got %f", count)
+	}
+
+	f.SetBreakerOptions(BreakerOptions{}, blog.NewMock())
+	_, _, err = f.Fetch(context.Background(), []byte{})
+	if err != nil || f.BreakerState(time.Now()) != BreakerClosed {
+		t.Errorf("Expected no breaker with a zero error rate, got %v", err)
+	}
+}
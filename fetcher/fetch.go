@@ -8,15 +8,20 @@ package fetcher
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/jcjones/ocsp-l2-cache/common"
 )
 
+// maxDrainBytes bounds how much of an unwanted response body is read, so that
+// its connection can be reused, before giving up on the connection instead.
+const maxDrainBytes = 64 << 10
+
 var (
 	RelevantHeaders = []string{
 		common.HeaderCacheControl,
@@ -40,21 +45,39 @@ func getRelevantHeaders(h http.Header) map[string]string {
 }
 
 type UpstreamFetcher struct {
-	upstreamUrl url.URL
-	maxGetLen   int
-	identifier  string
+	upstreamUrl      url.URL
+	request          RequestOptions
+	identifier       string
+	client           *http.Client
+	transport        *http.Transport
+	maxResponseBytes int64
+	retry            RetryOptions
+	latency          *latencyWindow
+	breaker          *circuitBreaker
 }
 
 func NewUpstreamFetcher(upstreamUrl url.URL, identifier string) (*UpstreamFetcher, error) {
-	maxGetLen := 254 - len(upstreamUrl.Path)
-	if maxGetLen < 0 {
+	return NewUpstreamFetcherWithTransport(upstreamUrl, identifier, DefaultTransportOptions)
+}
+
+// NewUpstreamFetcherWithTransport fetches from upstreamUrl over connections
+// tuned with opts, pooled for this fetcher and its copies.
+func NewUpstreamFetcherWithTransport(upstreamUrl url.URL, identifier string, opts TransportOptions) (*UpstreamFetcher, error) {
+	if len(upstreamUrl.Path) > 254 {
 		return nil, fmt.Errorf("Illegal URL, how did we get here?")
 	}
 
+	transport := newTransport(opts, upstreamUrl.String())
 	return &UpstreamFetcher{
 		upstreamUrl,
-		maxGetLen,
+		DefaultRequestOptions,
 		identifier,
+		&http.Client{Transport: transport},
+		transport,
+		opts.MaxResponseBytes,
+		RetryOptions{},
+		newLatencyWindow(),
+		nil,
 	}, nil
 }
 
@@ -69,69 +92,107 @@ func (uf *UpstreamFetcher) ocspPost(ctx context.Context, ocspReq []byte) ([]byte
 		return []byte{}, nil, err
 	}
 
-	uf.setHeaders(&req.Header)
 	req.Header.Set(common.HeaderContentType, common.MimeOcspRequest)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return []byte{}, nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return []byte{}, nil, fmt.Errorf(resp.Status)
-	}
-	contentType := resp.Header.Get(common.HeaderContentType)
-	if contentType != common.MimeOcspResponse {
-		return []byte{}, nil, fmt.Errorf("Unexpected content-type: %s", contentType)
-	}
-
-	headers := getRelevantHeaders(resp.Header)
-
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	return data, headers, err
+	return uf.do(req)
 }
 
 func (uf *UpstreamFetcher) ocspGet(ctx context.Context, ocspReq []byte) ([]byte, map[string]string, error) {
-	b64Req := base64.RawURLEncoding.EncodeToString(ocspReq)
-	url := uf.upstreamUrl
-	url.Path += "/" + b64Req
+	url := uf.getURL(ocspReq)
 	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
 	if err != nil {
 		return []byte{}, nil, err
 	}
 
+	return uf.do(req)
+}
+
+// do sends the request upstream and reads its OCSP response, classifying any
+// error along the way.
+func (uf *UpstreamFetcher) do(req *http.Request) ([]byte, map[string]string, error) {
 	uf.setHeaders(&req.Header)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := uf.client.Do(withConnTrace(req, uf.Responder()))
 	if err != nil {
 		return []byte{}, nil, err
 	}
+	defer func() {
+		// Keep-alive connections are only reused once their body is read
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+		resp.Body.Close()
+	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return []byte{}, nil, fmt.Errorf(resp.Status)
+		return []byte{}, nil, &fetchError{ErrorClassStatus, &statusError{resp.StatusCode, resp.Status}}
 	}
 
 	contentType := resp.Header.Get(common.HeaderContentType)
 	if contentType != common.MimeOcspResponse {
-		return []byte{}, nil, fmt.Errorf("Unexpected content-type: %s", contentType)
+		return []byte{}, nil, &fetchError{ErrorClassContentType, fmt.Errorf("Unexpected content-type: %s", contentType)}
 	}
 
 	headers := getRelevantHeaders(resp.Header)
 
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	return data, headers, err
+	var body io.Reader = resp.Body
+	if uf.maxResponseBytes > 0 {
+		body = io.LimitReader(resp.Body, uf.maxResponseBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return data, headers, &fetchError{ErrorClassBody, err}
+	}
+	if uf.maxResponseBytes > 0 && int64(len(data)) > uf.maxResponseBytes {
+		return []byte{}, nil, &fetchError{ErrorClassBody, fmt.Errorf("%w, over %d bytes", errResponseTooLarge, uf.maxResponseBytes)}
+	}
+	return data, headers, nil
 }
 
-func (uf *UpstreamFetcher) useGetRequest(ocspReq []byte) bool {
-	return base64.RawURLEncoding.EncodedLen(len(ocspReq)) <= uf.maxGetLen
+// Fetch sends the OCSP request upstream, retrying failures with backoff as
+// long as ctx allows, and hedging slow requests if so configured. While the
+// circuit breaker is open it fails at once with ErrBreakerOpen.
+func (uf *UpstreamFetcher) Fetch(ctx context.Context, ocspReq []byte) ([]byte, map[string]string, error) {
+	if uf.breaker == nil {
+		return uf.fetchWithRetries(ctx, ocspReq)
+	}
+	if !uf.breaker.Allow(time.Now()) {
+		uf.CountError(ErrorClassBreakerOpen)
+		return []byte{}, nil, &fetchError{ErrorClassBreakerOpen, ErrBreakerOpen}
+	}
+	data, headers, err := uf.fetchWithRetries(ctx, ocspReq)
+	uf.breaker.Record(err, time.Now())
+	return data, headers, err
 }
 
-func (uf *UpstreamFetcher) Fetch(ctx context.Context, ocspReq []byte) ([]byte, map[string]string, error) {
-	if uf.useGetRequest(ocspReq) {
-		return uf.ocspPost(ctx, ocspReq)
+func (uf *UpstreamFetcher) fetchWithRetries(ctx context.Context, ocspReq []byte) ([]byte, map[string]string, error) {
+	for attempt := 1; ; attempt++ {
+		result := uf.hedged(ctx, ocspReq)
+		if result.err == nil || attempt >= uf.retry.Attempts || !retryable(ctx, result.err) {
+			return result.data, result.headers, result.err
+		}
+
+		wait := uf.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return result.data, result.headers, result.err
+		}
+		upstreamRetries.WithLabelValues(uf.Responder()).Inc()
+		select {
+		case <-ctx.Done():
+			return result.data, result.headers, result.err
+		case <-time.After(wait):
+		}
 	}
-	return uf.ocspGet(ctx, ocspReq)
+}
+
+// Responder names the upstream responder in logs and metrics.
+func (uf *UpstreamFetcher) Responder() string {
+	return uf.upstreamUrl.String()
+}
+
+// CloseIdleConnections closes the pooled connections not in use.
+func (uf *UpstreamFetcher) CloseIdleConnections() {
+	uf.transport.CloseIdleConnections()
+}
+
+// CountError counts an error of the class against the upstream responder.
+// Callers use it for responses they reject, with their own classes.
+func (uf *UpstreamFetcher) CountError(class string) {
+	upstreamErrors.WithLabelValues(uf.Responder(), class).Inc()
 }
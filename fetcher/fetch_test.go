@@ -7,10 +7,12 @@ package fetcher
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/jcjones/ocsp-l2-cache/common"
@@ -45,6 +47,36 @@ func TestFetch404(t *testing.T) {
 	}
 }
 
+func TestFetchErrorReusesConnection(t *testing.T) {
+	t.Parallel()
+	var connections int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, strings.Repeat("unavailable ", 4000), http.StatusServiceUnavailable)
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	url, _ := url.Parse(ts.URL)
+	f, err := NewUpstreamFetcher(*url, "TestFetchErrorReusesConnection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, _, err = f.ocspGet(context.TODO(), []byte{})
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("Expected the connection reused, got %d connections", n)
+	}
+}
+
 func TestFetchNoContentType(t *testing.T) {
 	t.Parallel()
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,260 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Order decides which of a group's endpoints is tried first.
+type Order int
+
+const (
+	// OrderPriority tries the endpoints in the order they were added
+	OrderPriority Order = iota
+	// OrderWeighted picks the endpoints at random, in proportion to their
+	// weights
+	OrderWeighted
+)
+
+var orderNames = map[Order]string{
+	OrderPriority: "ordered",
+	OrderWeighted: "weighted",
+}
+
+func (o Order) String() string {
+	name, ok := orderNames[o]
+	if !ok {
+		return fmt.Sprintf("Order(%d)", int(o))
+	}
+	return name
+}
+
+type HealthOptions struct {
+	// Failures is how many failures in a row eject an endpoint
+	Failures int
+	// Cooldown is how long an ejected endpoint is tried only as a last resort.
+	// After it, one more failure ejects the endpoint again.
+	Cooldown time.Duration
+}
+
+var DefaultHealthOptions = HealthOptions{
+	Failures: 3,
+	Cooldown: 30 * time.Second,
+}
+
+// ParseHealthOptions reads options from settings with the keys "failures" and
+// "cooldown", as produced by common.GetEnvMap. Missing keys keep the value in
+// def.
+func ParseHealthOptions(settings map[string]string, def HealthOptions) (HealthOptions, error) {
+	opts := def
+	for k, v := range settings {
+		var err error
+		switch k {
+		case "failures":
+			opts.Failures, err = strconv.Atoi(v)
+			if err == nil && opts.Failures < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "cooldown":
+			opts.Cooldown, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return def, fmt.Errorf("Health option %s=%s: %v", k, v, err)
+		}
+	}
+	return opts, nil
+}
+
+// ParseWeights reads comma-separated weights, such as "3,1", each at least 1.
+func ParseWeights(s string) ([]int, error) {
+	var weights []int
+	for _, w := range strings.Split(s, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(w))
+		if err == nil && weight < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Weight %s: %v", w, err)
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
+
+// EndpointStatus is what an UpstreamGroup knows of one of its endpoints.
+type EndpointStatus struct {
+	URL                 string     `json:"url"`
+	Weight              int        `json:"weight"`
+	Healthy             bool       `json:"healthy"`
+	Breaker             string     `json:"breaker"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+}
+
+type endpoint struct {
+	fetcher *UpstreamFetcher
+	weight  int
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	lastError    string
+	lastFailure  time.Time
+	lastSuccess  time.Time
+}
+
+// UpstreamGroup is the upstream responders of one issuer. Endpoints that keep
+// failing are ejected for a cooldown, during which the others are tried first.
+type UpstreamGroup struct {
+	order     Order
+	health    HealthOptions
+	endpoints []*endpoint
+}
+
+func NewUpstreamGroup(order Order, health HealthOptions) *UpstreamGroup {
+	return &UpstreamGroup{order: order, health: health}
+}
+
+// Add makes the fetcher one of the group's endpoints. The weight only matters
+// to OrderWeighted groups.
+func (g *UpstreamGroup) Add(uf *UpstreamFetcher, weight int) error {
+	if uf == nil {
+		return fmt.Errorf("Fetcher must not be nil")
+	}
+	if weight < 1 {
+		return fmt.Errorf("Weight of %s must be at least 1", uf.Responder())
+	}
+	g.endpoints = append(g.endpoints, &endpoint{fetcher: uf, weight: weight})
+	return nil
+}
+
+// Endpoints returns every endpoint in the order to try them: those not ejected
+// first, then those ejected, soonest back first.
+func (g *UpstreamGroup) Endpoints(now time.Time) []*UpstreamFetcher {
+	var available []*endpoint
+	var ejected []*endpoint
+	ejectedUntil := make(map[*endpoint]time.Time)
+	for _, e := range g.endpoints {
+		e.mu.Lock()
+		until := e.ejectedUntil
+		e.mu.Unlock()
+		if now.Before(until) {
+			ejected = append(ejected, e)
+			ejectedUntil[e] = until
+			continue
+		}
+		available = append(available, e)
+	}
+
+	if g.order == OrderWeighted {
+		available = weightedShuffle(available)
+	}
+	sort.SliceStable(ejected, func(i, j int) bool {
+		return ejectedUntil[ejected[i]].Before(ejectedUntil[ejected[j]])
+	})
+
+	result := make([]*UpstreamFetcher, 0, len(g.endpoints))
+	for _, e := range append(available, ejected...) {
+		result = append(result, e.fetcher)
+	}
+	return result
+}
+
+// weightedShuffle orders the endpoints at random, each next one picked in
+// proportion to its weight among those left.
+func weightedShuffle(endpoints []*endpoint) []*endpoint {
+	left := append([]*endpoint(nil), endpoints...)
+	result := make([]*endpoint, 0, len(left))
+	for len(left) > 0 {
+		total := 0
+		for _, e := range left {
+			total += e.weight
+		}
+		pick := rand.Intn(total)
+		for i, e := range left {
+			pick -= e.weight
+			if pick < 0 {
+				result = append(result, e)
+				left = append(left[:i], left[i+1:]...)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Report records how a fetch from one of the group's endpoints went: a nil err
+// for a usable response. Fetches the caller canceled, or the endpoint's own
+// circuit breaker turned away, say nothing of the endpoint, and are ignored.
+func (g *UpstreamGroup) Report(uf *UpstreamFetcher, err error, now time.Time) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrBreakerOpen) {
+		return
+	}
+	for _, e := range g.endpoints {
+		if e.fetcher != uf {
+			continue
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if err == nil {
+			e.failures = 0
+			e.lastSuccess = now
+			return
+		}
+		e.failures++
+		e.lastError = err.Error()
+		e.lastFailure = now
+		if e.failures >= g.health.Failures && !now.Before(e.ejectedUntil) {
+			e.ejectedUntil = now.Add(g.health.Cooldown)
+			upstreamEjections.WithLabelValues(uf.Responder()).Inc()
+		}
+		return
+	}
+}
+
+// Status describes each endpoint, in the order they were added.
+func (g *UpstreamGroup) Status(now time.Time) []EndpointStatus {
+	result := make([]EndpointStatus, 0, len(g.endpoints))
+	for _, e := range g.endpoints {
+		e.mu.Lock()
+		status := EndpointStatus{
+			URL:                 e.fetcher.Responder(),
+			Weight:              e.weight,
+			Healthy:             !now.Before(e.ejectedUntil),
+			Breaker:             e.fetcher.BreakerState(now).String(),
+			ConsecutiveFailures: e.failures,
+			LastError:           e.lastError,
+			LastFailure:         timePtr(e.lastFailure),
+			LastSuccess:         timePtr(e.lastSuccess),
+		}
+		if !status.Healthy {
+			status.EjectedUntil = timePtr(e.ejectedUntil)
+		}
+		e.mu.Unlock()
+		result = append(result, status)
+	}
+	return result
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,163 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestGroup(t *testing.T, order Order, weights ...int) (*UpstreamGroup, []*UpstreamFetcher) {
+	group := NewUpstreamGroup(order, HealthOptions{Failures: 2, Cooldown: time.Minute})
+	var fetchers []*UpstreamFetcher
+	for i, weight := range weights {
+		u, _ := url.Parse("http://ocsp" + string(rune('a'+i)) + ".example.com/" + t.Name())
+		f, err := NewUpstreamFetcher(*u, t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = group.Add(f, weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetchers = append(fetchers, f)
+	}
+	return group, fetchers
+}
+
+func TestParseHealthOptions(t *testing.T) {
+	t.Parallel()
+	opts, err := ParseHealthOptions(map[string]string{"failures": "5", "cooldown": "1m"}, DefaultHealthOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts != (HealthOptions{5, time.Minute}) {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+
+	for _, bad := range []map[string]string{{"failures": "0"}, {"cooldown": "later"}, {"unknown": "1"}} {
+		_, err := ParseHealthOptions(bad, DefaultHealthOptions)
+		if err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	t.Parallel()
+	weights, err := ParseWeights("3, 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(weights) != 2 || weights[0] != 3 || weights[1] != 1 {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+	for _, bad := range []string{"", "0", "3,heavy", "1,-1"} {
+		if _, err := ParseWeights(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestUpstreamGroupAdd(t *testing.T) {
+	t.Parallel()
+	group, fetchers := newTestGroup(t, OrderPriority, 1)
+	if err := group.Add(nil, 1); err == nil {
+		t.Error("Expected an error for a nil fetcher")
+	}
+	if err := group.Add(fetchers[0], 0); err == nil {
+		t.Error("Expected an error for a zero weight")
+	}
+}
+
+func TestUpstreamGroupEjection(t *testing.T) {
+	t.Parallel()
+	group, fetchers := newTestGroup(t, OrderPriority, 1, 1, 1)
+	now := time.Now()
+	expectOrder := func(when time.Time, expected ...int) {
+		t.Helper()
+		endpoints := group.Endpoints(when)
+		for i, e := range expected {
+			if endpoints[i] != fetchers[e] {
+				t.Errorf("Expected endpoint %d at %d, got %s", e, i, endpoints[i].Responder())
+			}
+		}
+	}
+	expectOrder(now, 0, 1, 2)
+
+	failure := errors.New("down")
+	group.Report(fetchers[0], failure, now)
+	expectOrder(now, 0, 1, 2)
+	group.Report(fetchers[0], failure, now)
+	expectOrder(now, 1, 2, 0)
+	if count := testutil.ToFloat64(upstreamEjections.WithLabelValues(fetchers[0].Responder())); count != 1 {
+		t.Errorf("Expected 1 ejection, got %f", count)
+	}
+
+	// Ejected for longer, so tried last
+	group.Report(fetchers[1], failure, now.Add(time.Second))
+	group.Report(fetchers[1], failure, now.Add(time.Second))
+	expectOrder(now.Add(time.Second), 2, 0, 1)
+
+	// Canceled fetches don't count
+	group.Report(fetchers[2], context.Canceled, now)
+	group.Report(fetchers[2], context.Canceled, now)
+	// Nor do those its breaker turned away
+	group.Report(fetchers[2], &fetchError{ErrorClassBreakerOpen, ErrBreakerOpen}, now)
+	group.Report(fetchers[2], &fetchError{ErrorClassBreakerOpen, ErrBreakerOpen}, now)
+	expectOrder(now.Add(time.Second), 2, 0, 1)
+
+	// Back after the cooldown, but ejected again on the next failure
+	later := now.Add(time.Minute)
+	expectOrder(later, 0, 2, 1)
+	group.Report(fetchers[0], failure, later)
+	expectOrder(later, 2, 1, 0)
+
+	// A success restores it
+	group.Report(fetchers[0], nil, later.Add(time.Minute))
+	group.Report(fetchers[0], failure, later.Add(time.Minute))
+	expectOrder(later.Add(time.Minute), 0, 1, 2)
+}
+
+func TestUpstreamGroupWeighted(t *testing.T) {
+	t.Parallel()
+	group, fetchers := newTestGroup(t, OrderWeighted, 1, 9)
+	first := make(map[*UpstreamFetcher]int)
+	for i := 0; i < 1000; i++ {
+		endpoints := group.Endpoints(time.Now())
+		if len(endpoints) != 2 || endpoints[0] == endpoints[1] {
+			t.Fatalf("Expected both endpoints once, got %v", endpoints)
+		}
+		first[endpoints[0]]++
+	}
+	if first[fetchers[1]] < 800 || first[fetchers[1]] > 980 {
+		t.Errorf("Expected the heavier endpoint first about 900 times, got %d", first[fetchers[1]])
+	}
+}
+
+func TestUpstreamGroupStatus(t *testing.T) {
+	t.Parallel()
+	group, fetchers := newTestGroup(t, OrderWeighted, 3, 1)
+	now := time.Now()
+	group.Report(fetchers[0], nil, now)
+	group.Report(fetchers[1], errors.New("down"), now)
+	group.Report(fetchers[1], errors.New("still down"), now)
+
+	status := group.Status(now)
+	if len(status) != 2 {
+		t.Fatalf("Expected 2 endpoints, got %d", len(status))
+	}
+	if s := status[0]; s.URL != fetchers[0].Responder() || s.Weight != 3 || !s.Healthy || s.LastSuccess == nil || s.LastFailure != nil || s.EjectedUntil != nil {
+		t.Errorf("Unexpected status %+v", s)
+	}
+	if s := status[1]; s.Healthy || s.ConsecutiveFailures != 2 || s.LastError != "still down" || s.EjectedUntil == nil || !s.EjectedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("Unexpected status %+v", s)
+	}
+}
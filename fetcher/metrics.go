@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Classes of upstream errors, as counted in the upstream errors metric.
+const (
+	ErrorClassTimeout     = "timeout"
+	ErrorClassCanceled    = "canceled"
+	ErrorClassConnection  = "connection"
+	ErrorClassStatus      = "status"
+	ErrorClassContentType = "content_type"
+	ErrorClassBody        = "body"
+	ErrorClassBreakerOpen = "breaker_open"
+)
+
+var (
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ocsp_l2_cache_upstream_request_duration_seconds",
+		Help:    "Time taken by upstream OCSP responders to answer, successfully or not.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"responder"})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_upstream_errors_total",
+		Help: "Failed upstream requests and rejected upstream responses, by class.",
+	}, []string{"responder", "class"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_upstream_retries_total",
+		Help: "Upstream requests retried after a failure.",
+	}, []string{"responder"})
+
+	upstreamHedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_upstream_hedges_total",
+		Help: "Second upstream requests sent because the first was slower than usual.",
+	}, []string{"responder"})
+
+	upstreamEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_upstream_ejections_total",
+		Help: "Times upstream responders were ejected from their group for failing.",
+	}, []string{"responder"})
+
+	upstreamBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ocsp_l2_cache_upstream_breaker_state",
+		Help: "State of each upstream responder's circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"responder"})
+
+	upstreamBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_upstream_breaker_transitions_total",
+		Help: "Changes of state of upstream responders' circuit breakers, by the state changed to.",
+	}, []string{"responder", "state"})
+
+	upstreamConns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_upstream_connections_total",
+		Help: "Connections taken for upstream requests, by whether they were reused from the pool.",
+	}, []string{"responder", "reused"})
+
+	upstreamOpenConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ocsp_l2_cache_upstream_open_connections",
+		Help: "Connections open to upstream responders, in use or idle in the pool.",
+	}, []string{"responder"})
+)
+
+// fetchError is an upstream failure that was classified where it happened.
+type fetchError struct {
+	class string
+	err   error
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+// statusError is an upstream answer other than 200 OK.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+// errorClass returns which of the ErrorClass constants err falls under.
+func errorClass(err error) string {
+	var fe *fetchError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.As(err, &fe):
+		return fe.class
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	}
+	return ErrorClassConnection
+}
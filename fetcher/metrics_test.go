@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func upstreamRequestCount(t *testing.T, responder string) uint64 {
+	var m dto.Metric
+	err := upstreamDuration.WithLabelValues(responder).(prometheus.Histogram).Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestFetchErrorClasses(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name    string
+		handler http.HandlerFunc
+		timeout time.Duration
+		class   string
+	}{
+		{"404", http.NotFoundHandler().ServeHTTP, time.Second, ErrorClassStatus},
+		{"no content type", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Hello")
+		}, time.Second, ErrorClassContentType},
+		{"too slow", func(w http.ResponseWriter, r *http.Request) {
+			// Only once the body is read does the server notice the client
+			// giving up
+			_, _ = ioutil.ReadAll(r.Body)
+			<-r.Context().Done()
+		}, 50 * time.Millisecond, ErrorClassTimeout},
+		{"truncated", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte("short"))
+		}, time.Second, ErrorClassBody},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(tc.handler)
+			defer ts.Close()
+			u, _ := url.Parse(ts.URL)
+			f, err := NewUpstreamFetcher(*u, "TestFetchErrorClasses")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			_, _, err = f.Fetch(ctx, []byte{})
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if class := errorClass(err); class != tc.class {
+				t.Errorf("Expected class %s, got %s for %v", tc.class, class, err)
+			}
+			if count := testutil.ToFloat64(upstreamErrors.WithLabelValues(f.Responder(), tc.class)); count != 1 {
+				t.Errorf("Expected the error to be counted once, got %f", count)
+			}
+			if count := upstreamRequestCount(t, f.Responder()); count != 1 {
+				t.Errorf("Expected the request to be timed once, got %d", count)
+			}
+		})
+	}
+}
+
+func TestFetchErrorClassConnection(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.NotFoundHandler())
+	u, _ := url.Parse(ts.URL)
+	ts.Close()
+
+	f, err := NewUpstreamFetcher(*u, "TestFetchErrorClassConnection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = f.Fetch(context.Background(), []byte{})
+	if err == nil {
+		t.Fatal("Expected an error from a closed server")
+	}
+	if class := errorClass(err); class != ErrorClassConnection {
+		t.Errorf("Expected class %s, got %s for %v", ErrorClassConnection, class, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = f.Fetch(ctx, []byte{})
+	if class := errorClass(err); class != ErrorClassCanceled {
+		t.Errorf("Expected class %s, got %s for %v", ErrorClassCanceled, class, err)
+	}
+}
+
+func TestFetchCountError(t *testing.T) {
+	t.Parallel()
+	u, _ := url.Parse("http://ocsp.example.com/TestFetchCountError")
+	f, err := NewUpstreamFetcher(*u, "TestFetchCountError")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.CountError("invalid")
+	f.CountError("invalid")
+	if count := testutil.ToFloat64(upstreamErrors.WithLabelValues(u.String(), "invalid")); count != 2 {
+		t.Errorf("Expected 2 invalid responses, got %f", count)
+	}
+}
@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RequestMethod decides whether OCSP requests are sent upstream with GET, as
+// RFC 5019 recommends and CDNs cache, or with POST.
+type RequestMethod int
+
+const (
+	// MethodPreferGet sends a GET when the request fits within the URL length
+	// limit, and a POST otherwise
+	MethodPreferGet RequestMethod = iota
+	// MethodPost always sends a POST
+	MethodPost
+	// MethodGet always sends a GET, however long the URL
+	MethodGet
+)
+
+var requestMethodNames = map[RequestMethod]string{
+	MethodPreferGet: "preferGet",
+	MethodPost:      "post",
+	MethodGet:       "get",
+}
+
+func (m RequestMethod) String() string {
+	name, ok := requestMethodNames[m]
+	if !ok {
+		return fmt.Sprintf("RequestMethod(%d)", int(m))
+	}
+	return name
+}
+
+// GetEncoding is how OCSP requests are base64-encoded into GET URLs.
+type GetEncoding int
+
+const (
+	// EncodingURLSafe uses the URL-safe alphabet without padding, which needs
+	// no escaping
+	EncodingURLSafe GetEncoding = iota
+	// EncodingStandard uses the standard alphabet with padding, escaping "/",
+	// as RFC 6960 describes
+	EncodingStandard
+)
+
+var getEncodingNames = map[GetEncoding]string{
+	EncodingURLSafe:  "urlSafe",
+	EncodingStandard: "standard",
+}
+
+func (e GetEncoding) String() string {
+	name, ok := getEncodingNames[e]
+	if !ok {
+		return fmt.Sprintf("GetEncoding(%d)", int(e))
+	}
+	return name
+}
+
+type RequestOptions struct {
+	Method RequestMethod
+	// MaxGetLength bounds the length of a GET URL's path, with the encoded
+	// request, for MethodPreferGet. RFC 5019 suggests 255.
+	MaxGetLength int
+	Encoding     GetEncoding
+}
+
+var DefaultRequestOptions = RequestOptions{
+	Method:       MethodPreferGet,
+	MaxGetLength: 255,
+	Encoding:     EncodingURLSafe,
+}
+
+// ParseRequestOptions reads options from settings with the keys "method"
+// ("preferGet", "post" or "get"), "maxGetLength" and "encoding" ("urlSafe" or
+// "standard"), as produced by common.GetEnvMap. Missing keys keep the value in
+// def.
+func ParseRequestOptions(settings map[string]string, def RequestOptions) (RequestOptions, error) {
+	opts := def
+	for k, v := range settings {
+		var err error
+		switch k {
+		case "method":
+			opts.Method, err = parseRequestMethod(v)
+		case "maxGetLength":
+			opts.MaxGetLength, err = strconv.Atoi(v)
+			if err == nil && opts.MaxGetLength < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "encoding":
+			opts.Encoding, err = parseGetEncoding(v)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return def, fmt.Errorf("Request option %s=%s: %v", k, v, err)
+		}
+	}
+	return opts, nil
+}
+
+func parseRequestMethod(v string) (RequestMethod, error) {
+	for method, name := range requestMethodNames {
+		if name == v {
+			return method, nil
+		}
+	}
+	return MethodPreferGet, fmt.Errorf("unknown method")
+}
+
+func parseGetEncoding(v string) (GetEncoding, error) {
+	for encoding, name := range getEncodingNames {
+		if name == v {
+			return encoding, nil
+		}
+	}
+	return EncodingURLSafe, fmt.Errorf("unknown encoding")
+}
+
+// SetRequestOptions sets how the fetcher sends OCSP requests upstream. Set it
+// before the fetcher is in use.
+func (uf *UpstreamFetcher) SetRequestOptions(opts RequestOptions) {
+	uf.request = opts
+}
+
+// useGetRequest tells whether the OCSP request is sent with a GET.
+func (uf *UpstreamFetcher) useGetRequest(ocspReq []byte) bool {
+	switch uf.request.Method {
+	case MethodGet:
+		return true
+	case MethodPost:
+		return false
+	}
+	u := uf.getURL(ocspReq)
+	return len(u.EscapedPath()) <= uf.request.MaxGetLength
+}
+
+// getURL appends the encoded OCSP request to the upstream URL's path.
+func (uf *UpstreamFetcher) getURL(ocspReq []byte) url.URL {
+	u := uf.upstreamUrl
+	base := u.EscapedPath()
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	var encoded string
+	switch uf.request.Encoding {
+	case EncodingStandard:
+		encoded = base64.StdEncoding.EncodeToString(ocspReq)
+	default:
+		encoded = base64.RawURLEncoding.EncodeToString(ocspReq)
+	}
+	u.RawPath = base + url.PathEscape(encoded)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	return u
+}
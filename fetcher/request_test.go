@@ -0,0 +1,186 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+)
+
+// recordingResponder answers every request, keeping the OCSP request it
+// carried and how.
+type recordingResponder struct {
+	url *url.URL
+
+	mu      sync.Mutex
+	method  string
+	rawPath string
+	ocspReq []byte
+}
+
+func newRecordingResponder(t *testing.T, path string, encoding *base64.Encoding) *recordingResponder {
+	rr := &recordingResponder{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr.mu.Lock()
+		defer rr.mu.Unlock()
+		rr.method = r.Method
+		rr.rawPath = r.URL.EscapedPath()
+		var err error
+		if r.Method == "POST" {
+			rr.ocspReq, err = ioutil.ReadAll(r.Body)
+		} else {
+			rr.ocspReq, err = encoding.DecodeString(strings.TrimPrefix(r.URL.Path, path+"/"))
+		}
+		if err != nil {
+			t.Errorf("Couldn't read the OCSP request: %v", err)
+		}
+		w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+		_, _ = w.Write([]byte("response"))
+	}))
+	t.Cleanup(ts.Close)
+	rr.url, _ = url.Parse(ts.URL + path)
+	return rr
+}
+
+func (rr *recordingResponder) Last() (string, string, []byte) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.method, rr.rawPath, rr.ocspReq
+}
+
+func TestParseRequestOptions(t *testing.T) {
+	t.Parallel()
+	opts, err := ParseRequestOptions(map[string]string{
+		"method":       "post",
+		"maxGetLength": "1024",
+		"encoding":     "standard",
+	}, DefaultRequestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RequestOptions{MethodPost, 1024, EncodingStandard}
+	if opts != expected {
+		t.Errorf("Expected %+v, got %+v", expected, opts)
+	}
+
+	for _, bad := range []map[string]string{
+		{"method": "put"},
+		{"maxGetLength": "0"},
+		{"encoding": "hex"},
+		{"unknown": "1"},
+	} {
+		_, err := ParseRequestOptions(bad, DefaultRequestOptions)
+		if err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func TestRequestMethods(t *testing.T) {
+	t.Parallel()
+	short := bytes.Repeat([]byte{0xfb}, 100)
+	long := bytes.Repeat([]byte{0xfb}, 300)
+	testCases := []struct {
+		name     string
+		opts     RequestOptions
+		ocspReq  []byte
+		expected string
+	}{
+		{"preferGet short", DefaultRequestOptions, short, "GET"},
+		{"preferGet long", DefaultRequestOptions, long, "POST"},
+		{"preferGet under a lower limit", RequestOptions{MethodPreferGet, 100, EncodingURLSafe}, short, "POST"},
+		{"preferGet under a higher limit", RequestOptions{MethodPreferGet, 1024, EncodingURLSafe}, long, "GET"},
+		{"get long", RequestOptions{MethodGet, 255, EncodingURLSafe}, long, "GET"},
+		{"post short", RequestOptions{MethodPost, 255, EncodingURLSafe}, short, "POST"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rr := newRecordingResponder(t, "/ocsp", base64.RawURLEncoding)
+			f, err := NewUpstreamFetcher(*rr.url, "TestRequestMethods")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.SetRequestOptions(tc.opts)
+
+			data, _, err := f.Fetch(context.Background(), tc.ocspReq)
+			if err != nil || string(data) != "response" {
+				t.Fatalf("Expected a response, got %q and %v", data, err)
+			}
+			method, _, ocspReq := rr.Last()
+			if method != tc.expected {
+				t.Errorf("Expected a %s, got a %s", tc.expected, method)
+			}
+			if !bytes.Equal(ocspReq, tc.ocspReq) {
+				t.Errorf("Expected the OCSP request sent intact, got %x", ocspReq)
+			}
+		})
+	}
+}
+
+func TestGetEncodings(t *testing.T) {
+	t.Parallel()
+	// Encodes to "+/v7" in the standard alphabet, "-_v7" in the URL-safe one
+	ocspReq := []byte{0xfb, 0xfb, 0xfb}
+	testCases := []struct {
+		name     string
+		encoding GetEncoding
+		decoder  *base64.Encoding
+		expected string
+	}{
+		{"urlSafe", EncodingURLSafe, base64.RawURLEncoding, "/ocsp/-_v7"},
+		{"standard", EncodingStandard, base64.StdEncoding, "/ocsp/+%2Fv7"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			rr := newRecordingResponder(t, "/ocsp", tc.decoder)
+			f, err := NewUpstreamFetcher(*rr.url, "TestGetEncodings")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.SetRequestOptions(RequestOptions{MethodGet, 255, tc.encoding})
+
+			_, _, err = f.Fetch(context.Background(), ocspReq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			method, rawPath, sent := rr.Last()
+			if method != "GET" || rawPath != tc.expected {
+				t.Errorf("Expected a GET of %s, got a %s of %s", tc.expected, method, rawPath)
+			}
+			if !bytes.Equal(sent, ocspReq) {
+				t.Errorf("Expected the OCSP request sent intact, got %x", sent)
+			}
+		})
+	}
+}
+
+func TestGetURLJoinsPath(t *testing.T) {
+	t.Parallel()
+	for _, path := range []string{"", "/"} {
+		u, _ := url.Parse("http://ocsp.example.com" + path)
+		f, err := NewUpstreamFetcher(*u, "TestGetURLJoinsPath")
+		if err != nil {
+			t.Fatal(err)
+		}
+		getURL := f.getURL([]byte{0xfb})
+		if got := getURL.String(); got != "http://ocsp.example.com/-w" {
+			t.Errorf("Expected a single slash before the request for %q, got %s", path, got)
+		}
+	}
+}
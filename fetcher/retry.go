@@ -0,0 +1,243 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize is how many recent successful requests hedging takes
+	// its delay from.
+	latencyWindowSize = 128
+	// minHedgeSamples is how many successful requests must be seen before
+	// hedging starts.
+	minHedgeSamples = 20
+)
+
+// errResponseTooLarge rejects responses over the transport's MaxResponseBytes,
+// which retrying won't change.
+var errResponseTooLarge = errors.New("Response too large")
+
+type RetryOptions struct {
+	// Attempts bounds how many times a fetch is tried, counting the first. Zero
+	// or one disables retries.
+	Attempts int
+	// Backoff is the longest wait before the first retry, doubling for each
+	// retry after it up to MaxBackoff. The wait is picked at random below it,
+	// so that fetches failing together don't retry together. Zero MaxBackoff
+	// leaves it uncapped.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// HedgeQuantile sends a second request when the first hasn't answered
+	// within this quantile of recent successful requests' durations, such as
+	// 0.95. Zero disables hedging.
+	HedgeQuantile float64
+}
+
+// DefaultRetryOptions retry twice, without hedging.
+var DefaultRetryOptions = RetryOptions{
+	Attempts:   3,
+	Backoff:    50 * time.Millisecond,
+	MaxBackoff: time.Second,
+}
+
+// ParseRetryOptions reads options from settings with the keys "attempts",
+// "backoff", "maxBackoff" and "hedge", as produced by common.GetEnvMap.
+// Missing keys keep the value in def.
+func ParseRetryOptions(settings map[string]string, def RetryOptions) (RetryOptions, error) {
+	opts := def
+	for k, v := range settings {
+		var err error
+		switch k {
+		case "attempts":
+			opts.Attempts, err = strconv.Atoi(v)
+			if err == nil && opts.Attempts < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "backoff":
+			opts.Backoff, err = time.ParseDuration(v)
+		case "maxBackoff":
+			opts.MaxBackoff, err = time.ParseDuration(v)
+		case "hedge":
+			opts.HedgeQuantile, err = strconv.ParseFloat(v, 64)
+			if err == nil && (opts.HedgeQuantile < 0 || opts.HedgeQuantile >= 1) {
+				err = fmt.Errorf("must be at least 0 and less than 1")
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return def, fmt.Errorf("Retry option %s=%s: %v", k, v, err)
+		}
+	}
+	return opts, nil
+}
+
+// SetRetryOptions sets how the fetcher retries and hedges. Set it before the
+// fetcher is in use.
+func (uf *UpstreamFetcher) SetRetryOptions(opts RetryOptions) {
+	uf.retry = opts
+}
+
+// retryable tells whether err is worth another try: the responder failed
+// rather than answered, and the caller is still waiting.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch errorClass(err) {
+	case ErrorClassConnection, ErrorClassTimeout:
+		return true
+	case ErrorClassStatus:
+		var se *statusError
+		return errors.As(err, &se) && se.code >= 500
+	case ErrorClassBody:
+		return !errors.Is(err, errResponseTooLarge)
+	}
+	return false
+}
+
+// backoff picks how long to wait before the retry following the attempt.
+func (uf *UpstreamFetcher) backoff(attempt int) time.Duration {
+	limit := uf.retry.Backoff
+	for i := 1; i < attempt && limit < math.MaxInt64/2; i++ {
+		if uf.retry.MaxBackoff > 0 && limit >= uf.retry.MaxBackoff {
+			break
+		}
+		limit *= 2
+	}
+	if uf.retry.MaxBackoff > 0 && limit > uf.retry.MaxBackoff {
+		limit = uf.retry.MaxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+type attemptResult struct {
+	data    []byte
+	headers map[string]string
+	err     error
+	elapsed time.Duration
+}
+
+// hedged sends the request, and a second one if the first is slower than
+// usual, returning the first success. The slower request is abandoned.
+func (uf *UpstreamFetcher) hedged(ctx context.Context, ocspReq []byte) attemptResult {
+	delay, ok := uf.hedgeDelay()
+	if !ok {
+		result := uf.attempt(ctx, ocspReq)
+		uf.observe(result)
+		return result
+	}
+
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan attemptResult, 2)
+	launch := func() {
+		go func() {
+			results <- uf.attempt(hedgeCtx, ocspReq)
+		}()
+	}
+
+	launch()
+	inFlight := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			upstreamHedges.WithLabelValues(uf.Responder()).Inc()
+			launch()
+			inFlight++
+		case result := <-results:
+			inFlight--
+			uf.observe(result)
+			if result.err == nil || inFlight == 0 {
+				return result
+			}
+			// Wait on the other request rather than hedge again
+			timer.Stop()
+		}
+	}
+}
+
+// attempt sends the request once.
+func (uf *UpstreamFetcher) attempt(ctx context.Context, ocspReq []byte) attemptResult {
+	var result attemptResult
+	start := time.Now()
+	if uf.useGetRequest(ocspReq) {
+		result.data, result.headers, result.err = uf.ocspGet(ctx, ocspReq)
+	} else {
+		result.data, result.headers, result.err = uf.ocspPost(ctx, ocspReq)
+	}
+	result.elapsed = time.Since(start)
+	return result
+}
+
+// observe counts an attempt whose result was used in the metrics, and in the
+// durations hedging is based on.
+func (uf *UpstreamFetcher) observe(result attemptResult) {
+	upstreamDuration.WithLabelValues(uf.Responder()).Observe(result.elapsed.Seconds())
+	if result.err != nil {
+		uf.CountError(errorClass(result.err))
+		return
+	}
+	uf.latency.Record(result.elapsed)
+}
+
+func (uf *UpstreamFetcher) hedgeDelay() (time.Duration, bool) {
+	if uf.retry.HedgeQuantile <= 0 {
+		return 0, false
+	}
+	return uf.latency.Quantile(uf.retry.HedgeQuantile)
+}
+
+// latencyWindow keeps the durations of recent successful requests.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyWindow() *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, latencyWindowSize)}
+}
+
+func (w *latencyWindow) Record(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// Quantile returns the duration q of the recent requests finished within, if
+// enough were seen to tell.
+func (w *latencyWindow) Quantile(q float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if len(w.samples) < minHedgeSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(q*float64(len(sorted)-1))], true
+}
@@ -0,0 +1,260 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRetryOptions(t *testing.T) {
+	t.Parallel()
+	opts, err := ParseRetryOptions(map[string]string{
+		"attempts":   "5",
+		"backoff":    "10ms",
+		"maxBackoff": "100ms",
+		"hedge":      "0.9",
+	}, DefaultRetryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RetryOptions{5, 10 * time.Millisecond, 100 * time.Millisecond, 0.9}
+	if opts != expected {
+		t.Errorf("Expected %+v, got %+v", expected, opts)
+	}
+
+	for _, bad := range []map[string]string{
+		{"attempts": "0"},
+		{"backoff": "soon"},
+		{"hedge": "1"},
+		{"hedge": "-0.5"},
+		{"unknown": "1"},
+	} {
+		_, err := ParseRetryOptions(bad, DefaultRetryOptions)
+		if err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+	u, _ := url.Parse("http://ocsp.example.com")
+	testCases := []struct {
+		name    string
+		max     time.Duration
+		attempt int
+		limit   time.Duration
+	}{
+		{"first", time.Second, 1, 10 * time.Millisecond},
+		{"doubled", time.Second, 3, 40 * time.Millisecond},
+		{"capped", 20 * time.Millisecond, 3, 20 * time.Millisecond},
+		{"uncapped", 0, 4, 80 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			f, err := NewUpstreamFetcher(*u, "TestBackoff")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.SetRetryOptions(RetryOptions{Attempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: tc.max})
+
+			// Waits are random below the limit, so some of these are in its
+			// upper half
+			var longest time.Duration
+			for i := 0; i < 100; i++ {
+				wait := f.backoff(tc.attempt)
+				if wait >= tc.limit {
+					t.Fatalf("Expected waits below %s, got %s", tc.limit, wait)
+				}
+				if wait > longest {
+					longest = wait
+				}
+			}
+			if longest < tc.limit/2 {
+				t.Errorf("Expected waits up to %s, got at most %s", tc.limit, longest)
+			}
+		})
+	}
+}
+
+// failingResponder answers with each handler in turn, then with a response
+// once they run out, counting the requests it gets.
+type failingResponder struct {
+	hits     int32
+	handlers []http.HandlerFunc
+	url      *url.URL
+}
+
+func newFailingResponder(t *testing.T, handlers ...http.HandlerFunc) *failingResponder {
+	fr := &failingResponder{handlers: handlers}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit := int(atomic.AddInt32(&fr.hits, 1))
+		if hit <= len(fr.handlers) {
+			fr.handlers[hit-1](w, r)
+			return
+		}
+		w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(ts.Close)
+	fr.url, _ = url.Parse(ts.URL)
+	return fr
+}
+
+func (fr *failingResponder) Hits() int {
+	return int(atomic.LoadInt32(&fr.hits))
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+}
+
+func resetConnection(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		_ = conn.Close()
+	}
+}
+
+func newRetryingFetcher(t *testing.T, u *url.URL, opts RetryOptions) *UpstreamFetcher {
+	f, err := NewUpstreamFetcher(*u, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetRetryOptions(opts)
+	return f
+}
+
+func TestFetchRetries(t *testing.T) {
+	t.Parallel()
+	opts := RetryOptions{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	testCases := []struct {
+		name     string
+		handlers []http.HandlerFunc
+		hits     int
+		class    string
+	}{
+		{"recovers from 5xx", []http.HandlerFunc{unavailable, unavailable}, 3, ""},
+		{"recovers from resets", []http.HandlerFunc{resetConnection}, 2, ""},
+		{"gives up", []http.HandlerFunc{unavailable, unavailable, unavailable}, 3, ErrorClassStatus},
+		{"doesn't retry 404", []http.HandlerFunc{http.NotFound}, 1, ErrorClassStatus},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			fr := newFailingResponder(t, tc.handlers...)
+			f := newRetryingFetcher(t, fr.url, opts)
+
+			data, _, err := f.Fetch(context.Background(), []byte{})
+			if tc.class == "" && (err != nil || string(data) != "ok") {
+				t.Errorf("Expected a response after retrying, got %q and %v", data, err)
+			}
+			if tc.class != "" && errorClass(err) != tc.class {
+				t.Errorf("Expected class %s, got %v", tc.class, err)
+			}
+			if fr.Hits() != tc.hits {
+				t.Errorf("Expected %d requests, got %d", tc.hits, fr.Hits())
+			}
+			if retries := testutil.ToFloat64(upstreamRetries.WithLabelValues(f.Responder())); retries != float64(tc.hits-1) {
+				t.Errorf("Expected %d retries, got %f", tc.hits-1, retries)
+			}
+		})
+	}
+}
+
+func TestFetchRetriesWithinDeadline(t *testing.T) {
+	t.Parallel()
+	fr := newFailingResponder(t, unavailable, unavailable, unavailable)
+	f := newRetryingFetcher(t, fr.url, RetryOptions{Attempts: 3, Backoff: time.Hour, MaxBackoff: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, _, err := f.Fetch(ctx, []byte{})
+	if class := errorClass(err); class != ErrorClassStatus {
+		t.Errorf("Expected the upstream's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected no wait past the deadline, took %s", elapsed)
+	}
+}
+
+func TestFetchHedging(t *testing.T) {
+	t.Parallel()
+	var slow int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&slow, 1, 0) {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	f := newRetryingFetcher(t, u, RetryOptions{Attempts: 1, HedgeQuantile: 0.9})
+
+	for i := 0; i < minHedgeSamples; i++ {
+		_, _, err := f.Fetch(context.Background(), []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hedges := testutil.ToFloat64(upstreamHedges.WithLabelValues(f.Responder())); hedges != 0 {
+		t.Errorf("Expected no hedging while requests are fast, got %f", hedges)
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, _, err := f.Fetch(ctx, []byte{})
+	if err != nil || string(data) != "ok" {
+		t.Fatalf("Expected the hedged request's response, got %q and %v", data, err)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected the hedged request to answer before the deadline")
+	}
+	if hedges := testutil.ToFloat64(upstreamHedges.WithLabelValues(f.Responder())); hedges != 1 {
+		t.Errorf("Expected 1 hedged request, got %f", hedges)
+	}
+	if count := testutil.ToFloat64(upstreamErrors.WithLabelValues(f.Responder(), ErrorClassCanceled)); count != 0 {
+		t.Errorf("Expected the abandoned request not to count as an error, got %f", count)
+	}
+}
+
+func TestLatencyWindowQuantile(t *testing.T) {
+	t.Parallel()
+	w := newLatencyWindow()
+	for i := 1; i < minHedgeSamples; i++ {
+		w.Record(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := w.Quantile(0.5); ok {
+		t.Error("Expected no quantile from too few samples")
+	}
+
+	for i := 0; i < 2*latencyWindowSize; i++ {
+		w.Record(time.Duration(i%100) * time.Millisecond)
+	}
+	if len(w.samples) != latencyWindowSize {
+		t.Errorf("Expected the window to keep %d samples, got %d", latencyWindowSize, len(w.samples))
+	}
+	q, ok := w.Quantile(0.9)
+	if !ok || q < 80*time.Millisecond || q > 99*time.Millisecond {
+		t.Errorf("Expected the 90th percentile near 90ms, got %s", q)
+	}
+}
@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TransportOptions tunes the connections to an upstream responder. Each
+// fetcher keeps its own pool of them.
+type TransportOptions struct {
+	// MaxIdleConns bounds how many idle connections are kept for reuse
+	MaxIdleConns int
+	// MaxConns bounds how many connections are open at once, or zero for no
+	// limit. Requests past it wait for a connection.
+	MaxConns int
+	// IdleConnTimeout closes connections idle this long
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+	// DialTimeout bounds connecting, and TLSHandshakeTimeout the TLS handshake
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for the response headers once the
+	// request is sent, or zero to leave it to the request's deadline
+	ResponseHeaderTimeout time.Duration
+	// HTTP2 negotiates HTTP/2 with responders that offer it over TLS
+	HTTP2 bool
+	// MaxResponseBytes rejects larger response bodies, or zero for no limit
+	MaxResponseBytes int64
+}
+
+// DefaultTransportOptions are used by fetchers without options of their own.
+var DefaultTransportOptions = TransportOptions{
+	MaxIdleConns:        16,
+	IdleConnTimeout:     90 * time.Second,
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	HTTP2:               true,
+	MaxResponseBytes:    1 << 16,
+}
+
+// ParseTransportOptions reads options from settings with the keys "maxIdle",
+// "maxConns", "idleTimeout", "keepAlive", "dialTimeout", "tlsTimeout",
+// "headerTimeout", "http2" and "maxBody", as produced by common.GetEnvMap.
+// Missing keys keep the value in def.
+func ParseTransportOptions(settings map[string]string, def TransportOptions) (TransportOptions, error) {
+	opts := def
+	for k, v := range settings {
+		var err error
+		switch k {
+		case "maxIdle":
+			opts.MaxIdleConns, err = strconv.Atoi(v)
+		case "maxConns":
+			opts.MaxConns, err = strconv.Atoi(v)
+		case "idleTimeout":
+			opts.IdleConnTimeout, err = time.ParseDuration(v)
+		case "keepAlive":
+			var keepAlive bool
+			keepAlive, err = strconv.ParseBool(v)
+			opts.DisableKeepAlives = !keepAlive
+		case "dialTimeout":
+			opts.DialTimeout, err = time.ParseDuration(v)
+		case "tlsTimeout":
+			opts.TLSHandshakeTimeout, err = time.ParseDuration(v)
+		case "headerTimeout":
+			opts.ResponseHeaderTimeout, err = time.ParseDuration(v)
+		case "http2":
+			opts.HTTP2, err = strconv.ParseBool(v)
+		case "maxBody":
+			opts.MaxResponseBytes, err = strconv.ParseInt(v, 10, 64)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return def, fmt.Errorf("Transport option %s=%s: %v", k, v, err)
+		}
+	}
+	if opts.MaxIdleConns < 0 || opts.MaxConns < 0 || opts.MaxResponseBytes < 0 {
+		return def, fmt.Errorf("Transport limits must not be negative")
+	}
+	return opts, nil
+}
+
+// newTransport builds a transport with the options, counting the connections
+// it opens to the responder in the pool metrics.
+func newTransport(opts TransportOptions, responder string) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			upstreamOpenConns.WithLabelValues(responder).Inc()
+			return &countedConn{Conn: conn, responder: responder}, nil
+		},
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConns,
+		MaxConnsPerHost:       opts.MaxConns,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		DisableKeepAlives:     opts.DisableKeepAlives,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     opts.HTTP2,
+	}
+	if !opts.HTTP2 {
+		// A non-nil, empty map keeps the transport from upgrading
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// countedConn takes itself out of the open connections metric once closed.
+type countedConn struct {
+	net.Conn
+	responder string
+	once      sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		upstreamOpenConns.WithLabelValues(c.responder).Dec()
+	})
+	return c.Conn.Close()
+}
+
+// withConnTrace counts whether the request reuses a pooled connection.
+func withConnTrace(req *http.Request, responder string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamConns.WithLabelValues(responder, strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,180 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseTransportOptions(t *testing.T) {
+	t.Parallel()
+	opts, err := ParseTransportOptions(map[string]string{
+		"maxIdle":       "4",
+		"maxConns":      "8",
+		"idleTimeout":   "30s",
+		"keepAlive":     "false",
+		"dialTimeout":   "1s",
+		"tlsTimeout":    "2s",
+		"headerTimeout": "3s",
+		"http2":         "false",
+		"maxBody":       "1024",
+	}, DefaultTransportOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TransportOptions{
+		MaxIdleConns:          4,
+		MaxConns:              8,
+		IdleConnTimeout:       30 * time.Second,
+		DisableKeepAlives:     true,
+		DialTimeout:           time.Second,
+		TLSHandshakeTimeout:   2 * time.Second,
+		ResponseHeaderTimeout: 3 * time.Second,
+		MaxResponseBytes:      1024,
+	}
+	if opts != expected {
+		t.Errorf("Expected %+v, got %+v", expected, opts)
+	}
+
+	opts, err = ParseTransportOptions(map[string]string{"maxIdle": "2"}, DefaultTransportOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = DefaultTransportOptions
+	expected.MaxIdleConns = 2
+	if opts != expected {
+		t.Errorf("Expected the defaults for missing keys, got %+v", opts)
+	}
+
+	for _, bad := range []map[string]string{
+		{"maxIdle": "many"},
+		{"maxConns": "-1"},
+		{"http2": "maybe"},
+		{"dialTimeout": "1"},
+		{"unknown": "1"},
+	} {
+		_, err := ParseTransportOptions(bad, DefaultTransportOptions)
+		if err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func newTestResponder(t *testing.T, body []byte, delay time.Duration) *url.URL {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	u, _ := url.Parse(ts.URL)
+	return u
+}
+
+func TestFetchMaxResponseBytes(t *testing.T) {
+	t.Parallel()
+	opts := DefaultTransportOptions
+	opts.MaxResponseBytes = 16
+
+	f, err := NewUpstreamFetcherWithTransport(*newTestResponder(t, bytes.Repeat([]byte{1}, 16), 0), "TestFetchMaxResponseBytes", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := f.Fetch(context.Background(), []byte{})
+	if err != nil || len(data) != 16 {
+		t.Errorf("Expected a response of the maximum size, got %d bytes and %v", len(data), err)
+	}
+
+	f, err = NewUpstreamFetcherWithTransport(*newTestResponder(t, bytes.Repeat([]byte{1}, 17), 0), "TestFetchMaxResponseBytes", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err = f.Fetch(context.Background(), []byte{})
+	if class := errorClass(err); class != ErrorClassBody {
+		t.Errorf("Expected class %s, got %s for %v", ErrorClassBody, class, err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Expected no response, got %d bytes", len(data))
+	}
+}
+
+func TestFetchResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	opts := DefaultTransportOptions
+	opts.ResponseHeaderTimeout = 20 * time.Millisecond
+
+	f, err := NewUpstreamFetcherWithTransport(*newTestResponder(t, []byte("ok"), 200*time.Millisecond), "TestFetchResponseHeaderTimeout", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = f.Fetch(context.Background(), []byte{})
+	if class := errorClass(err); class != ErrorClassTimeout {
+		t.Errorf("Expected class %s, got %s for %v", ErrorClassTimeout, class, err)
+	}
+}
+
+func TestFetchConnectionPool(t *testing.T) {
+	t.Parallel()
+	f, err := NewUpstreamFetcher(*newTestResponder(t, []byte("ok"), 0), "TestFetchConnectionPool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, _, err = f.Fetch(context.Background(), []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := testutil.ToFloat64(upstreamConns.WithLabelValues(f.Responder(), "false")); count != 1 {
+		t.Errorf("Expected 1 new connection, got %f", count)
+	}
+	if count := testutil.ToFloat64(upstreamConns.WithLabelValues(f.Responder(), "true")); count != 2 {
+		t.Errorf("Expected 2 reused connections, got %f", count)
+	}
+	if open := testutil.ToFloat64(upstreamOpenConns.WithLabelValues(f.Responder())); open != 1 {
+		t.Errorf("Expected 1 open connection, got %f", open)
+	}
+
+	// Copies share the pool
+	copied := *f
+	_, _, err = copied.Fetch(context.Background(), []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := testutil.ToFloat64(upstreamConns.WithLabelValues(f.Responder(), "true")); count != 3 {
+		t.Errorf("Expected the copy to reuse the connection, got %f reused", count)
+	}
+
+	f.CloseIdleConnections()
+	if open := testutil.ToFloat64(upstreamOpenConns.WithLabelValues(f.Responder())); open != 0 {
+		t.Errorf("Expected no open connections, got %f", open)
+	}
+
+	opts := DefaultTransportOptions
+	opts.DisableKeepAlives = true
+	f, err = NewUpstreamFetcherWithTransport(*newTestResponder(t, []byte("ok"), 0), "TestFetchConnectionPool", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err = f.Fetch(context.Background(), []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := testutil.ToFloat64(upstreamConns.WithLabelValues(f.Responder(), "false")); count != 2 {
+		t.Errorf("Expected a new connection per request without keep-alives, got %f", count)
+	}
+}
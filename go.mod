@@ -3,10 +3,11 @@ module github.com/jcjones/ocsp-l2-cache
 go 1.15
 
 require (
-	github.com/armon/go-metrics v0.3.4
 	github.com/go-redis/redis/v8 v8.4.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/google/certificate-transparency-go v1.1.1
 	github.com/letsencrypt/boulder v0.0.0-20201202015010-ff01fe4625a3
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
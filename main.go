@@ -6,14 +6,22 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log/syslog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jcjones/ocsp-l2-cache/cli"
 	"github.com/jcjones/ocsp-l2-cache/common"
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	"github.com/jcjones/ocsp-l2-cache/storage"
 
 	blog "github.com/letsencrypt/boulder/log"
+	"golang.org/x/crypto/ocsp"
 )
 
 func getLogger(identifier string) blog.Logger {
@@ -35,6 +43,57 @@ func getLogger(identifier string) blog.Logger {
 	return logger
 }
 
+func getRedisOptions() (storage.RedisOptions, error) {
+	opts := storage.RedisOptions{
+		TxTimeout: time.Second,
+		Username:  common.GetEnvString("RedisUsername", ""),
+		DB:        common.GetEnvInt("RedisDB", 0),
+	}
+
+	var err error
+	opts.Password, err = common.GetEnvSecret("RedisPassword", "")
+	if err != nil {
+		return opts, err
+	}
+	opts.SentinelPassword, err = common.GetEnvSecret("RedisSentinelPassword", "")
+	if err != nil {
+		return opts, err
+	}
+
+	caPem, err := readEnvFile("RedisCACertFile")
+	if err != nil {
+		return opts, err
+	}
+	certPem, err := readEnvFile("RedisClientCertFile")
+	if err != nil {
+		return opts, err
+	}
+	keyPem, err := readEnvFile("RedisClientKeyFile")
+	if err != nil {
+		return opts, err
+	}
+	if common.GetEnvBool("RedisTLS", false) || caPem != nil || certPem != nil {
+		opts.TLSConfig, err = storage.NewRedisTLSConfig(caPem, certPem, keyPem)
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// readEnvFile reads the file named by the variable name, if it is set.
+func readEnvFile(name string) ([]byte, error) {
+	path, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %v", name, err)
+	}
+	return data, nil
+}
+
 func main() {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -48,9 +107,66 @@ func main() {
 		WithIdentifier(identifier).
 		WithListenAddr(common.GetEnvString("ListenOCSP", ":8080")).
 		WithHealthListenAddr(common.GetEnvString("ListenHealth", ":8081")).
-		WithRedis(common.GetEnvString("RedisHost", "redis:6379"), time.Second).
 		WithCacheLifespan(common.GetEnvDuration("CacheLifespan", 24*time.Hour)).
-		WithConnectionDeadline(common.GetEnvDuration("ConnectionDeadline", time.Second))
+		WithMinimumCacheLife(common.GetEnvDuration("MinimumCacheLife", time.Hour)).
+		WithStaleLifespan(common.GetEnvDuration("StaleLifespan", 0), common.GetEnvBool("StaleWhileRevalidate", true)).
+		WithConnectionDeadline(common.GetEnvDuration("ConnectionDeadline", time.Second)).
+		WithMaxClockSkew(common.GetEnvDuration("MaxClockSkew", repo.DefaultMaxClockSkew)).
+		WithLegacyKeyFallback(common.GetEnvBool("LegacyKeyFallback", true)).
+		WithPopularityTracking(common.GetEnvBool("PopularityTracking", true)).
+		WithMemoryCache(common.GetEnvInt("MemoryCacheEntries", 0), common.GetEnvDuration("MemoryCacheLife", 0)).
+		WithFetchLease(common.GetEnvDuration("FetchLeaseLife", 0), common.GetEnvDuration("FetchLeaseWait", 500*time.Millisecond)).
+		WithWarming(common.GetEnvInt("WarmConcurrency", 8), float64(common.GetEnvInt("WarmRate", 50))).
+		WithProactiveRefresh(common.GetEnvDuration("RefreshWindow", 24*time.Hour), repo.RefreshOptions{
+			Interval:    common.GetEnvDuration("RefreshInterval", 0),
+			Ahead:       common.GetEnvDuration("RefreshAhead", time.Hour),
+			Jitter:      common.GetEnvDuration("RefreshJitter", 15*time.Minute),
+			Concurrency: common.GetEnvInt("RefreshConcurrency", 4),
+			Rate:        float64(common.GetEnvInt("RefreshRate", 10)),
+		})
+
+	cacheEncoding, err := repo.ParseEncoding(common.GetEnvString("CacheEncoding", repo.DefaultEncoding.String()))
+	if err != nil {
+		logger.Errf("Fatal configuring the cache encoding: %v", err)
+		os.Exit(42)
+	}
+	c.WithCacheEncoding(cacheEncoding)
+
+	adminToken, err := common.GetEnvSecret("AdminToken", "")
+	if err != nil {
+		logger.Errf("Fatal reading the admin token: %v", err)
+		os.Exit(42)
+	}
+	c.WithAdminListenAddr(common.GetEnvString("ListenAdmin", ""), adminToken)
+
+	redisOpts, err := getRedisOptions()
+	if err != nil {
+		logger.Errf("Fatal configuring Redis: %v", err)
+		os.Exit(42)
+	}
+	if clusterHosts, ok := os.LookupEnv("RedisClusterHosts"); ok {
+		c.WithRedisCluster(strings.Split(clusterHosts, ","), redisOpts)
+	} else if sentinelHosts, ok := os.LookupEnv("RedisSentinelHosts"); ok {
+		c.WithRedisSentinel(common.GetEnvString("RedisSentinelMaster", ""), strings.Split(sentinelHosts, ","), redisOpts)
+	} else {
+		c.WithRedis(common.GetEnvString("RedisHost", "redis:6379"), redisOpts)
+	}
+
+	ttlRuleVars := map[string]int{
+		"TTLGood":    ocsp.Good,
+		"TTLRevoked": ocsp.Revoked,
+		"TTLUnknown": ocsp.Unknown,
+	}
+	for name, status := range ttlRuleVars {
+		parseEnvOptions(logger, name, func(settings map[string]string) error {
+			rule, err := repo.ParseTTLRule(settings, c.DefaultTTLRule())
+			if err != nil {
+				return err
+			}
+			c.WithTTLRule(status, rule)
+			return nil
+		})
+	}
 
 	responderMap, err := common.GetEnvMap("Responders")
 	if err != nil {
@@ -60,9 +176,203 @@ func main() {
 		c.WithUpstreamResponder(keyId, responder)
 	}
 
+	parseEnvOptions(logger, "UpstreamWeights", func(weightMap map[string]string) error {
+		for keyId, setting := range weightMap {
+			weights, err := fetcher.ParseWeights(setting)
+			if err != nil {
+				return fmt.Errorf("for %s: %v", keyId, err)
+			}
+			c.WithUpstreamWeights(keyId, weights)
+		}
+		return nil
+	})
+
+	parseEnvOptions(logger, "IssuerCertificates", func(issuerCertMap map[string]string) error {
+		for keyId, certPath := range issuerCertMap {
+			certPem, err := ioutil.ReadFile(certPath)
+			if err != nil {
+				return err
+			}
+			c.WithIssuerCertificate(keyId, certPem)
+		}
+		return nil
+	})
+
+	headerPolicy, err := repo.ParseHeaderPolicy(common.GetEnvString("HeaderPolicy", repo.DefaultHeaderPolicy.String()))
+	if err != nil {
+		logger.Errf("Fatal decoding HeaderPolicy: %v", err)
+		os.Exit(42)
+	}
+	c.WithDefaultHeaderPolicy(headerPolicy)
+
+	parseEnvOptions(logger, "HeaderPolicies", func(headerPolicyMap map[string]string) error {
+		for keyId, name := range headerPolicyMap {
+			policy, err := repo.ParseHeaderPolicy(name)
+			if err != nil {
+				return err
+			}
+			c.WithHeaderPolicy(keyId, policy)
+		}
+		return nil
+	})
+
+	transport := fetcher.DefaultTransportOptions
+	parseEnvOptions(logger, "UpstreamTransport", func(settings map[string]string) (err error) {
+		transport, err = fetcher.ParseTransportOptions(settings, transport)
+		return err
+	})
+	c.WithDefaultTransport(transport)
+	for keyId := range responderMap {
+		parseEnvOptions(logger, "UpstreamTransport_"+keyId, func(settings map[string]string) error {
+			opts, err := fetcher.ParseTransportOptions(settings, transport)
+			if err != nil {
+				return err
+			}
+			c.WithTransport(keyId, opts)
+			return nil
+		})
+	}
+
+	request := fetcher.DefaultRequestOptions
+	parseEnvOptions(logger, "UpstreamRequest", func(settings map[string]string) (err error) {
+		request, err = fetcher.ParseRequestOptions(settings, request)
+		return err
+	})
+	c.WithDefaultRequestOptions(request)
+	for keyId := range responderMap {
+		parseEnvOptions(logger, "UpstreamRequest_"+keyId, func(settings map[string]string) error {
+			opts, err := fetcher.ParseRequestOptions(settings, request)
+			if err != nil {
+				return err
+			}
+			c.WithRequestOptions(keyId, opts)
+			return nil
+		})
+	}
+
+	parseEnvOptions(logger, "UpstreamHealth", func(settings map[string]string) error {
+		health, err := fetcher.ParseHealthOptions(settings, fetcher.DefaultHealthOptions)
+		if err != nil {
+			return err
+		}
+		c.WithUpstreamHealth(health)
+		return nil
+	})
+
+	parseEnvOptions(logger, "UpstreamBreaker", func(settings map[string]string) error {
+		breaker, err := fetcher.ParseBreakerOptions(settings, fetcher.DefaultBreakerOptions)
+		if err != nil {
+			return err
+		}
+		c.WithCircuitBreaker(breaker)
+		return nil
+	})
+
+	parseEnvOptions(logger, "UpstreamRetry", func(settings map[string]string) error {
+		retry, err := fetcher.ParseRetryOptions(settings, fetcher.DefaultRetryOptions)
+		if err != nil {
+			return err
+		}
+		c.WithRetries(retry)
+		return nil
+	})
+
+	if len(os.Args) > 1 {
+		runSubcommand(logger, c, os.Args[1], os.Args[2:])
+		return
+	}
+
 	err = c.Run(context.Background())
 	if err != nil {
 		logger.Errf("Fatal: %v", err)
 		os.Exit(42)
 	}
 }
+
+// parseEnvOptions calls parse with the settings in the named variable, as
+// common.GetEnvMap reads them, if it is set. It exits if they are invalid.
+func parseEnvOptions(logger blog.Logger, name string, parse func(settings map[string]string) error) {
+	if _, ok := os.LookupEnv(name); !ok {
+		return
+	}
+	settings, err := common.GetEnvMap(name)
+	if err == nil {
+		err = parse(settings)
+	}
+	if err != nil {
+		logger.Errf("Fatal decoding %s: %v", name, err)
+		os.Exit(42)
+	}
+}
+
+func runSubcommand(logger blog.Logger, c *cli.CLI, name string, args []string) {
+	switch name {
+	case "migrate-keys":
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only report which keys would be migrated")
+		_ = flags.Parse(args)
+
+		err := c.MigrateKeys(context.Background(), *dryRun)
+		if err != nil {
+			logger.Errf("Fatal migrating keys: %v", err)
+			os.Exit(42)
+		}
+	case "warm":
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		certsPath := flags.String("certs", "", "file of PEM certificates to warm")
+		serialsPath := flags.String("serials", "", "file of \"<issuer key ID> <serial>\" lines in hex to warm")
+		ctLog := flags.String("ct-log", "", "URL of a CT log whose entries to warm")
+		start := flags.Int64("start", 0, "first CT log entry to warm")
+		end := flags.Int64("end", 0, "last CT log entry to warm")
+		concurrency := flags.Int("concurrency", common.GetEnvInt("WarmConcurrency", 8), "upstream fetches at once")
+		rate := flags.Float64("rate", float64(common.GetEnvInt("WarmRate", 50)), "upstream fetches started per second, 0 for no limit")
+		force := flags.Bool("force", false, "refetch responses that are cached and still fresh")
+		_ = flags.Parse(args)
+
+		source, err := warmSource(*certsPath, *serialsPath, *ctLog, *start, *end)
+		if err != nil {
+			logger.Errf("Fatal warming: %v", err)
+			os.Exit(42)
+		}
+		c.WithWarming(*concurrency, *rate)
+		err = c.Warm(context.Background(), source, *force)
+		if err != nil {
+			logger.Errf("Fatal warming: %v", err)
+			os.Exit(42)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q, expected one of: migrate-keys, warm\n", name)
+		os.Exit(2)
+	}
+}
+
+// warmSource reads the targets of the warm command from exactly one of a file
+// of certificates, a file of serials, or a CT log range.
+func warmSource(certsPath string, serialsPath string, ctLog string, start int64, end int64) (repo.WarmSource, error) {
+	sources := 0
+	for _, s := range []string{certsPath, serialsPath, ctLog} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("Expected exactly one of -certs, -serials or -ct-log")
+	}
+
+	switch {
+	case ctLog != "":
+		return repo.CTLogSource(ctLog, start, end)
+	case certsPath != "":
+		f, err := os.Open(certsPath)
+		if err != nil {
+			return nil, err
+		}
+		return repo.CertificateSource(f), nil
+	default:
+		f, err := os.Open(serialsPath)
+		if err != nil {
+			return nil, err
+		}
+		return repo.SerialSource(f), nil
+	}
+}
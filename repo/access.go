@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+const (
+	accessKeyPrefix = "access/"
+	// allAccessPattern matches every access marker, for KeysToChan.
+	allAccessPattern = accessKeyPrefix + "*"
+	// maxMarked bounds how many markers a replica remembers writing; past it,
+	// it forgets them all and rewrites markers as they are next requested.
+	maxMarked = 1 << 16
+)
+
+// accessLog records which serials were requested recently, across replicas
+// sharing the cache, as marker keys that expire window after the last request.
+// Each replica rewrites a serial's marker at most once per quarter window, so
+// hot serials don't cost a cache write per request.
+type accessLog struct {
+	cache  storage.RemoteCache
+	window time.Duration
+
+	mu     sync.Mutex
+	marked map[string]time.Time
+}
+
+func newAccessLog(cache storage.RemoteCache, window time.Duration) *accessLog {
+	return &accessLog{
+		cache:  cache,
+		window: window,
+		marked: make(map[string]time.Time),
+	}
+}
+
+func accessKey(issuer storage.Issuer, serial storage.Serial) string {
+	return accessKeyPrefix + issuer.String() + "/" + serial.HexString()
+}
+
+// parseAccessKey returns the issuer and serial an access marker is for.
+func parseAccessKey(key string) (storage.Issuer, storage.Serial, error) {
+	return storage.ParseResponseKey(storage.ResponseKeyPrefix + strings.TrimPrefix(key, accessKeyPrefix))
+}
+
+// Record notes that the serial was just requested.
+func (al *accessLog) Record(ctx context.Context, issuer storage.Issuer, serial storage.Serial, now time.Time) error {
+	key := accessKey(issuer, serial)
+	al.mu.Lock()
+	if last, ok := al.marked[key]; ok && now.Sub(last) < al.window/4 {
+		al.mu.Unlock()
+		return nil
+	}
+	if len(al.marked) >= maxMarked {
+		al.marked = make(map[string]time.Time)
+	}
+	al.marked[key] = now
+	al.mu.Unlock()
+
+	err := al.cache.Set(ctx, key, "", al.window)
+	if err != nil {
+		// Try again on the next request
+		al.mu.Lock()
+		delete(al.marked, key)
+		al.mu.Unlock()
+	}
+	return err
+}
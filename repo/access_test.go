@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+func TestAccessLogRecord(t *testing.T) {
+	t.Parallel()
+	cache := storage.NewMockRemoteCache()
+	al := newAccessLog(cache, time.Hour)
+	issuer, err := storage.NewIssuerFromHexKeyId("abcdef0123456789abcdef0123456789abcdef01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := storage.NewSerialFromBigInt(big.NewInt(2001))
+	key := accessKey(*issuer, serial)
+
+	now := time.Now()
+	err = al.Record(context.Background(), *issuer, serial, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, found, err := cache.TTL(context.Background(), key)
+	if err != nil || !found || ttl <= 59*time.Minute {
+		t.Fatalf("Expected a marker for the window, got %s %v %v", ttl, found, err)
+	}
+
+	// Hot serials aren't rewritten on every request
+	_ = cache.Delete(context.Background(), key)
+	err = al.Record(context.Background(), *issuer, serial, now.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := cache.Exists(context.Background(), key); exists {
+		t.Error("Expected the marker not to be rewritten within a quarter window")
+	}
+	err = al.Record(context.Background(), *issuer, serial, now.Add(20*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := cache.Exists(context.Background(), key); !exists {
+		t.Error("Expected the marker to be rewritten after a quarter window")
+	}
+
+	parsedIssuer, parsedSerial, err := parseAccessKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedIssuer.String() != issuer.String() || parsedSerial.Cmp(serial) != 0 {
+		t.Errorf("Expected issuer %s serial %s, got %s %s", issuer, serial, parsedIssuer, parsedSerial)
+	}
+}
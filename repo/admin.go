@@ -0,0 +1,297 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	"golang.org/x/crypto/ocsp"
+)
+
+var statusNames = map[int]string{
+	ocsp.Good:    "good",
+	ocsp.Revoked: "revoked",
+	ocsp.Unknown: "unknown",
+}
+
+// Entry describes a cached response, for administration.
+type Entry struct {
+	Issuer           string     `json:"issuer"`
+	Serial           string     `json:"serial"`
+	Status           string     `json:"status"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	RevocationReason *int       `json:"revocationReason,omitempty"`
+	ThisUpdate       time.Time  `json:"thisUpdate"`
+	NextUpdate       *time.Time `json:"nextUpdate,omitempty"`
+	// FetchedAt is unset for entries written by versions that didn't record it
+	FetchedAt  *time.Time `json:"fetchedAt,omitempty"`
+	FreshUntil time.Time  `json:"freshUntil"`
+	Fresh      bool       `json:"fresh"`
+	// TTL is how long until the entry expires from the cache, in seconds
+	TTL int64 `json:"ttl"`
+}
+
+// Lookup describes the response cached for the serial, or returns
+// NotCachedError. The issuer needn't be configured, so that leftover entries
+// can be inspected too.
+func (c *OcspStore) Lookup(ctx context.Context, issuer storage.Issuer, serial storage.Serial) (Entry, error) {
+	key := storage.ResponseKey(issuer, serial)
+	cacheRsp, found, err := c.cache.Get(ctx, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !found {
+		return Entry{}, NotCachedError
+	}
+	ttl, found, err := c.cache.TTL(ctx, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !found {
+		return Entry{}, NotCachedError
+	}
+
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
+	if err != nil {
+		return Entry{}, err
+	}
+	// The response was checked before it was cached, so only its contents
+	// matter here
+	resp, err := ocsp.ParseResponseForCert(cr.RawResp, &x509.Certificate{SerialNumber: serial.AsBigInt()}, nil)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{
+		Issuer:     issuer.String(),
+		Serial:     serial.HexString(),
+		Status:     statusNames[resp.Status],
+		ThisUpdate: resp.ThisUpdate,
+		FreshUntil: cr.FreshUntil,
+		Fresh:      cr.IsFresh(time.Now()),
+		TTL:        int64(ttl / time.Second),
+	}
+	if resp.Status == ocsp.Revoked {
+		entry.RevokedAt = &resp.RevokedAt
+		entry.RevocationReason = &resp.RevocationReason
+	}
+	if !resp.NextUpdate.IsZero() {
+		entry.NextUpdate = &resp.NextUpdate
+	}
+	if !cr.FetchedAt.IsZero() {
+		entry.FetchedAt = &cr.FetchedAt
+	}
+	return entry, nil
+}
+
+// Purge removes the response cached for the serial, if there is one,
+// including one for the issuer under the serial's legacy key, which the legacy
+// key fallback or migrate-keys would otherwise bring back.
+func (c *OcspStore) Purge(ctx context.Context, issuer storage.Issuer, serial storage.Serial) error {
+	err := c.cache.Delete(ctx, storage.ResponseKey(issuer, serial))
+	if err != nil {
+		return err
+	}
+	_, err = c.purgeLegacy(ctx, storage.LegacyResponseKey(serial), issuer, serial)
+	return err
+}
+
+// PurgeIssuer removes every response cached for the issuer, including those
+// under legacy keys, returning how many were removed.
+func (c *OcspStore) PurgeIssuer(ctx context.Context, issuer storage.Issuer) (int, error) {
+	// Legacy keys have no issuer in them, so every key is looked at
+	keys := make(chan string)
+	scanErr := make(chan error, 1)
+	go func() {
+		scanErr <- c.cache.KeysToChan(ctx, "*", keys)
+	}()
+
+	var purged int
+	var err error
+	for key := range keys {
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(key, storage.ResponseKeyPrefix) {
+			keyIssuer, _, parseErr := storage.ParseResponseKey(key)
+			if parseErr != nil || keyIssuer.String() != issuer.String() {
+				continue
+			}
+			err = c.cache.Delete(ctx, key)
+			if err == nil {
+				purged++
+			}
+			continue
+		}
+		if strings.HasPrefix(key, leaseKeyPrefix) {
+			continue
+		}
+		serial, serialErr := storage.NewSerialFromBinaryString(key)
+		if serialErr != nil {
+			continue
+		}
+		var deleted bool
+		deleted, err = c.purgeLegacy(ctx, key, issuer, serial)
+		if deleted {
+			purged++
+		}
+	}
+	if scanErr := <-scanErr; err == nil {
+		err = scanErr
+	}
+	c.logger.Infof("Purged %d responses for issuer %s", purged, issuer.String())
+	return purged, err
+}
+
+// purgeLegacy deletes the legacy key, if its response is for the issuer.
+func (c *OcspStore) purgeLegacy(ctx context.Context, key string, issuer storage.Issuer, serial storage.Serial) (bool, error) {
+	cacheRsp, found, err := c.cache.Get(ctx, key)
+	if err != nil || !found || !c.legacyEntryIsFor(cacheRsp, issuer, serial) {
+		return false, err
+	}
+	err = c.cache.Delete(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	c.logger.Debugf("Purged legacy entry for issuer %s serial %s", issuer.String(), serial.String())
+	return true, nil
+}
+
+// legacyEntryIsFor tells whether a response cached under a legacy key is for
+// the issuer, as its CertID shows: by a SHA-1 key hash, which is the issuer's
+// key ID, or otherwise by the issuer's certificate, if it's configured.
+func (c *OcspStore) legacyEntryIsFor(cacheRsp string, issuer storage.Issuer, serial storage.Serial) bool {
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
+	if err != nil {
+		return false
+	}
+	id, err := responseCertID(cr.RawResp, serial.AsBigInt())
+	if err != nil {
+		return false
+	}
+	hash, err := id.Hash()
+	if err == nil && hash == crypto.SHA1 {
+		return hex.EncodeToString(id.IssuerKeyHash) == issuer.String()
+	}
+	issuerCert, ok := c.issuerCerts[issuer.String()]
+	return ok && checkCertIDIssuer(id, issuerCert) == nil
+}
+
+// Push caches a DER-encoded response for a single serial from the issuer,
+// replacing whatever was cached for it. It is checked as an upstream response
+// would be; if it doesn't pass, the error wraps InvalidResponseError. Without
+// the issuer's certificate, the response's CertID must at least name the
+// issuer's key.
+func (c *OcspStore) Push(ctx context.Context, issuer storage.Issuer, rspBytes []byte) (Entry, error) {
+	if _, ok := c.responders[issuer.String()]; !ok {
+		return Entry{}, UnknownIssuerError
+	}
+
+	ids, err := responseCertIDs(rspBytes)
+	if err != nil {
+		return Entry{}, wrapError(InvalidResponseError, err)
+	}
+	if len(ids) != 1 || ids[0].SerialNumber == nil {
+		return Entry{}, fmt.Errorf("%w: expected a response for one serial, got %d", InvalidResponseError, len(ids))
+	}
+	serial, err := storage.NewSerialFromBigInt(ids[0].SerialNumber)
+	if err != nil {
+		return Entry{}, wrapError(InvalidResponseError, err)
+	}
+	if _, ok := c.issuerCerts[issuer.String()]; !ok {
+		hash, err := ids[0].Hash()
+		if err != nil || hash != crypto.SHA1 {
+			return Entry{}, fmt.Errorf("%w: without the issuer's certificate, the CertID must use a SHA-1 key hash", InvalidResponseError)
+		}
+		if hex.EncodeToString(ids[0].IssuerKeyHash) != issuer.String() {
+			return Entry{}, fmt.Errorf("%w: CertID names issuer %x", InvalidResponseError, ids[0].IssuerKeyHash)
+		}
+	}
+
+	resp, err := c.parseUpstreamResponse(rspBytes, issuer, serial)
+	if err != nil {
+		return Entry{}, wrapError(InvalidResponseError, err)
+	}
+	now := time.Now()
+	err = checkFreshness(resp, now, c.maxClockSkew)
+	if err != nil {
+		return Entry{}, wrapError(InvalidResponseError, err)
+	}
+
+	_, err = c.store(ctx, issuer, serial, resp, rspBytes, nil, now)
+	if err != nil {
+		return Entry{}, err
+	}
+	c.logger.Infof("Pushed response for issuer %s serial %s", issuer.String(), serial.String())
+	entry, err := c.Lookup(ctx, issuer, serial)
+	if err == NotCachedError {
+		return Entry{}, fmt.Errorf("%w: too close to its NextUpdate to cache", InvalidResponseError)
+	}
+	return entry, err
+}
+
+// Refresh fetches the serial's response from upstream and caches it, however
+// fresh the cached one is. The request is built from the issuer's certificate
+// or, failing that, from the CertID of the cached response.
+func (c *OcspStore) Refresh(ctx context.Context, issuer storage.Issuer, serial storage.Serial) (Entry, error) {
+	group, ok := c.responders[issuer.String()]
+	if !ok {
+		return Entry{}, UnknownIssuerError
+	}
+
+	previous, _, err := c.cache.Get(ctx, storage.ResponseKey(issuer, serial))
+	if err != nil {
+		return Entry{}, err
+	}
+	reqBytes, err := c.buildRequest(issuer, serial, previous)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	_, _, err = c.fetch(ctx, group, issuer, serial, reqBytes, previous)
+	if err != nil {
+		return Entry{}, err
+	}
+	return c.Lookup(ctx, issuer, serial)
+}
+
+// buildRequest returns a DER-encoded OCSP request for the serial, using the
+// issuer's certificate if it is known, or else the CertID of the cached
+// response, if there is one.
+func (c *OcspStore) buildRequest(issuer storage.Issuer, serial storage.Serial, cacheRsp string) ([]byte, error) {
+	if issuerCert, ok := c.issuerCerts[issuer.String()]; ok {
+		return ocsp.CreateRequest(&x509.Certificate{SerialNumber: serial.AsBigInt()}, issuerCert, nil)
+	}
+	if cacheRsp == "" {
+		return nil, fmt.Errorf("Can't build a request for issuer %s serial %s without the issuer's certificate or a cached response", issuer.String(), serial.String())
+	}
+
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
+	if err != nil {
+		return nil, err
+	}
+	id, err := responseCertID(cr.RawResp, serial.AsBigInt())
+	if err != nil {
+		return nil, err
+	}
+	hash, err := id.Hash()
+	if err != nil {
+		return nil, err
+	}
+	req := &ocsp.Request{
+		HashAlgorithm:  hash,
+		IssuerNameHash: id.NameHash,
+		IssuerKeyHash:  id.IssuerKeyHash,
+		SerialNumber:   serial.AsBigInt(),
+	}
+	return req.Marshal()
+}
@@ -0,0 +1,286 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+func TestLookupAndPurge(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1701)
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	nextUpdate := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	tu := newTestUpstream(t, ti.response(t, 1701, thisUpdate, nextUpdate), false)
+	issuer := storage.NewIssuerFromRequest(req)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+	serial, _ := storage.NewSerialFromBigInt(big.NewInt(1701))
+
+	_, err := store.Lookup(context.Background(), issuer, serial)
+	if err != NotCachedError {
+		t.Errorf("Expected NotCachedError before the first request, got %v", err)
+	}
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := store.Lookup(context.Background(), issuer, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Issuer != issuer.String() || entry.Serial != serial.HexString() || entry.Status != "good" {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if !entry.ThisUpdate.Equal(thisUpdate) || entry.NextUpdate == nil || !entry.NextUpdate.Equal(nextUpdate) {
+		t.Errorf("Unexpected validity %s to %v", entry.ThisUpdate, entry.NextUpdate)
+	}
+	if !entry.Fresh || entry.FetchedAt == nil || entry.TTL <= 0 || entry.TTL > int64((24*time.Hour).Seconds()) {
+		t.Errorf("Unexpected freshness %+v", entry)
+	}
+
+	err = store.Purge(context.Background(), issuer, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Lookup(context.Background(), issuer, serial)
+	if err != NotCachedError {
+		t.Errorf("Expected NotCachedError after purging, got %v", err)
+	}
+}
+
+func TestPurgeIssuer(t *testing.T) {
+	t.Parallel()
+	cache := storage.NewMockRemoteCache()
+	var issuers []storage.Issuer
+	var stores []*OcspStore
+	for i := 0; i < 2; i++ {
+		ti := newTestIssuer(t)
+		req, _ := ti.request(t, 1)
+		issuer := storage.NewIssuerFromRequest(req)
+		store := newTestStore(t, cache, issuer, newTestUpstream(t, nil, false))
+		for serial := int64(1); serial <= 3; serial++ {
+			_, err := store.Push(context.Background(), issuer, ti.response(t, serial, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		issuers = append(issuers, issuer)
+		stores = append(stores, store)
+	}
+
+	purged, err := stores[0].PurgeIssuer(context.Background(), issuers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 3 {
+		t.Errorf("Expected 3 responses purged, got %d", purged)
+	}
+	for serial := int64(1); serial <= 3; serial++ {
+		s, _ := storage.NewSerialFromBigInt(big.NewInt(serial))
+		if _, err := stores[0].Lookup(context.Background(), issuers[0], s); err != NotCachedError {
+			t.Errorf("Expected serial %d of the purged issuer to be gone, got %v", serial, err)
+		}
+		if _, err := stores[1].Lookup(context.Background(), issuers[1], s); err != nil {
+			t.Errorf("Expected serial %d of the other issuer to remain, got %v", serial, err)
+		}
+	}
+}
+
+func TestPurgeWithLegacyKeyFallback(t *testing.T) {
+	t.Parallel()
+	tiA := newTestIssuer(t)
+	tiB := newTestIssuer(t)
+	req, reqBytes := tiA.request(t, 8888)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, tiA.response(t, 8888, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, issuer, tu)
+	store.EnableLegacyKeyFallback()
+	storeLegacyEntry(t, cache, 8888, tiA.response(t, 8888, time.Now().Add(-2*time.Hour), time.Now().Add(72*time.Hour)), time.Hour)
+	storeLegacyEntry(t, cache, 8889, tiB.response(t, 8889, time.Now().Add(-2*time.Hour), time.Now().Add(72*time.Hour)), time.Hour)
+	storeLegacyEntry(t, cache, 8890, tiA.response(t, 8890, time.Now().Add(-2*time.Hour), time.Now().Add(72*time.Hour)), time.Hour)
+	legacyExists := func(serial int64) bool {
+		s, _ := storage.NewSerialFromBigInt(big.NewInt(serial))
+		exists, err := cache.Exists(context.Background(), storage.LegacyResponseKey(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tu.Hits() != 0 {
+		t.Fatalf("Expected the legacy entry served, got %d fetches", tu.Hits())
+	}
+
+	serial, _ := storage.NewSerialFromBigInt(big.NewInt(8888))
+	err = store.Purge(context.Background(), issuer, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacyExists(8888) {
+		t.Error("Expected the issuer's legacy entry purged")
+	}
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tu.Hits() != 1 {
+		t.Errorf("Expected a fetch after purging, got %d", tu.Hits())
+	}
+
+	otherSerial, _ := storage.NewSerialFromBigInt(big.NewInt(8889))
+	err = store.Purge(context.Background(), issuer, otherSerial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !legacyExists(8889) {
+		t.Error("Expected another issuer's legacy entry to remain")
+	}
+
+	// The response just fetched, and the legacy entry for 8890
+	purged, err := store.PurgeIssuer(context.Background(), issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 || legacyExists(8890) || !legacyExists(8889) {
+		t.Errorf("Expected the issuer's responses purged, and only those, got %d", purged)
+	}
+}
+
+func TestPush(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1702)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, nil, false)
+	tu.SetFailing(true)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+	err := store.AddIssuerCertificate(issuer, ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rspBytes := ti.response(t, 1702, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	entry, err := store.Push(context.Background(), issuer, rspBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Serial != "06a6" || entry.FetchedAt == nil {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Errorf("Expected the pushed response to be served, got %v", err)
+	}
+	if tu.Hits() != 0 {
+		t.Errorf("Expected no upstream fetches, got %d", tu.Hits())
+	}
+
+	other := newTestIssuer(t)
+	tests := []struct {
+		name     string
+		rspBytes []byte
+	}{
+		{"garbage", []byte("not a response")},
+		{"another issuer", other.response(t, 1702, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))},
+		{"expired", ti.response(t, 1702, time.Now().Add(-72*time.Hour), time.Now().Add(-time.Hour))},
+	}
+	for _, tt := range tests {
+		_, err := store.Push(context.Background(), issuer, tt.rspBytes)
+		if !errors.Is(err, InvalidResponseError) {
+			t.Errorf("%s: expected an InvalidResponseError, got %v", tt.name, err)
+		}
+	}
+
+	otherReq, _ := other.request(t, 1702)
+	_, err = store.Push(context.Background(), storage.NewIssuerFromRequest(otherReq), tests[1].rspBytes)
+	if err != UnknownIssuerError {
+		t.Errorf("Expected UnknownIssuerError for an unconfigured issuer, got %v", err)
+	}
+}
+
+func TestPushWithoutIssuerCertificate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, _ := ti.request(t, 1703)
+	issuer := storage.NewIssuerFromRequest(req)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, newTestUpstream(t, nil, false))
+
+	_, err := store.Push(context.Background(), issuer, ti.response(t, 1703, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)))
+	if err != nil {
+		t.Errorf("Expected a response naming the issuer to be accepted, got %v", err)
+	}
+
+	other := newTestIssuer(t)
+	_, err = store.Push(context.Background(), issuer, other.response(t, 1703, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)))
+	if !errors.Is(err, InvalidResponseError) {
+		t.Errorf("Expected a response naming another issuer to be rejected, got %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1704)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 1704, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+	serial, _ := storage.NewSerialFromBigInt(big.NewInt(1704))
+
+	_, err := store.Refresh(context.Background(), issuer, serial)
+	if err == nil {
+		t.Error("Expected an error refreshing without the issuer's certificate or a cached response")
+	}
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Lookup(context.Background(), issuer, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the issuer's certificate, the request comes from the cached CertID
+	time.Sleep(10 * time.Millisecond)
+	entry, err := store.Refresh(context.Background(), issuer, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected a second upstream fetch, got %d", tu.Hits())
+	}
+	if !entry.FetchedAt.After(*first.FetchedAt) {
+		t.Errorf("Expected a new fetch time, got %s then %s", first.FetchedAt, entry.FetchedAt)
+	}
+
+	err = store.AddIssuerCertificate(issuer, ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Purge(context.Background(), issuer, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Refresh(context.Background(), issuer, serial)
+	if err != nil {
+		t.Errorf("Expected a refresh with the issuer's certificate to need no cached response, got %v", err)
+	}
+	if tu.Hits() != 3 {
+		t.Errorf("Expected a third upstream fetch, got %d", tu.Hits())
+	}
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// The ocsp package doesn't expose the CertID of a parsed response, so these
+// mirror just enough of RFC 6960 to read it.
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type singleResponse struct {
+	CertID     certID
+	CertStatus asn1.RawValue
+	ThisUpdate time.Time     `asn1:"generalized"`
+	NextUpdate time.Time     `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions asn1.RawValue `asn1:"explicit,tag:1,optional"`
+}
+
+type responseData struct {
+	Raw            asn1.RawContent
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []singleResponse
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type responseASN1 struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   asn1.ObjectIdentifier([]int{1, 3, 14, 3, 2, 26}),
+	crypto.SHA256: asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 2, 1}),
+	crypto.SHA384: asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 2, 2}),
+	crypto.SHA512: asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 2, 3}),
+}
+
+// Hash returns the hash algorithm used for the CertID's name and key hashes.
+func (id certID) Hash() (crypto.Hash, error) {
+	for h, oid := range hashOIDs {
+		if id.HashAlgorithm.Algorithm.Equal(oid) {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported CertID hash algorithm %v", id.HashAlgorithm.Algorithm)
+}
+
+// singleResponses returns the SingleResponses in a DER-encoded OCSP response.
+// It does not check any signatures.
+func singleResponses(rspBytes []byte) ([]singleResponse, error) {
+	var resp responseASN1
+	_, err := asn1.Unmarshal(rspBytes, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var basicResp basicResponse
+	_, err = asn1.Unmarshal(resp.Response.Response, &basicResp)
+	if err != nil {
+		return nil, err
+	}
+	return basicResp.TBSResponseData.Responses, nil
+}
+
+// responseCertIDs returns the CertID of each SingleResponse in a DER-encoded
+// OCSP response. It does not check any signatures.
+func responseCertIDs(rspBytes []byte) ([]certID, error) {
+	singles, err := singleResponses(rspBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]certID, 0, len(singles))
+	for _, single := range singles {
+		ids = append(ids, single.CertID)
+	}
+	return ids, nil
+}
+
+// responseCertID returns the CertID in a DER-encoded OCSP response for the
+// given serial number.
+func responseCertID(rspBytes []byte, serial *big.Int) (certID, error) {
+	ids, err := responseCertIDs(rspBytes)
+	if err != nil {
+		return certID{}, err
+	}
+	for _, id := range ids {
+		if id.SerialNumber != nil && id.SerialNumber.Cmp(serial) == 0 {
+			return id, nil
+		}
+	}
+	return certID{}, fmt.Errorf("no response for serial %x", serial)
+}
+
+// responseValidity returns the ThisUpdate and NextUpdate of the response for
+// the given serial number in a DER-encoded OCSP response. NextUpdate is zero
+// if the response doesn't have one.
+func responseValidity(rspBytes []byte, serial *big.Int) (time.Time, time.Time, error) {
+	singles, err := singleResponses(rspBytes)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	for _, single := range singles {
+		if single.CertID.SerialNumber != nil && single.CertID.SerialNumber.Cmp(serial) == 0 {
+			return single.ThisUpdate, single.NextUpdate, nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("no response for serial %x", serial)
+}
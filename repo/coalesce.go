@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"sync"
+)
+
+type fetchFunc func(ctx context.Context) ([]byte, map[string]string, error)
+
+type fetchCall struct {
+	done     chan struct{}
+	rspBytes []byte
+	headers  map[string]string
+	err      error
+}
+
+// fetchGroup coalesces concurrent fetches that share a key, so that only one
+// upstream request is in flight per key at a time. Every caller waiting on
+// that request receives its result, but each waiter gives up independently
+// when its own context is done.
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+}
+
+func newFetchGroup() *fetchGroup {
+	return &fetchGroup{
+		calls: make(map[string]*fetchCall),
+	}
+}
+
+// Do runs fn for the key unless a call for that key is already in flight, in
+// which case it waits for that call's result instead. The function runs with a
+// context that carries the first caller's deadline but not its cancellation,
+// so one impatient caller cannot fail the fetch for everyone else.
+func (g *fetchGroup) Do(ctx context.Context, key string, fn fetchFunc) ([]byte, map[string]string, error) {
+	g.mu.Lock()
+	call, inFlight := g.calls[key]
+	if !inFlight {
+		call = &fetchCall{done: make(chan struct{})}
+		g.calls[key] = call
+	}
+	g.mu.Unlock()
+
+	if !inFlight {
+		fetchCtx, cancel := detachedContext(ctx)
+		go func() {
+			defer cancel()
+			call.rspBytes, call.headers, call.err = fn(fetchCtx)
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.rspBytes, call.headers, call.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// Has reports whether a call for the key is currently in flight.
+func (g *fetchGroup) Has(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, inFlight := g.calls[key]
+	return inFlight
+}
+
+// InFlight reports how many distinct keys are currently being fetched.
+func (g *fetchGroup) InFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
+
+// detachedContext returns a context with the same deadline as ctx, but which
+// is not cancelled when ctx is.
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
@@ -6,64 +6,435 @@ package repo
 
 import (
 	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jcjones/ocsp-l2-cache/common"
 	"github.com/jcjones/ocsp-l2-cache/storage"
 )
 
+// Encoding is how a CompressedResponse is serialized for the cache.
+type Encoding int
+
+const (
+	// EncodingGob is the original gob encoding.
+	EncodingGob Encoding = iota
+	// EncodingBinary is the compact binary format, uncompressed.
+	EncodingBinary
+	// EncodingDeflate is the compact binary format, deflated with a dictionary
+	// of what OCSP responses have in common.
+	EncodingDeflate
+)
+
+const DefaultEncoding = EncodingDeflate
+
+// The compact binary format starts with a format byte, which is never the
+// first byte of a gob stream: gob starts with a message length, which is
+// either a byte below 0x80 or a byte count from 0xf8 up. Then comes a
+// compression byte, and the fields, possibly compressed. Other compressors,
+// like zstd, or newer dictionaries, get a compression byte of their own. The
+// first version of the format always stored the upstream's four caching
+// headers, the second none, and the third those the header policy kept. The
+// fourth added the fetch time.
+const (
+	formatBinaryV1 byte = 0x81
+	formatBinaryV2 byte = 0x82
+	formatBinaryV3 byte = 0x83
+	formatBinaryV4 byte = 0x84
+
+	compressionNone      byte = 0x00
+	compressionDeflateV1 byte = 0x01
+)
+
+// staleWarning marks responses served past their fresh life, per RFC 7234
+const staleWarning = `110 - "Response is Stale"`
+
+var maxAgeDirective = regexp.MustCompile(`(^|[\s,])(max-age|s-maxage)=("?)(\d+)("?)`)
+
+// maxDecompressedLength is far more than any OCSP response takes
+const maxDecompressedLength = 1 << 20
+
+var encodingNames = map[Encoding]string{
+	EncodingGob:     "gob",
+	EncodingBinary:  "binary",
+	EncodingDeflate: "deflate",
+}
+
+func (e Encoding) String() string {
+	name, ok := encodingNames[e]
+	if !ok {
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+	return name
+}
+
+// ParseEncoding returns the encoding with the given name: gob, binary or
+// deflate.
+func ParseEncoding(name string) (Encoding, error) {
+	for e, n := range encodingNames {
+		if strings.EqualFold(name, n) {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown encoding %q", name)
+}
+
+// CompressedResponse is a cached OCSP response. HTTP caching headers are
+// derived from the response when it is served, unless the upstream's were
+// kept.
 type CompressedResponse struct {
+	RawResp []byte
+	// FreshUntil is when the entry becomes stale. Entries written before it
+	// existed have the zero time, and are fresh for as long as they are cached.
+	FreshUntil time.Time
+	// FetchedAt is when the response was fetched from upstream. Entries
+	// written before it existed have the zero time.
+	FetchedAt time.Time
+	// UpstreamHeaders are served in place of the derived headers, if set
+	UpstreamHeaders map[string]string
+
+	// From the SingleResponse for the serial, which are never stored
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// legacyResponse is the gob encoding of earlier versions, which stored the
+// upstream's headers alongside the response. Gob skips fields the decoder
+// doesn't know, so UpstreamHeaders is added without earlier versions noticing.
+type legacyResponse struct {
 	RawResp                                   []byte
 	CacheControl, ETag, LastModified, Expires string
+	FreshUntil                                time.Time
+	FetchedAt                                 time.Time
+	UpstreamHeaders                           map[string]string
 }
 
+// NewCompressedResponse wraps the DER of a response for the serial.
+func NewCompressedResponse(rawResp []byte, serial storage.Serial) (*CompressedResponse, error) {
+	cr := &CompressedResponse{RawResp: rawResp}
+	err := cr.readValidity(serial)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// NewCompressedResponseFromBinaryString decodes a cache entry for the serial
+// in any of the encodings.
 func NewCompressedResponseFromBinaryString(s string, serial storage.Serial) (CompressedResponse, error) {
 	var cr CompressedResponse
-	buf := bytes.NewBuffer([]byte(s))
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&cr)
-	return cr, err
+	var err error
+	switch {
+	case len(s) > 0 && s[0] >= formatBinaryV1 && s[0] <= formatBinaryV4:
+		cr, err = decodeBinary(s[1:], s[0])
+	default:
+		var legacy legacyResponse
+		err = gob.NewDecoder(strings.NewReader(s)).Decode(&legacy)
+		cr = CompressedResponse{RawResp: legacy.RawResp, FreshUntil: legacy.FreshUntil, FetchedAt: legacy.FetchedAt, UpstreamHeaders: legacy.UpstreamHeaders}
+	}
+	if err != nil {
+		return cr, err
+	}
+	return cr, cr.readValidity(serial)
 }
 
-func NewCompressedResponseFromRawResponseAndHeaders(RawResp []byte, headers map[string]string) (*CompressedResponse, error) {
-	CacheControl, ok := headers[common.HeaderCacheControl]
-	if !ok {
-		return nil, fmt.Errorf("Cache-Control header not provided")
+func (cr *CompressedResponse) readValidity(serial storage.Serial) error {
+	thisUpdate, nextUpdate, err := responseValidity(cr.RawResp, serial.AsBigInt())
+	if err != nil {
+		return err
 	}
-	ETag, ok := headers[common.HeaderETag]
-	if !ok {
-		return nil, fmt.Errorf("ETag header not provided")
+	cr.thisUpdate = thisUpdate
+	cr.nextUpdate = nextUpdate
+	return nil
+}
+
+// BinaryString encodes the response with the DefaultEncoding.
+func (cr *CompressedResponse) BinaryString() (string, error) {
+	return cr.Encode(DefaultEncoding)
+}
+
+func (cr *CompressedResponse) Encode(e Encoding) (string, error) {
+	switch e {
+	case EncodingGob:
+		// Earlier versions serve the headers as stored, so store them as they
+		// are now
+		headers := cr.Headers(time.Now())
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		err := enc.Encode(&legacyResponse{
+			cr.RawResp,
+			headers[common.HeaderCacheControl],
+			headers[common.HeaderETag],
+			headers[common.HeaderLastModified],
+			headers[common.HeaderExpires],
+			cr.FreshUntil,
+			cr.FetchedAt,
+			cr.UpstreamHeaders,
+		})
+		return b.String(), err
+	case EncodingBinary:
+		var b bytes.Buffer
+		b.WriteByte(formatBinaryV4)
+		b.WriteByte(compressionNone)
+		cr.writeFields(&b)
+		return b.String(), nil
+	case EncodingDeflate:
+		var fields bytes.Buffer
+		cr.writeFields(&fields)
+		var b bytes.Buffer
+		b.WriteByte(formatBinaryV4)
+		b.WriteByte(compressionDeflateV1)
+		err := deflate(&b, fields.Bytes())
+		return b.String(), err
+	default:
+		return "", fmt.Errorf("Unknown encoding %s", e)
 	}
-	LastModified, ok := headers[common.HeaderLastModified]
-	if !ok {
-		return nil, fmt.Errorf("Last-Modified header not provided")
+}
+
+// writeFields writes the response with a length prefix, then FreshUntil and
+// FetchedAt as Unix nanoseconds, or 0 if unset, then the number of upstream
+// headers and each one's name and value, with length prefixes.
+func (cr *CompressedResponse) writeFields(b *bytes.Buffer) {
+	var scratch [binary.MaxVarintLen64]byte
+	writeField := func(field string) {
+		b.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(field)))])
+		b.WriteString(field)
 	}
-	Expires, ok := headers[common.HeaderExpires]
-	if !ok {
-		return nil, fmt.Errorf("Expires header not provided")
+
+	b.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(cr.RawResp)))])
+	b.Write(cr.RawResp)
+	for _, t := range []time.Time{cr.FreshUntil, cr.FetchedAt} {
+		var nanos int64
+		if !t.IsZero() {
+			nanos = t.UnixNano()
+		}
+		b.Write(scratch[:binary.PutVarint(scratch[:], nanos)])
+	}
+
+	names := make([]string, 0, len(cr.UpstreamHeaders))
+	for k := range cr.UpstreamHeaders {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	b.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(names)))])
+	for _, k := range names {
+		writeField(k)
+		writeField(cr.UpstreamHeaders[k])
 	}
-	return &CompressedResponse{
-		RawResp,
-		CacheControl,
-		ETag,
-		LastModified,
-		Expires,
-	}, nil
 }
 
-func (cr *CompressedResponse) BinaryString() (string, error) {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	err := enc.Encode(cr)
-	return b.String(), err
+// decodeBinary decodes the given version of the compact binary format, after
+// its format byte. The upstream headers stored by the first version are
+// skipped, as they were stored regardless of policy.
+func decodeBinary(s string, format byte) (CompressedResponse, error) {
+	var cr CompressedResponse
+	if len(s) == 0 {
+		return cr, fmt.Errorf("Truncated entry")
+	}
+
+	var fields []byte
+	switch s[0] {
+	case compressionNone:
+		fields = []byte(s[1:])
+	case compressionDeflateV1:
+		var err error
+		fields, err = inflate(s[1:])
+		if err != nil {
+			return cr, err
+		}
+	default:
+		return cr, fmt.Errorf("Unknown compression %#x", s[0])
+	}
+
+	r := bytes.NewReader(fields)
+	var err error
+	readField := func() []byte {
+		if err != nil {
+			return nil
+		}
+		length, lerr := binary.ReadUvarint(r)
+		if lerr != nil || length > uint64(r.Len()) {
+			err = fmt.Errorf("Truncated entry")
+			return nil
+		}
+		field := make([]byte, length)
+		_, _ = r.Read(field)
+		return field
+	}
+	cr.RawResp = readField()
+	if format == formatBinaryV1 {
+		for i := 0; i < 4; i++ {
+			readField()
+		}
+	}
+	if err != nil {
+		return cr, err
+	}
+
+	readTime := func() time.Time {
+		if err != nil {
+			return time.Time{}
+		}
+		nanos, terr := binary.ReadVarint(r)
+		if terr != nil {
+			err = fmt.Errorf("Truncated entry")
+		}
+		if nanos == 0 {
+			return time.Time{}
+		}
+		return time.Unix(0, nanos)
+	}
+	cr.FreshUntil = readTime()
+	if format >= formatBinaryV4 {
+		cr.FetchedAt = readTime()
+	}
+	if err != nil {
+		return cr, err
+	}
+
+	if format >= formatBinaryV3 {
+		count, cerr := binary.ReadUvarint(r)
+		if cerr != nil || count > uint64(r.Len()) {
+			return cr, fmt.Errorf("Truncated entry")
+		}
+		if count > 0 {
+			cr.UpstreamHeaders = make(map[string]string, count)
+		}
+		for i := uint64(0); i < count; i++ {
+			k := readField()
+			v := readField()
+			if err != nil {
+				return cr, err
+			}
+			cr.UpstreamHeaders[string(k)] = string(v)
+		}
+	}
+
+	if r.Len() > 0 {
+		return cr, fmt.Errorf("%d trailing bytes in entry", r.Len())
+	}
+	return cr, nil
 }
 
-func (cr *CompressedResponse) Headers() map[string]string {
+// IsFresh reports whether the response can be served at the given time
+// without being refreshed first.
+func (cr *CompressedResponse) IsFresh(now time.Time) bool {
+	return cr.FreshUntil.IsZero() || now.Before(cr.FreshUntil)
+}
+
+// Headers returns the HTTP caching headers for serving the response at the
+// given time. Last-Modified and Expires are its ThisUpdate and NextUpdate, and
+// clients may cache it for as long as it remains valid. The ETag is a hash of
+// the response. Any UpstreamHeaders take precedence, though their max-age is
+// capped so that it too ends by NextUpdate.
+//
+// As for any cached HTTP response, max-age is counted from when the response
+// was fetched, and the Age header says how long ago that was, so that what
+// remains of max-age after subtracting Age counts down to the expiry. Entries
+// without a fetch time are treated as just fetched. Responses past their
+// fresh life are marked with a stale Warning.
+func (cr *CompressedResponse) Headers(now time.Time) map[string]string {
+	fetchedAt := cr.FetchedAt
+	if fetchedAt.IsZero() || fetchedAt.After(now) {
+		fetchedAt = now
+	}
+	var maxAge int64
+	if cr.nextUpdate.After(fetchedAt) {
+		maxAge = int64(cr.nextUpdate.Sub(fetchedAt) / time.Second)
+	}
+
 	h := make(map[string]string)
-	h[common.HeaderETag] = cr.ETag
-	h[common.HeaderExpires] = cr.Expires
-	h[common.HeaderLastModified] = cr.LastModified
-	h[common.HeaderCacheControl] = cr.CacheControl
+	h[common.HeaderETag] = fmt.Sprintf("\"%X\"", sha256.Sum256(cr.RawResp))
+	h[common.HeaderLastModified] = cr.thisUpdate.UTC().Format(http.TimeFormat)
+	if !cr.nextUpdate.IsZero() {
+		h[common.HeaderExpires] = cr.nextUpdate.UTC().Format(http.TimeFormat)
+	}
+	h[common.HeaderCacheControl] = fmt.Sprintf("public, no-transform, must-revalidate, max-age=%d", maxAge)
+
+	for k, v := range cr.UpstreamHeaders {
+		h[k] = v
+	}
+	if cc, ok := cr.UpstreamHeaders[common.HeaderCacheControl]; ok && !cr.nextUpdate.IsZero() {
+		h[common.HeaderCacheControl] = capMaxAge(cc, maxAge)
+	}
+
+	if !cr.FetchedAt.IsZero() {
+		h[common.HeaderAge] = strconv.FormatInt(int64(now.Sub(fetchedAt)/time.Second), 10)
+	}
+	if !cr.IsFresh(now) {
+		h[common.HeaderWarning] = staleWarning
+	}
 	return h
 }
+
+// capMaxAge lowers the max-age and s-maxage directives of a Cache-Control
+// header to at most maxAge seconds.
+func capMaxAge(cacheControl string, maxAge int64) string {
+	return maxAgeDirective.ReplaceAllStringFunc(cacheControl, func(directive string) string {
+		m := maxAgeDirective.FindStringSubmatch(directive)
+		value, err := strconv.ParseInt(m[4], 10, 64)
+		if err == nil && value <= maxAge {
+			return directive
+		}
+		return fmt.Sprintf("%s%s=%s%d%s", m[1], m[2], m[3], maxAge, m[5])
+	})
+}
+
+//go:generate go run ../tools/gendict -corpus ../tools/gendict/testdata/corpus -o dictionary.go
+
+// Deflate state is large, so it's reused across entries
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriterDict(nil, flate.BestCompression, responseDictionaryV1)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	},
+}
+
+var inflaters = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReaderDict(nil, responseDictionaryV1)
+	},
+}
+
+func deflate(dst io.Writer, data []byte) error {
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+	w.Reset(dst)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func inflate(s string) ([]byte, error) {
+	r := inflaters.Get().(io.ReadCloser)
+	defer inflaters.Put(r)
+	err := r.(flate.Resetter).Reset(strings.NewReader(s), responseDictionaryV1)
+	if err != nil {
+		return nil, err
+	}
+	// Bound what a corrupt entry can make us allocate
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedLength+1))
+	if err != nil {
+		return nil, fmt.Errorf("Decompressing entry: %v", err)
+	}
+	if len(data) > maxDecompressedLength {
+		return nil, fmt.Errorf("Entry decompresses to over %d bytes", maxDecompressedLength)
+	}
+	return data, nil
+}
@@ -5,11 +5,28 @@
 package repo
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jcjones/ocsp-l2-cache/common"
 	"github.com/jcjones/ocsp-l2-cache/storage"
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestInvalidBinaryString(t *testing.T) {
@@ -20,78 +37,427 @@ func TestInvalidBinaryString(t *testing.T) {
 	}
 }
 
-func TestRequiredHeaders(t *testing.T) {
+func TestRoundtrip(t *testing.T) {
 	t.Parallel()
-	h := make(map[string]string)
+	cr := typicalResponse(t, newSampleKey(t))
+	cr.FreshUntil = time.Time{}
 
-	binString := []byte("hey")
+	encoded, err := cr.BinaryString()
+	if err != nil {
+		t.Error(err)
+	}
 
-	_, err := NewCompressedResponseFromRawResponseAndHeaders(binString, h)
-	if err == nil {
-		t.Error("Expected an error!")
+	cr2, err := NewCompressedResponseFromBinaryString(encoded, sampleSerial)
+	if err != nil {
+		t.Error(err)
 	}
 
-	h[common.HeaderETag] = "etag"
-	_, err = NewCompressedResponseFromRawResponseAndHeaders(binString, h)
-	if err == nil {
-		t.Error("Expected an error!")
+	if !reflect.DeepEqual(*cr, cr2) {
+		t.Errorf("Expected equality between %+v and %+v", cr, cr2)
 	}
+}
 
-	h[common.HeaderExpires] = "expires"
-	_, err = NewCompressedResponseFromRawResponseAndHeaders(binString, h)
+func TestNewCompressedResponseWrongSerial(t *testing.T) {
+	t.Parallel()
+	cr := typicalResponse(t, newSampleKey(t))
+	_, err := NewCompressedResponse(cr.RawResp, storage.NewSerialFromHex("de4d"))
 	if err == nil {
-		t.Error("Expected an error!")
+		t.Error("Expected an error for a serial the response isn't about")
 	}
+}
 
-	h[common.HeaderLastModified] = "modified"
-	_, err = NewCompressedResponseFromRawResponseAndHeaders(binString, h)
-	if err == nil {
-		t.Error("Expected an error!")
+func TestHeaders(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	thisUpdate := now.Add(-time.Hour).Truncate(time.Second)
+	nextUpdate := now.Add(48 * time.Hour).Truncate(time.Second)
+	cr := sampleResponse(t, newSampleKey(t), thisUpdate, nextUpdate)
+
+	expected := map[string]string{
+		common.HeaderETag:         etagOf(cr.RawResp),
+		common.HeaderLastModified: thisUpdate.UTC().Format(http.TimeFormat),
+		common.HeaderExpires:      nextUpdate.UTC().Format(http.TimeFormat),
+		common.HeaderCacheControl: fmt.Sprintf("public, no-transform, must-revalidate, max-age=%d", int(nextUpdate.Sub(now).Seconds())),
+	}
+	if h := cr.Headers(now); !reflect.DeepEqual(h, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, h)
 	}
 
-	h["irrelevant-header"] = "still shouldn't work"
-	_, err = NewCompressedResponseFromRawResponseAndHeaders(binString, h)
-	if err == nil {
-		t.Error("Expected an error!")
+	// max-age counts down to NextUpdate, and no further
+	later := now.Add(24 * time.Hour)
+	h := cr.Headers(later)
+	if h[common.HeaderCacheControl] != fmt.Sprintf("public, no-transform, must-revalidate, max-age=%d", int(nextUpdate.Sub(later).Seconds())) {
+		t.Errorf("Unexpected Cache-Control a day later: %s", h[common.HeaderCacheControl])
 	}
+	h = cr.Headers(nextUpdate.Add(time.Hour))
+	if h[common.HeaderCacheControl] != "public, no-transform, must-revalidate, max-age=0" {
+		t.Errorf("Unexpected Cache-Control past NextUpdate: %s", h[common.HeaderCacheControl])
+	}
+}
+
+func TestHeadersAge(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	nextUpdate := now.Add(48 * time.Hour).Truncate(time.Second)
+	cr := sampleResponse(t, newSampleKey(t), now.Add(-2*time.Hour), nextUpdate)
+	cr.FetchedAt = now.Add(-time.Hour)
+	cr.FreshUntil = now.Add(time.Hour)
 
-	h[common.HeaderCacheControl] = "control"
-	cr, err := NewCompressedResponseFromRawResponseAndHeaders(binString, h)
+	// max-age runs from the fetch to NextUpdate, the Age since the fetch
+	maxAge := fmt.Sprintf("public, no-transform, must-revalidate, max-age=%d", int(nextUpdate.Sub(cr.FetchedAt).Seconds()))
+	h := cr.Headers(now)
+	if h[common.HeaderAge] != "3600" || h[common.HeaderCacheControl] != maxAge {
+		t.Errorf("Unexpected Age or Cache-Control: %+v", h)
+	}
+	if _, ok := h[common.HeaderWarning]; ok {
+		t.Errorf("Fresh responses mustn't be marked stale: %+v", h)
+	}
+
+	h = cr.Headers(now.Add(2 * time.Hour))
+	if h[common.HeaderAge] != "10800" || h[common.HeaderCacheControl] != maxAge {
+		t.Errorf("Unexpected Age or Cache-Control: %+v", h)
+	}
+	if h[common.HeaderWarning] != `110 - "Response is Stale"` {
+		t.Errorf("Expected a stale warning, got %+v", h)
+	}
+}
+
+func TestHeadersCapUpstreamMaxAge(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	nextUpdate := now.Add(time.Hour).Truncate(time.Second)
+	cr := sampleResponse(t, newSampleKey(t), now.Add(-time.Hour), nextUpdate)
+	cr.FetchedAt = now.Add(-20 * time.Hour)
+	cr.UpstreamHeaders = map[string]string{common.HeaderCacheControl: "public, max-age=604800"}
+
+	h := cr.Headers(now)
+	expected := fmt.Sprintf("public, max-age=%d", int(nextUpdate.Sub(cr.FetchedAt).Seconds()))
+	if h[common.HeaderCacheControl] != expected {
+		t.Errorf("Expected %s, got %s", expected, h[common.HeaderCacheControl])
+	}
+}
+
+func TestCapMaxAge(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		cacheControl string
+		expected     string
+	}{
+		{"public, max-age=3600", "public, max-age=100"},
+		{"max-age=50, public", "max-age=50, public"},
+		{`s-maxage=9999,max-age="9999"`, `s-maxage=100,max-age="100"`},
+		{"no-cache", "no-cache"},
+	}
+	for _, tt := range tests {
+		if capped := capMaxAge(tt.cacheControl, 100); capped != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, capped)
+		}
+	}
+}
+
+func TestHeadersWithoutNextUpdate(t *testing.T) {
+	t.Parallel()
+	cr := sampleResponse(t, newSampleKey(t), time.Now().Add(-time.Hour), time.Time{})
+	h := cr.Headers(time.Now())
+	if _, ok := h[common.HeaderExpires]; ok {
+		t.Errorf("Expected no Expires without a NextUpdate, got %s", h[common.HeaderExpires])
+	}
+	if h[common.HeaderCacheControl] != "public, no-transform, must-revalidate, max-age=0" {
+		t.Errorf("Unexpected Cache-Control: %s", h[common.HeaderCacheControl])
+	}
+}
+
+func TestDecodeEarlierEntries(t *testing.T) {
+	t.Parallel()
+	cr := typicalResponse(t, newSampleKey(t))
+
+	// As earlier versions declared it, without UpstreamHeaders
+	type earlierResponse struct {
+		RawResp                                   []byte
+		CacheControl, ETag, LastModified, Expires string
+		FreshUntil                                time.Time
+		FetchedAt                                 time.Time
+	}
+	var gobEntry bytes.Buffer
+	err := gob.NewEncoder(&gobEntry).Encode(&earlierResponse{cr.RawResp, "max-age=3600", "\"etag\"", "modified", "expires", cr.FreshUntil, cr.FetchedAt})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	// The first binary format stored the upstream's headers after the response
+	var binaryV1 bytes.Buffer
+	binaryV1.Write([]byte{formatBinaryV1, compressionNone})
+	var scratch [binary.MaxVarintLen64]byte
+	for _, field := range []string{string(cr.RawResp), "max-age=3600", "\"etag\"", "modified", "expires"} {
+		binaryV1.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(field)))])
+		binaryV1.WriteString(field)
 	}
+	binaryV1.Write(scratch[:binary.PutVarint(scratch[:], cr.FreshUntil.UnixNano())])
 
-	delete(h, "irrelevant-header")
-	if !reflect.DeepEqual(h, cr.Headers()) {
-		t.Errorf("Expected the headers to match, got %+v expected %+v", cr.Headers(), h)
+	for name, entry := range map[string]string{"gob": gobEntry.String(), "binary v1": binaryV1.String()} {
+		decoded, err := NewCompressedResponseFromBinaryString(entry, sampleSerial)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !decoded.FreshUntil.Equal(cr.FreshUntil) {
+			t.Errorf("%s: expected FreshUntil %s, got %s", name, cr.FreshUntil, decoded.FreshUntil)
+		}
+		decoded.FreshUntil = cr.FreshUntil
+		if !reflect.DeepEqual(*cr, decoded) {
+			t.Errorf("%s: expected equality between %+v and %+v", name, cr, decoded)
+		}
 	}
 }
 
-func TestRoundtrip(t *testing.T) {
+func TestGobEncodingKeepsHeaders(t *testing.T) {
 	t.Parallel()
-	h := make(map[string]string)
-	h[common.HeaderETag] = "etag"
-	h[common.HeaderExpires] = "expires"
-	h[common.HeaderLastModified] = "modified"
-	h[common.HeaderCacheControl] = "control"
+	cr := typicalResponse(t, newSampleKey(t))
+	encoded, err := cr.Encode(EncodingGob)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	binString := []byte("hey")
-	cr, err := NewCompressedResponseFromRawResponseAndHeaders(binString, h)
+	// Earlier versions serve whatever headers they find
+	var legacy legacyResponse
+	err = gob.NewDecoder(strings.NewReader(encoded)).Decode(&legacy)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	if legacy.ETag != etagOf(cr.RawResp) || legacy.LastModified != "Fri, 16 Oct 2020 19:00:00 GMT" || legacy.Expires != "Fri, 23 Oct 2020 19:00:00 GMT" || legacy.CacheControl == "" {
+		t.Errorf("Expected the synthesized headers, got %+v", legacy)
+	}
+}
 
-	encoded, err := cr.BinaryString()
+var sampleSerial = storage.NewSerialFromHex("3fd4c1ab39c0da5f3c8b7f0e4a6d2e11")
+
+// sampleResponse returns a response shaped like a real one: from an issuer
+// with a two-part name, and with a 128-bit serial.
+func sampleResponse(tb testing.TB, key crypto.Signer, thisUpdate time.Time, nextUpdate time.Time) *CompressedResponse {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Country: []string{"US"}, Organization: []string{"Let's Encrypt"}, CommonName: "R3"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
 	if err != nil {
-		t.Error(err)
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
 	}
 
-	cr2, err := NewCompressedResponseFromBinaryString(encoded, storage.NewSerialFromHex("de4d"))
+	rspBytes, err := ocsp.CreateResponse(cert, cert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: sampleSerial.AsBigInt(),
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+	}, key)
 	if err != nil {
-		t.Error(err)
+		tb.Fatal(err)
 	}
 
-	if !reflect.DeepEqual(*cr, cr2) {
-		t.Errorf("Expected equality between %+v and %+v", cr, cr2)
+	cr, err := NewCompressedResponse(rspBytes, sampleSerial)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cr.FreshUntil = thisUpdate.Add(84 * time.Hour)
+	return cr
+}
+
+func typicalResponse(tb testing.TB, key crypto.Signer) *CompressedResponse {
+	thisUpdate := time.Date(2020, 10, 16, 19, 0, 0, 0, time.UTC)
+	return sampleResponse(tb, key, thisUpdate, thisUpdate.Add(7*24*time.Hour))
+}
+
+func newSampleKey(tb testing.TB) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return key
+}
+
+func etagOf(rspBytes []byte) string {
+	return fmt.Sprintf("\"%X\"", sha256.Sum256(rspBytes))
+}
+
+func sampleKeys(tb testing.TB) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": newSampleKey(tb)}
+}
+
+func TestRoundtripEncodings(t *testing.T) {
+	t.Parallel()
+	cr := typicalResponse(t, newSampleKey(t))
+	cr.FetchedAt = time.Date(2020, 10, 16, 20, 0, 0, 0, time.UTC)
+
+	for _, e := range []Encoding{EncodingGob, EncodingBinary, EncodingDeflate} {
+		encoded, err := cr.Encode(e)
+		if err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		isBinary := encoded[0] == formatBinaryV4
+		if isBinary == (e == EncodingGob) {
+			t.Errorf("%s: unexpected format byte %#x", e, encoded[0])
+		}
+
+		cr2, err := NewCompressedResponseFromBinaryString(encoded, sampleSerial)
+		if err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		if !cr2.FreshUntil.Equal(cr.FreshUntil) || !cr2.FetchedAt.Equal(cr.FetchedAt) {
+			t.Errorf("%s: expected times %s and %s, got %s and %s", e, cr.FreshUntil, cr.FetchedAt, cr2.FreshUntil, cr2.FetchedAt)
+		}
+		cr2.FreshUntil = cr.FreshUntil
+		cr2.FetchedAt = cr.FetchedAt
+		if !reflect.DeepEqual(*cr, cr2) {
+			t.Errorf("%s: expected equality between %+v and %+v", e, cr, cr2)
+		}
+	}
+}
+
+func TestRoundtripUpstreamHeaders(t *testing.T) {
+	t.Parallel()
+	cr := typicalResponse(t, newSampleKey(t))
+	cr.UpstreamHeaders = map[string]string{common.HeaderCacheControl: "max-age=3600", common.HeaderETag: "\"etag\""}
+
+	for _, e := range []Encoding{EncodingGob, EncodingBinary, EncodingDeflate} {
+		encoded, err := cr.Encode(e)
+		if err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		cr2, err := NewCompressedResponseFromBinaryString(encoded, sampleSerial)
+		if err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		if !reflect.DeepEqual(cr.UpstreamHeaders, cr2.UpstreamHeaders) {
+			t.Errorf("%s: expected %+v, got %+v", e, cr.UpstreamHeaders, cr2.UpstreamHeaders)
+		}
+	}
+
+	h := cr.Headers(time.Date(2020, 10, 16, 20, 0, 0, 0, time.UTC))
+	if h[common.HeaderCacheControl] != "max-age=3600" || h[common.HeaderETag] != "\"etag\"" {
+		t.Errorf("Expected the upstream's headers, got %+v", h)
+	}
+	if h[common.HeaderLastModified] != "Fri, 16 Oct 2020 19:00:00 GMT" {
+		t.Errorf("Expected the headers the upstream omitted to be derived, got %+v", h)
+	}
+}
+
+func TestDeflateIsSmaller(t *testing.T) {
+	t.Parallel()
+	for name, key := range sampleKeys(t) {
+		cr := typicalResponse(t, key)
+		sizes := make(map[Encoding]int)
+		for _, e := range []Encoding{EncodingGob, EncodingBinary, EncodingDeflate} {
+			encoded, err := cr.Encode(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[e] = len(encoded)
+		}
+		if sizes[EncodingBinary] >= sizes[EncodingGob] || sizes[EncodingDeflate] >= sizes[EncodingBinary] {
+			t.Errorf("%s: expected each encoding to be smaller than the last, got %v", name, sizes)
+		}
+	}
+}
+
+func TestDictionaryUnchanged(t *testing.T) {
+	t.Parallel()
+	// Entries deflated with it are unreadable if it changes, even by
+	// regenerating it
+	sum := fmt.Sprintf("%x", sha256.Sum256(responseDictionaryV1))
+	if sum != "0f21992703e0cc96f8ef04e25e86373184092ca88525d49459c459bc50b58f7d" {
+		t.Errorf("responseDictionaryV1 changed, to SHA-256 %s", sum)
+	}
+}
+
+func TestInvalidBinaryEntries(t *testing.T) {
+	t.Parallel()
+	cr := typicalResponse(t, newSampleKey(t))
+	binaryEntry, err := cr.Encode(EncodingBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflateEntry, err := cr.Encode(EncodingDeflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, entry := range map[string]string{
+		"format byte only":    binaryEntry[:1],
+		"truncated":           binaryEntry[:len(binaryEntry)-3],
+		"trailing bytes":      binaryEntry + "x",
+		"unknown compression": binaryEntry[:1] + "\x7f" + binaryEntry[2:],
+		"corrupt deflate":     deflateEntry[:2] + strings.Repeat("\xff", len(deflateEntry)-2),
+		"truncated deflate":   deflateEntry[:len(deflateEntry)-2],
+	} {
+		_, err := NewCompressedResponseFromBinaryString(entry, sampleSerial)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	t.Parallel()
+	for _, e := range []Encoding{EncodingGob, EncodingBinary, EncodingDeflate} {
+		parsed, err := ParseEncoding(strings.ToUpper(e.String()))
+		if err != nil || parsed != e {
+			t.Errorf("Expected %s, got %s %v", e, parsed, err)
+		}
+	}
+	if _, err := ParseEncoding("zip"); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+}
+
+// The benchmarks report the size of each encoding of a typical cached
+// response as bytes/entry.
+func BenchmarkEncode(b *testing.B) {
+	for name, key := range sampleKeys(b) {
+		cr := typicalResponse(b, key)
+		for _, e := range []Encoding{EncodingGob, EncodingBinary, EncodingDeflate} {
+			b.Run(name+"/"+e.String(), func(b *testing.B) {
+				var encoded string
+				var err error
+				for i := 0; i < b.N; i++ {
+					encoded, err = cr.Encode(e)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(encoded)), "bytes/entry")
+				b.ReportMetric(float64(len(cr.RawResp)), "bytes/response")
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for name, key := range sampleKeys(b) {
+		cr := typicalResponse(b, key)
+		for _, e := range []Encoding{EncodingGob, EncodingBinary, EncodingDeflate} {
+			encoded, err := cr.Encode(e)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(name+"/"+e.String(), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := NewCompressedResponseFromBinaryString(encoded, sampleSerial); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(encoded)), "bytes/entry")
+			})
+		}
 	}
 }
@@ -4,12 +4,35 @@
 
 package repo
 
+import "fmt"
+
 const UpstreamError = OcspStoreError("upstream")
 
 const UnknownIssuerError = OcspStoreError("unknown issuer")
 
+const InvalidResponseError = OcspStoreError("invalid upstream response")
+
+const NotCachedError = OcspStoreError("not cached")
+
 type OcspStoreError string
 
 func (e OcspStoreError) Error() string { return string(e) }
 
 func (OcspStoreError) OcspStoreError() {}
+
+// causedError is an OcspStoreError, for callers to test for with errors.Is,
+// which keeps the error that caused it in the chain too.
+type causedError struct {
+	kind  OcspStoreError
+	cause error
+}
+
+func wrapError(kind OcspStoreError, cause error) error {
+	return &causedError{kind, cause}
+}
+
+func (e *causedError) Error() string { return fmt.Sprintf("%s: %v", e.kind, e.cause) }
+
+func (e *causedError) Is(target error) bool { return target == e.kind }
+
+func (e *causedError) Unwrap() error { return e.cause }
@@ -0,0 +1,29 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWrapErrorKeepsCause(t *testing.T) {
+	t.Parallel()
+	err := wrapError(UpstreamError, fmt.Errorf("fetching: %w", context.Canceled))
+	if !errors.Is(err, UpstreamError) {
+		t.Errorf("Expected %v to be an UpstreamError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v to keep its cause", err)
+	}
+	if errors.Is(err, InvalidResponseError) {
+		t.Errorf("Expected %v not to be an InvalidResponseError", err)
+	}
+	if err.Error() != "upstream: fetching: context canceled" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+}
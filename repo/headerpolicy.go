@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+)
+
+// HeaderPolicy decides what becomes of the HTTP caching headers an upstream
+// responder sends along with its responses.
+type HeaderPolicy int
+
+const (
+	// HeaderPolicySynthesize ignores the upstream's headers, and derives them
+	// all from the response when serving it.
+	HeaderPolicySynthesize HeaderPolicy = iota
+	// HeaderPolicyPassthrough caches the upstream's headers and serves them
+	// as they were received. Any it omits are derived from the response.
+	HeaderPolicyPassthrough
+	// HeaderPolicyRequire is HeaderPolicyPassthrough, but rejects responses
+	// unless the upstream sent every one of fetcher.RelevantHeaders.
+	HeaderPolicyRequire
+)
+
+const DefaultHeaderPolicy = HeaderPolicySynthesize
+
+var headerPolicyNames = map[HeaderPolicy]string{
+	HeaderPolicySynthesize:  "synthesize",
+	HeaderPolicyPassthrough: "passthrough",
+	HeaderPolicyRequire:     "require",
+}
+
+func (p HeaderPolicy) String() string {
+	name, ok := headerPolicyNames[p]
+	if !ok {
+		return fmt.Sprintf("HeaderPolicy(%d)", int(p))
+	}
+	return name
+}
+
+// ParseHeaderPolicy returns the policy with the given name: synthesize,
+// passthrough or require.
+func ParseHeaderPolicy(name string) (HeaderPolicy, error) {
+	for p, n := range headerPolicyNames {
+		if strings.EqualFold(name, n) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown header policy %q", name)
+}
+
+// upstreamHeaders returns which of the upstream's headers to cache along with
+// its response, or an error if the policy rejects the response.
+func (p HeaderPolicy) upstreamHeaders(headers map[string]string) (map[string]string, error) {
+	switch p {
+	case HeaderPolicySynthesize:
+		return nil, nil
+	case HeaderPolicyRequire:
+		for _, k := range fetcher.RelevantHeaders {
+			if _, ok := headers[k]; !ok {
+				return nil, fmt.Errorf("%s header not provided", k)
+			}
+		}
+	}
+
+	kept := make(map[string]string)
+	for _, k := range fetcher.RelevantHeaders {
+		if v, ok := headers[k]; ok {
+			kept[k] = v
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return kept, nil
+}
@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+)
+
+func TestParseHeaderPolicy(t *testing.T) {
+	t.Parallel()
+	for _, p := range []HeaderPolicy{HeaderPolicySynthesize, HeaderPolicyPassthrough, HeaderPolicyRequire} {
+		parsed, err := ParseHeaderPolicy(p.String())
+		if err != nil || parsed != p {
+			t.Errorf("Expected %s, got %s %v", p, parsed, err)
+		}
+	}
+	if _, err := ParseHeaderPolicy("ignore"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestHeaderPolicyUpstreamHeaders(t *testing.T) {
+	t.Parallel()
+	all := map[string]string{
+		common.HeaderCacheControl: "max-age=3600",
+		common.HeaderETag:         "\"etag\"",
+		common.HeaderLastModified: "modified",
+		common.HeaderExpires:      "expires",
+	}
+	partial := map[string]string{common.HeaderETag: "\"etag\""}
+
+	tests := []struct {
+		policy      HeaderPolicy
+		headers     map[string]string
+		expected    map[string]string
+		expectedErr bool
+	}{
+		{HeaderPolicySynthesize, all, nil, false},
+		{HeaderPolicyPassthrough, all, all, false},
+		{HeaderPolicyPassthrough, partial, partial, false},
+		{HeaderPolicyPassthrough, map[string]string{}, nil, false},
+		{HeaderPolicyRequire, all, all, false},
+		{HeaderPolicyRequire, partial, nil, true},
+	}
+	for _, tt := range tests {
+		kept, err := tt.policy.upstreamHeaders(tt.headers)
+		if (err != nil) != tt.expectedErr {
+			t.Errorf("%s %+v: unexpected error %v", tt.policy, tt.headers, err)
+		}
+		if !reflect.DeepEqual(kept, tt.expected) {
+			t.Errorf("%s %+v: expected %+v, got %+v", tt.policy, tt.headers, tt.expected, kept)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+const leaseKeyPrefix = "lease/"
+
+// fetchLease lets replicas sharing a RemoteCache agree on which one of them
+// fetches a given serial from upstream. The lease is a short-lived cache entry
+// created with SetIfNotExist; whoever's token ends up stored in it won.
+type fetchLease struct {
+	cache     storage.RemoteCache
+	owner     string
+	life      time.Duration
+	maxWait   time.Duration
+	pollEvery time.Duration
+}
+
+func newFetchLease(cache storage.RemoteCache, owner string, life time.Duration, maxWait time.Duration) *fetchLease {
+	pollEvery := maxWait / 10
+	if pollEvery < 10*time.Millisecond {
+		pollEvery = 10 * time.Millisecond
+	}
+	if pollEvery > 100*time.Millisecond {
+		pollEvery = 100 * time.Millisecond
+	}
+	return &fetchLease{cache, owner, life, maxWait, pollEvery}
+}
+
+func leaseKey(issuer storage.Issuer, serial storage.Serial) string {
+	return leaseKeyPrefix + issuer.String() + "/" + serial.HexString()
+}
+
+func (fl *fetchLease) newToken() (string, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return fl.owner + "/" + hex.EncodeToString(nonce), nil
+}
+
+// Acquire attempts to take the lease at key. It returns the token to pass to
+// Release and whether this caller won.
+func (fl *fetchLease) Acquire(ctx context.Context, key string) (string, bool, error) {
+	token, err := fl.newToken()
+	if err != nil {
+		return "", false, err
+	}
+	holder, err := fl.cache.SetIfNotExist(ctx, key, token, fl.life)
+	if err != nil {
+		return "", false, err
+	}
+	return token, holder == token, nil
+}
+
+// Release gives up the lease at key, if it is still held by token. Leases
+// expire on their own, so failures here only delay other replicas.
+func (fl *fetchLease) Release(ctx context.Context, key string, token string) error {
+	_, err := fl.cache.ExpireIfEqual(ctx, key, token, time.Now())
+	return err
+}
+
+// WaitFor polls the cache for cacheKey until it holds something other than
+// previous, the lease at key is given up without the entry being written,
+// maxWait passes, or the context is done. It returns the cached value and
+// whether a new one was found.
+func (fl *fetchLease) WaitFor(ctx context.Context, key string, cacheKey string, previous string) (string, bool, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, fl.maxWait)
+	defer cancel()
+
+	ticker := time.NewTicker(fl.pollEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-waitCtx.Done():
+			return "", false, nil
+		case <-ticker.C:
+		}
+
+		cached, found, err := fl.cache.Get(waitCtx, cacheKey)
+		if err != nil && waitCtx.Err() != nil {
+			return "", false, nil
+		}
+		if err != nil || (found && cached != previous) {
+			return cached, found, err
+		}
+
+		held, err := fl.cache.Exists(waitCtx, key)
+		if err != nil || held {
+			continue
+		}
+		// The holder is done; it may have written the entry since we looked
+		cached, found, err = fl.cache.Get(waitCtx, cacheKey)
+		return cached, found && cached != previous, err
+	}
+}
@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+func TestLeaseAcquireRelease(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	cache := storage.NewMockRemoteCache()
+	a := newFetchLease(cache, "a", time.Minute, time.Second)
+	b := newFetchLease(cache, "b", time.Minute, time.Second)
+
+	tokenA, won, err := a.Acquire(ctx, "lease/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !won {
+		t.Error("First acquirer should have won")
+	}
+
+	tokenB, won, err := b.Acquire(ctx, "lease/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if won {
+		t.Error("Second acquirer should not have won")
+	}
+
+	// Releasing with a token that doesn't hold the lease is a no-op
+	if err := b.Release(ctx, "lease/test", tokenB); err != nil {
+		t.Error(err)
+	}
+	if held, _ := cache.Exists(ctx, "lease/test"); !held {
+		t.Error("Lease should still be held by a")
+	}
+
+	if err := a.Release(ctx, "lease/test", tokenA); err != nil {
+		t.Error(err)
+	}
+	if held, _ := cache.Exists(ctx, "lease/test"); held {
+		t.Error("Lease should have been released")
+	}
+
+	_, won, err = b.Acquire(ctx, "lease/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !won {
+		t.Error("Lease should be available after release")
+	}
+}
+
+func TestLeaseSameOwnerDistinctTokens(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	cache := storage.NewMockRemoteCache()
+	a := newFetchLease(cache, "same-hostname", time.Minute, time.Second)
+	b := newFetchLease(cache, "same-hostname", time.Minute, time.Second)
+
+	_, won, err := a.Acquire(ctx, "lease/test")
+	if err != nil || !won {
+		t.Fatalf("First acquirer should have won: %v %v", won, err)
+	}
+	_, won, err = b.Acquire(ctx, "lease/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if won {
+		t.Error("Replicas sharing an identifier must not both win")
+	}
+}
+
+func TestLeaseReplicasShareOneFetch(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 4242)
+	rspBytes := ti.response(t, 4242, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, true)
+	cache := storage.NewMockRemoteCache()
+
+	const replicas = 5
+	stores := make([]*OcspStore, replicas)
+	for i := range stores {
+		stores[i] = newTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+		stores[i].EnableFetchLease(fmt.Sprintf("replica-%d", i), 10*time.Second, 5*time.Second)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, replicas)
+	for _, store := range stores {
+		wg.Add(1)
+		go func(store *OcspStore) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			data, _, err := store.Get(ctx, req, reqBytes)
+			if err == nil && !bytes.Equal(data, rspBytes) {
+				err = fmt.Errorf("unexpected response body")
+			}
+			errs <- err
+		}(store)
+	}
+
+	for tu.Hits() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(tu.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if tu.Hits() != 1 {
+		t.Errorf("Expected one upstream fetch across all replicas, got %d", tu.Hits())
+	}
+	serial, err := storage.NewSerialFromBigInt(req.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := cache.Exists(context.Background(), leaseKey(storage.NewIssuerFromRequest(req), serial)); held {
+		t.Error("Lease should have been released after the fetch")
+	}
+}
+
+func TestLeaseWaiterFallsBackWhenHolderStalls(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 4343)
+	rspBytes := ti.response(t, 4343, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	cache := storage.NewMockRemoteCache()
+	issuer := storage.NewIssuerFromRequest(req)
+
+	// A replica that took the lease and then died without releasing it
+	serial, err := storage.NewSerialFromBigInt(req.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.SetIfNotExist(context.Background(), leaseKey(issuer, serial), "dead-replica/00", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestStore(t, cache, issuer, tu)
+	store.EnableFetchLease("survivor", time.Minute, 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	data, _, err := store.Get(ctx, req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, rspBytes) {
+		t.Error("Unexpected response body")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("Expected to wait on the lease first, only took %v", time.Since(start))
+	}
+	if tu.Hits() != 1 {
+		t.Errorf("Expected the survivor to fetch upstream itself, got %d fetches", tu.Hits())
+	}
+}
+
+func TestLeaseWaiterStopsWhenHolderGivesUp(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	cache := storage.NewMockRemoteCache()
+	holder := newFetchLease(cache, "holder", time.Minute, time.Minute)
+	waiter := newFetchLease(cache, "waiter", time.Minute, time.Minute)
+
+	token, won, err := holder.Acquire(ctx, "lease/test")
+	if err != nil || !won {
+		t.Fatalf("Holder should have won: %v %v", won, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = holder.Release(ctx, "lease/test", token)
+	}()
+
+	start := time.Now()
+	_, found, err := waiter.WaitFor(ctx, "lease/test", "entry", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("Entry was never written")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Waiter should have stopped once the lease was released, took %v", time.Since(start))
+	}
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of looking up a response in the cache.
+const (
+	cacheResultHit   = "hit"
+	cacheResultMiss  = "miss"
+	cacheResultStale = "stale"
+)
+
+// Classes of upstream responses the store rejects, counted along with the
+// fetcher's own error classes.
+const (
+	errorClassInvalid    = "invalid"
+	errorClassNotCurrent = "not_current"
+	errorClassHeaders    = "headers"
+)
+
+// Results of refreshing entries before they go stale.
+const (
+	refreshResultRefreshed = "refreshed"
+	refreshResultSkipped   = "skipped"
+	refreshResultFailed    = "failed"
+)
+
+var cacheResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ocsp_l2_cache_cache_results_total",
+	Help: "Requests for known issuers, by whether the cache had a fresh, stale or no response.",
+}, []string{"issuer", "result"})
+
+var refreshResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "ocsp_l2_cache_refresh_results_total",
+	Help: "Recently requested entries the refresh scheduler refetched, skipped or failed to refetch.",
+}, []string{"result"})
+
+var refreshLeader = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "ocsp_l2_cache_refresh_leader",
+	Help: "Whether this replica holds the refresh leadership.",
+})
+
+var requestPopularity = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ocsp_l2_cache_request_popularity",
+	Help:    "How often the serial of each request was requested recently, as estimated by this replica.",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+})
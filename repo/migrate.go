@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"crypto"
+	"encoding/hex"
+	"strings"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+type MigrationStats struct {
+	// Scanned counts the keys considered, excluding current-schema keys.
+	Scanned int
+	// Migrated counts legacy entries rewritten under their new key, or that
+	// would have been in a dry run.
+	Migrated int
+	// Skipped counts keys that aren't legacy entries, or whose issuer can't be
+	// determined. These are left alone to expire.
+	Skipped int
+	// Failed counts legacy entries that couldn't be migrated due to cache
+	// errors.
+	Failed int
+}
+
+// MigrateLegacyKeys rewrites responses cached under the serial-only legacy
+// keys to their versioned issuer and serial keys, keeping their remaining
+// lifetime, then deletes the legacy keys. The issuer is read from the
+// response's CertID, which must use a SHA-1 key hash to match the key IDs of
+// the configured issuers. Entries already present under the new key are not
+// overwritten. With dryRun set, nothing is written.
+func MigrateLegacyKeys(ctx context.Context, logger blog.Logger, cache storage.RemoteCache, dryRun bool) (MigrationStats, error) {
+	var stats MigrationStats
+
+	keys := make(chan string)
+	scanErr := make(chan error, 1)
+	go func() {
+		scanErr <- cache.KeysToChan(ctx, "*", keys)
+	}()
+
+	for key := range keys {
+		if strings.HasPrefix(key, storage.ResponseKeyPrefix) {
+			continue
+		}
+		stats.Scanned++
+		if strings.HasPrefix(key, leaseKeyPrefix) {
+			stats.Skipped++
+			continue
+		}
+
+		newKey, ok := legacyEntryNewKey(ctx, logger, cache, key)
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+
+		if dryRun {
+			logger.Infof("Would migrate legacy key %s to %s", hex.EncodeToString([]byte(key)), newKey)
+			stats.Migrated++
+			continue
+		}
+
+		err := migrateLegacyEntry(ctx, cache, key, newKey)
+		if err != nil {
+			logger.Warningf("Failed migrating legacy key %s to %s: %v", hex.EncodeToString([]byte(key)), newKey, err)
+			stats.Failed++
+			continue
+		}
+		logger.Debugf("Migrated legacy key %s to %s", hex.EncodeToString([]byte(key)), newKey)
+		stats.Migrated++
+	}
+
+	return stats, <-scanErr
+}
+
+// legacyEntryNewKey returns the versioned key for the response stored under a
+// legacy key, if it is a legacy entry for an identifiable issuer.
+func legacyEntryNewKey(ctx context.Context, logger blog.Logger, cache storage.RemoteCache, key string) (string, bool) {
+	serial, err := storage.NewSerialFromBinaryString(key)
+	if err != nil {
+		return "", false
+	}
+	value, found, err := cache.Get(ctx, key)
+	if err != nil || !found {
+		return "", false
+	}
+	cr, err := NewCompressedResponseFromBinaryString(value, serial)
+	if err != nil {
+		logger.Debugf("Skipping key %s, not a cached response: %v", hex.EncodeToString([]byte(key)), err)
+		return "", false
+	}
+	id, err := responseCertID(cr.RawResp, serial.AsBigInt())
+	if err != nil {
+		logger.Infof("Skipping legacy key %s: %v", serial.String(), err)
+		return "", false
+	}
+	hash, err := id.Hash()
+	if err != nil || hash != crypto.SHA1 {
+		logger.Infof("Skipping legacy key %s, its CertID doesn't use a SHA-1 key hash", serial.String())
+		return "", false
+	}
+	issuer, err := storage.NewIssuerFromHexKeyId(hex.EncodeToString(id.IssuerKeyHash))
+	if err != nil {
+		logger.Infof("Skipping legacy key %s: %v", serial.String(), err)
+		return "", false
+	}
+	return storage.ResponseKey(*issuer, serial), true
+}
+
+func migrateLegacyEntry(ctx context.Context, cache storage.RemoteCache, key string, newKey string) error {
+	value, found, err := cache.Get(ctx, key)
+	if err != nil || !found {
+		return err
+	}
+	ttl, found, err := cache.TTL(ctx, key)
+	if err != nil || !found {
+		return err
+	}
+	_, err = cache.SetIfNotExist(ctx, newKey, value, ttl)
+	if err != nil {
+		return err
+	}
+	return cache.Delete(ctx, key)
+}
@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tiA := newTestIssuer(t)
+	tiB := newTestIssuer(t)
+	reqA, _ := tiA.request(t, 100)
+	reqB, _ := tiB.request(t, 200)
+	issuerA := storage.NewIssuerFromRequest(reqA)
+	issuerB := storage.NewIssuerFromRequest(reqB)
+
+	cache := storage.NewMockRemoteCache()
+	storeLegacyEntry(t, cache, 100, tiA.response(t, 100, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), 2*time.Hour)
+	storeLegacyEntry(t, cache, 200, tiB.response(t, 200, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), 3*time.Hour)
+	if err := cache.Set(ctx, "lease/somewhere", "someone", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set(ctx, "junk", "not a response", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	serialA, _ := storage.NewSerialFromBigInt(big.NewInt(100))
+	serialB, _ := storage.NewSerialFromBigInt(big.NewInt(200))
+	legacyValueA, _, _ := cache.Get(ctx, storage.LegacyResponseKey(serialA))
+
+	stats, err := MigrateLegacyKeys(ctx, blog.NewMock(), cache, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MigrationStats{Scanned: 4, Migrated: 2, Skipped: 2}
+	if stats != expected {
+		t.Errorf("Dry run: expected %+v, got %+v", expected, stats)
+	}
+	if len(cache.Data) != 4 {
+		t.Errorf("A dry run must not change the cache: %d entries", len(cache.Data))
+	}
+
+	stats, err = MigrateLegacyKeys(ctx, blog.NewMock(), cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+
+	for _, legacy := range []storage.Serial{serialA, serialB} {
+		if _, found, _ := cache.Get(ctx, storage.LegacyResponseKey(legacy)); found {
+			t.Errorf("Legacy key for %s should be gone", legacy)
+		}
+	}
+	value, found, _ := cache.Get(ctx, storage.ResponseKey(issuerA, serialA))
+	if !found || value != legacyValueA {
+		t.Error("Expected issuer A's entry under its new key")
+	}
+	ttl, found, _ := cache.TTL(ctx, storage.ResponseKey(issuerB, serialB))
+	if !found || ttl < 2*time.Hour+59*time.Minute || ttl > 3*time.Hour {
+		t.Errorf("Expected issuer B's entry to keep its remaining life, got %v", ttl)
+	}
+
+	// Migrating again finds nothing left to do
+	stats, err = MigrateLegacyKeys(ctx, blog.NewMock(), cache, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = MigrationStats{Scanned: 2, Skipped: 2}
+	if stats != expected {
+		t.Errorf("Second run: expected %+v, got %+v", expected, stats)
+	}
+}
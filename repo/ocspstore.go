@@ -6,7 +6,10 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"time"
 
@@ -16,36 +19,160 @@ import (
 	"golang.org/x/crypto/ocsp"
 )
 
+// DefaultMaxClockSkew is how far apart our clock and an upstream responder's
+// may be before its responses are considered not yet valid, or expired.
+const DefaultMaxClockSkew = 5 * time.Minute
+
 type OcspStore struct {
-	logger           blog.Logger
-	responders       map[string]fetcher.UpstreamFetcher
-	cache            storage.RemoteCache
-	lifespan         time.Duration
-	minimumCacheLife time.Duration
+	logger                 blog.Logger
+	responders             map[string]*fetcher.UpstreamGroup
+	issuerCerts            map[string]*x509.Certificate
+	cache                  storage.RemoteCache
+	ttlPolicy              TTLPolicy
+	maxClockSkew           time.Duration
+	fetches                *fetchGroup
+	lease                  *fetchLease
+	staleLifespan          time.Duration
+	revalidateInBackground bool
+	legacyKeyFallback      bool
+	encoding               Encoding
+	headerPolicies         map[string]HeaderPolicy
+	access                 *accessLog
+	popularity             *popularity
 }
 
-func NewOcspStore(logger blog.Logger, cache storage.RemoteCache, lifespan time.Duration, minimumCacheLife time.Duration) OcspStore {
-	return OcspStore{
+func NewOcspStore(logger blog.Logger, cache storage.RemoteCache, ttlPolicy TTLPolicy) *OcspStore {
+	return &OcspStore{
 		logger,
-		make(map[string]fetcher.UpstreamFetcher),
+		make(map[string]*fetcher.UpstreamGroup),
+		make(map[string]*x509.Certificate),
 		cache,
-		lifespan,
-		minimumCacheLife,
+		ttlPolicy,
+		DefaultMaxClockSkew,
+		newFetchGroup(),
+		nil,
+		0,
+		false,
+		false,
+		DefaultEncoding,
+		make(map[string]HeaderPolicy),
+		nil,
+		newPopularity(),
 	}
 }
 
+// SetMaxClockSkew sets how much clock skew with the upstream responders to
+// tolerate when checking that their responses are currently valid.
+func (c *OcspStore) SetMaxClockSkew(maxSkew time.Duration) {
+	c.maxClockSkew = maxSkew
+}
+
+// EnableStaleServing keeps entries in the cache for up to staleLifespan past
+// the end of their fresh life, though never past their NextUpdate. A stale
+// entry is served in place of an upstream error when a refresh fails. If
+// revalidateInBackground is set, stale entries are served immediately and
+// refreshed asynchronously instead.
+func (c *OcspStore) EnableStaleServing(staleLifespan time.Duration, revalidateInBackground bool) {
+	c.staleLifespan = staleLifespan
+	c.revalidateInBackground = revalidateInBackground
+}
+
+// EnableFetchLease makes replicas sharing this store's cache coordinate their
+// upstream fetches: on a miss, only the replica holding the fetch lease for a
+// serial queries upstream, while the others wait up to maxWait for its result
+// to appear in the cache before fetching it themselves.
+func (c *OcspStore) EnableFetchLease(owner string, leaseLife time.Duration, maxWait time.Duration) {
+	c.lease = newFetchLease(c.cache, owner, leaseLife, maxWait)
+}
+
+// EnableLegacyKeyFallback makes the store look for responses under the
+// serial-only keys used before keys included the issuer, when they aren't
+// found under their current key. Entries found there are only used if they
+// are for the requested issuer.
+func (c *OcspStore) EnableLegacyKeyFallback() {
+	c.legacyKeyFallback = true
+}
+
+// EnableAccessTracking records which serials were requested within the last
+// window, across replicas sharing the cache, so that they can be refreshed
+// before they expire.
+func (c *OcspStore) EnableAccessTracking(window time.Duration) {
+	c.access = newAccessLog(c.cache, window)
+}
+
+// SetEncoding sets how responses are encoded for the cache. Entries in any
+// encoding can be read regardless.
+func (c *OcspStore) SetEncoding(encoding Encoding) {
+	c.encoding = encoding
+}
+
+// AddFetcherForIssuer makes uf the issuer's only upstream responder.
 func (c *OcspStore) AddFetcherForIssuer(issuer storage.Issuer, uf *fetcher.UpstreamFetcher) error {
-	if uf == nil {
-		return fmt.Errorf("Fetcher must not be nil")
+	group := fetcher.NewUpstreamGroup(fetcher.OrderPriority, fetcher.DefaultHealthOptions)
+	err := group.Add(uf, 1)
+	if err != nil {
+		return err
+	}
+	return c.AddGroupForIssuer(issuer, group)
+}
+
+// AddGroupForIssuer fetches the issuer's responses from the group's upstream
+// responders, failing over from one to the next.
+func (c *OcspStore) AddGroupForIssuer(issuer storage.Issuer, group *fetcher.UpstreamGroup) error {
+	if group == nil || len(group.Endpoints(time.Now())) == 0 {
+		return fmt.Errorf("Upstream group must have an endpoint")
+	}
+
+	c.responders[issuer.String()] = group
+	return nil
+}
+
+// UpstreamStatus describes each issuer's upstream responders, by issuer.
+func (c *OcspStore) UpstreamStatus() map[string][]fetcher.EndpointStatus {
+	now := time.Now()
+	result := make(map[string][]fetcher.EndpointStatus, len(c.responders))
+	for issuer, group := range c.responders {
+		result[issuer] = group.Status(now)
+	}
+	return result
+}
+
+// SetHeaderPolicy sets what to do with the HTTP caching headers from the
+// issuer's upstream responder. It is DefaultHeaderPolicy unless set.
+func (c *OcspStore) SetHeaderPolicy(issuer storage.Issuer, policy HeaderPolicy) {
+	c.headerPolicies[issuer.String()] = policy
+}
+
+func (c *OcspStore) headerPolicy(issuer storage.Issuer) HeaderPolicy {
+	policy, ok := c.headerPolicies[issuer.String()]
+	if !ok {
+		return DefaultHeaderPolicy
 	}
+	return policy
+}
 
-	c.responders[issuer.String()] = *uf
+// AddIssuerCertificate makes the store verify responses for the issuer before
+// caching them: they must be signed by the issuer's key or by a responder
+// certificate it delegated OCSP signing to, and must name the issuer.
+func (c *OcspStore) AddIssuerCertificate(issuer storage.Issuer, cert *x509.Certificate) error {
+	if cert == nil {
+		return fmt.Errorf("Certificate must not be nil")
+	}
+	certIssuer, err := storage.NewIssuerFromCertificate(cert)
+	if err != nil {
+		return err
+	}
+	if certIssuer.String() != issuer.String() {
+		return fmt.Errorf("Certificate %s has key ID %s, not %s", cert.Subject, certIssuer.String(), issuer.String())
+	}
+
+	c.issuerCerts[issuer.String()] = cert
 	return nil
 }
 
 func (c *OcspStore) Get(ctx context.Context, req *ocsp.Request, reqBytes []byte) ([]byte, map[string]string, error) {
 	issuer := storage.NewIssuerFromRequest(req)
-	uf, ok := c.responders[issuer.String()]
+	group, ok := c.responders[issuer.String()]
 	if !ok {
 		return nil, nil, UnknownIssuerError
 	}
@@ -55,56 +182,290 @@ func (c *OcspStore) Get(ctx context.Context, req *ocsp.Request, reqBytes []byte)
 		return nil, nil, err
 	}
 
-	cacheRsp, found, err := c.cache.Get(ctx, serial.BinaryString())
+	if c.popularity != nil {
+		requestPopularity.Observe(float64(c.popularity.Record(issuer, serial, time.Now())))
+	}
+	if c.access != nil {
+		err = c.access.Record(ctx, issuer, serial, time.Now())
+		if err != nil {
+			c.logger.Warningf("Failed recording access to issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		}
+	}
+
+	cacheRsp, found, err := c.cache.Get(ctx, storage.ResponseKey(issuer, serial))
 	if err != nil {
 		return nil, nil, err
 	}
-
-	if found {
-		cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
+	if !found && c.legacyKeyFallback {
+		cacheRsp, found, err = c.getLegacy(ctx, req, issuer, serial)
 		if err != nil {
 			return nil, nil, err
 		}
+	}
+
+	if !found {
+		c.logger.Debugf("issuer %s serial %s miss", issuer.String(), serial.String())
+		cacheResults.WithLabelValues(issuer.String(), cacheResultMiss).Inc()
+		return c.fetch(ctx, group, issuer, serial, reqBytes, "")
+	}
 
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if cr.IsFresh(now) {
 		c.logger.Debugf("issuer %s serial %s hit", issuer.String(), serial.String())
-		return cr.RawResp, cr.Headers(), nil
+		cacheResults.WithLabelValues(issuer.String(), cacheResultHit).Inc()
+		return cr.RawResp, cr.Headers(now), nil
 	}
 
-	c.logger.Debugf("issuer %s serial %s miss", issuer.String(), serial.String())
+	cacheResults.WithLabelValues(issuer.String(), cacheResultStale).Inc()
+	if c.revalidateInBackground {
+		c.logger.Debugf("issuer %s serial %s stale, revalidating", issuer.String(), serial.String())
+		if c.fetches.Has(fetchKey(issuer, serial)) {
+			return cr.RawResp, cr.Headers(now), nil
+		}
+		go func() {
+			refreshCtx, cancel := detachedContext(ctx)
+			defer cancel()
+			_, _, err := c.fetch(refreshCtx, group, issuer, serial, reqBytes, cacheRsp)
+			if err != nil {
+				c.logger.Warningf("Background refresh of issuer %s serial %s failed: %v", issuer.String(), serial.String(), err)
+			}
+		}()
+		return cr.RawResp, cr.Headers(now), nil
+	}
 
-	rspBytes, headers, err := uf.Fetch(ctx, reqBytes)
+	c.logger.Debugf("issuer %s serial %s stale, refreshing", issuer.String(), serial.String())
+	// Whether upstream is unreachable or returned something invalid, the stale
+	// entry is still better than nothing
+	rspBytes, headers, err := c.fetch(ctx, group, issuer, serial, reqBytes, cacheRsp)
 	if err != nil {
-		c.logger.Warningf("Fetch error: %v", err)
+		c.logger.Infof("Serving stale response for issuer %s serial %s after refresh error: %v", issuer.String(), serial.String(), err)
+		return cr.RawResp, cr.Headers(time.Now()), nil
+	}
+	return rspBytes, headers, nil
+}
+
+// fetch retrieves a response from upstream and stores it. Concurrent fetches
+// for the same serial share a single upstream request. The previous argument
+// is whatever is currently cached for the serial, if anything, so that a
+// refresh is not satisfied by the very entry it is replacing.
+func (c *OcspStore) fetch(ctx context.Context, group *fetcher.UpstreamGroup, issuer storage.Issuer, serial storage.Serial, reqBytes []byte, previous string) ([]byte, map[string]string, error) {
+	rspBytes, headers, err := c.fetches.Do(ctx, fetchKey(issuer, serial), func(fetchCtx context.Context) ([]byte, map[string]string, error) {
+		return c.fetchAndStore(fetchCtx, group, issuer, serial, reqBytes, previous)
+	})
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		c.logger.Warningf("Gave up waiting on upstream for issuer %s serial %s: %v", issuer.String(), serial.String(), err)
 		return nil, nil, UpstreamError
 	}
+	return rspBytes, headers, err
+}
+
+func fetchKey(issuer storage.Issuer, serial storage.Serial) string {
+	return issuer.String() + "/" + serial.HexString()
+}
+
+// getLegacy looks for a response under the serial's legacy key, ignoring it
+// unless its CertID shows it's for the requested issuer.
+func (c *OcspStore) getLegacy(ctx context.Context, req *ocsp.Request, issuer storage.Issuer, serial storage.Serial) (string, bool, error) {
+	cacheRsp, found, err := c.cache.Get(ctx, storage.LegacyResponseKey(serial))
+	if err != nil || !found {
+		return "", false, err
+	}
 
-	// Don't verify here, use nil as issuer
-	resp, err := ocsp.ParseResponse(rspBytes, nil)
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
 	if err != nil {
-		c.logger.Warningf("Parse of upstream response error: %v", err)
-		return nil, nil, UpstreamError
+		c.logger.Infof("Ignoring undecodable legacy entry for serial %s: %v", serial.String(), err)
+		return "", false, nil
+	}
+	id, err := responseCertID(cr.RawResp, serial.AsBigInt())
+	if err != nil {
+		c.logger.Infof("Ignoring unparseable legacy entry for serial %s: %v", serial.String(), err)
+		return "", false, nil
 	}
 
-	cacheEndTime := resp.ThisUpdate.Add(c.lifespan)
-	remainingLife := time.Until(cacheEndTime)
-	if remainingLife < c.minimumCacheLife {
-		remainingLife = c.minimumCacheLife
+	var sameIssuer bool
+	hash, err := id.Hash()
+	if err == nil && hash == req.HashAlgorithm {
+		sameIssuer = bytes.Equal(id.IssuerKeyHash, req.IssuerKeyHash) && bytes.Equal(id.NameHash, req.IssuerNameHash)
+	} else if issuerCert, ok := c.issuerCerts[issuer.String()]; ok {
+		sameIssuer = checkCertIDIssuer(id, issuerCert) == nil
+	}
+	if !sameIssuer {
+		c.logger.Debugf("issuer %s serial %s legacy entry is for another issuer", issuer.String(), serial.String())
+		return "", false, nil
 	}
 
-	cr, err := NewCompressedResponseFromRawResponseAndHeaders(rspBytes, headers)
+	c.logger.Debugf("issuer %s serial %s found under legacy key", issuer.String(), serial.String())
+	return cacheRsp, true, nil
+}
+
+func decodeCachedResponse(cacheRsp string, serial storage.Serial) ([]byte, map[string]string, error) {
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
 	if err != nil {
 		return nil, nil, err
 	}
+	return cr.RawResp, cr.Headers(time.Now()), nil
+}
+
+func (c *OcspStore) fetchAndStore(ctx context.Context, group *fetcher.UpstreamGroup, issuer storage.Issuer, serial storage.Serial, reqBytes []byte, previous string) ([]byte, map[string]string, error) {
+	// Responders whose circuit breaker is open would only fail
+	now := time.Now()
+	var endpoints []*fetcher.UpstreamFetcher
+	for _, uf := range group.Endpoints(now) {
+		if uf.BreakerState(now) != fetcher.BreakerOpen {
+			endpoints = append(endpoints, uf)
+		}
+	}
+	if len(endpoints) == 0 {
+		c.logger.Debugf("issuer %s serial %s not fetched, every upstream's circuit breaker is open", issuer.String(), serial.String())
+		return nil, nil, UpstreamError
+	}
+
+	if c.lease != nil {
+		key := leaseKey(issuer, serial)
+		token, won, err := c.lease.Acquire(ctx, key)
+		switch {
+		case err != nil:
+			c.logger.Warningf("Couldn't acquire fetch lease for issuer %s serial %s, fetching anyway: %v", issuer.String(), serial.String(), err)
+		case won:
+			defer func() {
+				if err := c.lease.Release(ctx, key, token); err != nil {
+					c.logger.Warningf("Couldn't release fetch lease for issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+				}
+			}()
+		default:
+			cacheRsp, found, err := c.lease.WaitFor(ctx, key, storage.ResponseKey(issuer, serial), previous)
+			if err != nil {
+				c.logger.Warningf("Error waiting on fetch lease for issuer %s serial %s, fetching anyway: %v", issuer.String(), serial.String(), err)
+			} else if found {
+				c.logger.Debugf("issuer %s serial %s filled by another replica", issuer.String(), serial.String())
+				return decodeCachedResponse(cacheRsp, serial)
+			} else {
+				c.logger.Debugf("issuer %s serial %s lease holder too slow, fetching", issuer.String(), serial.String())
+			}
+		}
+	}
+
+	var err error
+	for i, uf := range endpoints {
+		rspBytes, headers, fetchErr := c.fetchFrom(ctx, uf, issuer, serial, reqBytes)
+		switch {
+		case errors.Is(fetchErr, UpstreamError):
+			err = UpstreamError
+		case errors.Is(fetchErr, InvalidResponseError):
+			err = InvalidResponseError
+		default:
+			// Whether or not the cache took it, the response was fine
+			group.Report(uf, nil, time.Now())
+			return rspBytes, headers, fetchErr
+		}
+		if ctx.Err() != nil {
+			if ctx.Err() != context.Canceled {
+				group.Report(uf, fetchErr, time.Now())
+			}
+			return nil, nil, err
+		}
+		group.Report(uf, fetchErr, time.Now())
+		if i+1 < len(endpoints) {
+			c.logger.Infof("Failing over from %s for issuer %s serial %s: %v", uf.Responder(), issuer.String(), serial.String(), fetchErr)
+		}
+	}
+	return nil, nil, err
+}
 
-	encoded, err := cr.BinaryString()
+// fetchFrom fetches the serial's response from one upstream responder, and
+// stores it if it passes the checks. Errors from the responder wrap
+// UpstreamError or InvalidResponseError.
+func (c *OcspStore) fetchFrom(ctx context.Context, uf *fetcher.UpstreamFetcher, issuer storage.Issuer, serial storage.Serial, reqBytes []byte) ([]byte, map[string]string, error) {
+	rspBytes, headers, err := uf.Fetch(ctx, reqBytes)
 	if err != nil {
-		return nil, nil, err
+		c.logger.Warningf("Fetch error from %s: %v", uf.Responder(), err)
+		return nil, nil, wrapError(UpstreamError, err)
+	}
+
+	resp, err := c.parseUpstreamResponse(rspBytes, issuer, serial)
+	if err != nil {
+		uf.CountError(errorClassInvalid)
+		c.logger.Warningf("Rejected upstream response for issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		return nil, nil, wrapError(InvalidResponseError, err)
+	}
+
+	now := time.Now()
+	err = checkFreshness(resp, now, c.maxClockSkew)
+	if err != nil {
+		uf.CountError(errorClassNotCurrent)
+		c.logger.Warningf("Rejected upstream response for issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		return nil, nil, wrapError(InvalidResponseError, err)
+	}
+
+	upstreamHeaders, err := c.headerPolicy(issuer).upstreamHeaders(headers)
+	if err != nil {
+		uf.CountError(errorClassHeaders)
+		c.logger.Warningf("Rejected upstream response for issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		return nil, nil, wrapError(InvalidResponseError, err)
 	}
 
-	err = c.cache.Set(ctx, serial.BinaryString(), encoded, remainingLife)
+	servedHeaders, err := c.store(ctx, issuer, serial, resp, rspBytes, upstreamHeaders, now)
 	if err != nil {
 		return nil, nil, err
 	}
+	return rspBytes, servedHeaders, nil
+}
 
-	return rspBytes, headers, nil
+// store caches a parsed and checked response for the serial, fetched at now,
+// and returns the headers to serve it with.
+func (c *OcspStore) store(ctx context.Context, issuer storage.Issuer, serial storage.Serial, resp *ocsp.Response, rspBytes []byte, upstreamHeaders map[string]string, now time.Time) (map[string]string, error) {
+	cr, err := NewCompressedResponse(rspBytes, serial)
+	if err != nil {
+		return nil, err
+	}
+	cr.FetchedAt = now
+	cr.UpstreamHeaders = upstreamHeaders
+
+	remainingLife := c.ttlPolicy.FreshLife(resp, now)
+	if remainingLife <= 0 {
+		// Within the skew tolerance, but not worth caching
+		c.logger.Infof("Not caching issuer %s serial %s, at its NextUpdate of %s", issuer.String(), serial.String(), resp.NextUpdate)
+		return cr.Headers(now), nil
+	}
+
+	// Past its fresh life, the entry is kept around as stale for a while
+	// longer, but never beyond the response's own validity.
+	cr.FreshUntil = now.Add(remainingLife)
+	if c.staleLifespan > 0 {
+		keepUntil := cr.FreshUntil.Add(c.staleLifespan)
+		if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(keepUntil) {
+			keepUntil = resp.NextUpdate
+		}
+		if keepUntil.After(cr.FreshUntil) {
+			remainingLife = keepUntil.Sub(now)
+		}
+	}
+
+	encoded, err := cr.Encode(c.encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.cache.Set(ctx, storage.ResponseKey(issuer, serial), encoded, remainingLife)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr.Headers(now), nil
+}
+
+// parseUpstreamResponse parses a response for the serial, verifying it if the
+// issuer's certificate is known.
+func (c *OcspStore) parseUpstreamResponse(rspBytes []byte, issuer storage.Issuer, serial storage.Serial) (*ocsp.Response, error) {
+	issuerCert, ok := c.issuerCerts[issuer.String()]
+	if ok {
+		return verifyResponse(rspBytes, serial.AsBigInt(), issuerCert, time.Now())
+	}
+	// Without the issuer there's no verifying, but at least get the right serial
+	return ocsp.ParseResponseForCert(rspBytes, &x509.Certificate{SerialNumber: serial.AsBigInt()}, nil)
 }
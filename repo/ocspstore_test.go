@@ -0,0 +1,816 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	blog "github.com/letsencrypt/boulder/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestIssuer(t *testing.T) testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIssuer{cert, key}
+}
+
+func (ti testIssuer) request(t *testing.T, serial int64) (*ocsp.Request, []byte) {
+	reqBytes, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: big.NewInt(serial)}, ti.cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := ocsp.ParseRequest(reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, reqBytes
+}
+
+func (ti testIssuer) response(t *testing.T, serial int64, thisUpdate time.Time, nextUpdate time.Time) []byte {
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(serial),
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+	}
+	rspBytes, err := ocsp.CreateResponse(ti.cert, ti.cert, template, ti.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rspBytes
+}
+
+// testUpstream is an OCSP responder that answers every request with the same
+// response, optionally holding each request until released.
+type testUpstream struct {
+	server   *httptest.Server
+	hits     int32
+	failing  int32
+	blocking int32
+	bare     int32
+	release  chan struct{}
+	rspBytes []byte
+}
+
+func newTestUpstream(t *testing.T, rspBytes []byte, blocking bool) *testUpstream {
+	tu := &testUpstream{rspBytes: rspBytes, release: make(chan struct{})}
+	tu.SetBlocking(blocking)
+	tu.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tu.hits, 1)
+		if atomic.LoadInt32(&tu.blocking) != 0 {
+			<-tu.release
+		}
+		if atomic.LoadInt32(&tu.failing) != 0 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+		if atomic.LoadInt32(&tu.bare) == 0 {
+			w.Header().Set(common.HeaderCacheControl, "max-age=3600")
+			w.Header().Set(common.HeaderETag, "\"etag\"")
+			w.Header().Set(common.HeaderLastModified, "Mon, 01 Jan 2020 00:00:00 GMT")
+			w.Header().Set(common.HeaderExpires, "Mon, 01 Jan 2020 00:00:00 GMT")
+		}
+		_, _ = w.Write(tu.rspBytes)
+	}))
+	t.Cleanup(tu.server.Close)
+	return tu
+}
+
+func (tu *testUpstream) Hits() int {
+	return int(atomic.LoadInt32(&tu.hits))
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SetBlocking makes subsequent requests wait until release is closed
+func (tu *testUpstream) SetBlocking(blocking bool) {
+	atomic.StoreInt32(&tu.blocking, boolToInt32(blocking))
+}
+
+func (tu *testUpstream) SetFailing(failing bool) {
+	atomic.StoreInt32(&tu.failing, boolToInt32(failing))
+}
+
+// SetBare omits the HTTP caching headers, like minimal responders do
+func (tu *testUpstream) SetBare(bare bool) {
+	atomic.StoreInt32(&tu.bare, boolToInt32(bare))
+}
+
+func (tu *testUpstream) fetcher(t *testing.T) *fetcher.UpstreamFetcher {
+	u, err := url.Parse(tu.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf, err := fetcher.NewUpstreamFetcher(*u, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uf
+}
+
+func newTestStore(t *testing.T, cache storage.RemoteCache, issuer storage.Issuer, tu *testUpstream) *OcspStore {
+	store := NewOcspStore(blog.NewMock(), cache, NewTTLPolicy(TTLRule{Fraction: DefaultTTLFraction, MaxLife: 24 * time.Hour, MinLife: time.Hour}))
+	err := store.AddFetcherForIssuer(issuer, tu.fetcher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestGetMissThenHit(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1234)
+	rspBytes := ti.response(t, 1234, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+
+	for i := 0; i < 3; i++ {
+		data, headers, err := store.Get(context.Background(), req, reqBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, rspBytes) {
+			t.Errorf("Unexpected response body on attempt %d", i)
+		}
+		if headers[common.HeaderETag] != etagOf(rspBytes) {
+			t.Errorf("Unexpected headers on attempt %d: %+v", i, headers)
+		}
+	}
+
+	if tu.Hits() != 1 {
+		t.Errorf("Expected only one upstream fetch, got %d", tu.Hits())
+	}
+
+	issuer := storage.NewIssuerFromRequest(req).String()
+	if count := testutil.ToFloat64(cacheResults.WithLabelValues(issuer, cacheResultMiss)); count != 1 {
+		t.Errorf("Expected one miss to be counted, got %f", count)
+	}
+	if count := testutil.ToFloat64(cacheResults.WithLabelValues(issuer, cacheResultHit)); count != 2 {
+		t.Errorf("Expected two hits to be counted, got %f", count)
+	}
+}
+
+func TestGetWithoutUpstreamHeaders(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1235)
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	rspBytes := ti.response(t, 1235, thisUpdate, time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	tu.SetBare(true)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+
+	for i := 0; i < 2; i++ {
+		data, headers, err := store.Get(context.Background(), req, reqBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, rspBytes) {
+			t.Errorf("Unexpected response body on attempt %d", i)
+		}
+		if headers[common.HeaderLastModified] != thisUpdate.UTC().Format(http.TimeFormat) {
+			t.Errorf("Expected Last-Modified from ThisUpdate on attempt %d, got %+v", i, headers)
+		}
+	}
+	if tu.Hits() != 1 {
+		t.Errorf("Expected the response to be cached, got %d fetches", tu.Hits())
+	}
+}
+
+func TestGetHeaderPolicies(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1236)
+	rspBytes := ti.response(t, 1236, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+
+	tests := []struct {
+		policy       HeaderPolicy
+		bare         bool
+		expectedETag string
+		expectedErr  error
+	}{
+		{HeaderPolicySynthesize, false, etagOf(rspBytes), nil},
+		{HeaderPolicySynthesize, true, etagOf(rspBytes), nil},
+		{HeaderPolicyPassthrough, false, "\"etag\"", nil},
+		{HeaderPolicyPassthrough, true, etagOf(rspBytes), nil},
+		{HeaderPolicyRequire, false, "\"etag\"", nil},
+		{HeaderPolicyRequire, true, "", InvalidResponseError},
+	}
+	for _, tt := range tests {
+		tu := newTestUpstream(t, rspBytes, false)
+		tu.SetBare(tt.bare)
+		store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+		store.SetHeaderPolicy(storage.NewIssuerFromRequest(req), tt.policy)
+
+		// From upstream, then from the cache
+		for i := 0; i < 2; i++ {
+			_, headers, err := store.Get(context.Background(), req, reqBytes)
+			if err != tt.expectedErr {
+				t.Fatalf("%s, bare %v: expected error %v, got %v", tt.policy, tt.bare, tt.expectedErr, err)
+			}
+			if headers[common.HeaderETag] != tt.expectedETag {
+				t.Errorf("%s, bare %v: expected ETag %s, got %+v", tt.policy, tt.bare, tt.expectedETag, headers)
+			}
+		}
+	}
+}
+
+func TestGetUnknownIssuer(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	other := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1234)
+	otherReq, _ := other.request(t, 1234)
+	tu := newTestUpstream(t, ti.response(t, 1234, time.Now(), time.Now().Add(time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(otherReq), tu)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != UnknownIssuerError {
+		t.Errorf("Expected UnknownIssuerError, got %v", err)
+	}
+}
+
+func TestGetCoalescesConcurrentMisses(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 5678)
+	rspBytes := ti.response(t, 5678, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, true)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+
+	const waiters = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			data, _, err := store.Get(ctx, req, reqBytes)
+			if err == nil && !bytes.Equal(data, rspBytes) {
+				err = UpstreamError
+			}
+			errs <- err
+		}()
+	}
+
+	// Wait until the single fetch reaches the upstream before letting it go
+	for tu.Hits() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(tu.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if tu.Hits() != 1 {
+		t.Errorf("Expected one coalesced upstream fetch, got %d", tu.Hits())
+	}
+	if store.fetches.InFlight() != 0 {
+		t.Errorf("Expected no fetches left in flight, got %d", store.fetches.InFlight())
+	}
+}
+
+func TestGetWaiterObeysOwnDeadline(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 9012)
+	rspBytes := ti.response(t, 9012, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, true)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+
+	// The first caller is patient and starts the fetch
+	patient := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _, err := store.Get(ctx, req, reqBytes)
+		patient <- err
+	}()
+	for tu.Hits() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A second caller joins the fetch but has a short deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := store.Get(ctx, req, reqBytes)
+	if err != UpstreamError {
+		t.Errorf("Expected UpstreamError when the deadline passed, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Waiter should have given up at its deadline, took %v", time.Since(start))
+	}
+
+	close(tu.release)
+	if err := <-patient; err != nil {
+		t.Errorf("Patient caller should have succeeded: %v", err)
+	}
+	if tu.Hits() != 1 {
+		t.Errorf("Expected one upstream fetch, got %d", tu.Hits())
+	}
+}
+
+func TestGetFirstCallerCancelDoesNotFailOthers(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 3456)
+	rspBytes := ti.response(t, 3456, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, true)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+
+	// The first caller starts the fetch and then goes away
+	impatientCtx, impatientCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	impatient := make(chan error, 1)
+	go func() {
+		_, _, err := store.Get(impatientCtx, req, reqBytes)
+		impatient <- err
+	}()
+	for tu.Hits() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	patient := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _, err := store.Get(ctx, req, reqBytes)
+		patient <- err
+	}()
+
+	impatientCancel()
+	if err := <-impatient; err != UpstreamError {
+		t.Errorf("Expected the cancelled caller to get UpstreamError, got %v", err)
+	}
+
+	close(tu.release)
+	if err := <-patient; err != nil {
+		t.Errorf("Remaining caller should have succeeded: %v", err)
+	}
+}
+
+// newStaleTestStore returns a store whose entries go stale almost immediately
+func newStaleTestStore(t *testing.T, cache storage.RemoteCache, issuer storage.Issuer, tu *testUpstream) *OcspStore {
+	store := NewOcspStore(blog.NewMock(), cache, NewTTLPolicy(TTLRule{Fraction: 0, MaxLife: time.Millisecond, MinLife: 50 * time.Millisecond}))
+	err := store.AddFetcherForIssuer(issuer, tu.fetcher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestExpiredWithoutStaleServing(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1111)
+	rspBytes := ti.response(t, 1111, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	store := newStaleTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	tu.SetFailing(true)
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != UpstreamError {
+		t.Errorf("Expected UpstreamError once the entry expired, got %v", err)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 2222)
+	rspBytes := ti.response(t, 2222, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	store := newStaleTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+	store.EnableStaleServing(time.Hour, false)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	tu.SetFailing(true)
+
+	data, headers, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatalf("Expected the stale entry instead of an error, got %v", err)
+	}
+	if !bytes.Equal(data, rspBytes) {
+		t.Error("Unexpected response body")
+	}
+	if headers[common.HeaderWarning] == "" || headers[common.HeaderAge] == "" {
+		t.Errorf("Expected the stale entry to be marked, got %+v", headers)
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected a synchronous refresh attempt, got %d fetches", tu.Hits())
+	}
+	issuer := storage.NewIssuerFromRequest(req).String()
+	if count := testutil.ToFloat64(cacheResults.WithLabelValues(issuer, cacheResultStale)); count != 1 {
+		t.Errorf("Expected one stale result to be counted, got %f", count)
+	}
+}
+
+func TestStaleWhileBreakerOpen(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 2223)
+	otherReq, otherReqBytes := ti.request(t, 2224)
+	rspBytes := ti.response(t, 2223, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	store := NewOcspStore(blog.NewMock(), storage.NewMockRemoteCache(), NewTTLPolicy(TTLRule{Fraction: 0, MaxLife: time.Millisecond, MinLife: 50 * time.Millisecond}))
+	uf := tu.fetcher(t)
+	uf.SetBreakerOptions(fetcher.BreakerOptions{ErrorRate: 0.5, MinRequests: 2, Window: time.Hour, OpenFor: time.Hour, Trials: 1}, blog.NewMock())
+	err := store.AddFetcherForIssuer(storage.NewIssuerFromRequest(req), uf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.EnableStaleServing(time.Hour, false)
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	tu.SetFailing(true)
+
+	// The failed refresh opens the breaker
+	for i := 0; i < 2; i++ {
+		data, _, err := store.Get(context.Background(), req, reqBytes)
+		if err != nil || !bytes.Equal(data, rspBytes) {
+			t.Fatalf("Expected the stale entry, got %v", err)
+		}
+	}
+	if uf.BreakerState(time.Now()) != fetcher.BreakerOpen {
+		t.Errorf("Expected the breaker open, got %s", uf.BreakerState(time.Now()))
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected no fetch while the breaker is open, got %d fetches", tu.Hits())
+	}
+
+	_, _, err = store.Get(context.Background(), otherReq, otherReqBytes)
+	if err != UpstreamError {
+		t.Errorf("Expected UpstreamError for a miss while the breaker is open, got %v", err)
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected the miss to fail fast, got %d fetches", tu.Hits())
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 3333)
+	rspBytes := ti.response(t, 3333, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	store := newStaleTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+	store.EnableStaleServing(time.Hour, true)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	tu.SetBlocking(true)
+
+	data, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, rspBytes) {
+		t.Error("Unexpected response body")
+	}
+
+	// The stale entry was served while the refresh is still held upstream
+	for tu.Hits() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(tu.release)
+	for store.fetches.InFlight() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected the refreshed entry to be fresh, got %d fetches", tu.Hits())
+	}
+}
+
+func TestStaleLifespanCappedAtNextUpdate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 4444)
+	nextUpdate := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	rspBytes := ti.response(t, 4444, time.Now().Add(-time.Hour), nextUpdate)
+	tu := newTestUpstream(t, rspBytes, false)
+	cache := storage.NewMockRemoteCache()
+	store := newStaleTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+	store.EnableStaleServing(72*time.Hour, false)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := storage.NewSerialFromBigInt(req.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := cache.Expirations[storage.ResponseKey(storage.NewIssuerFromRequest(req), serial)]
+	if expiry.After(nextUpdate.Add(time.Second)) {
+		t.Errorf("Entry kept until %v, past NextUpdate %v", expiry, nextUpdate)
+	}
+	if expiry.Before(nextUpdate.Add(-time.Minute)) {
+		t.Errorf("Entry should have been kept as stale until NextUpdate %v, expires %v", nextUpdate, expiry)
+	}
+}
+
+func TestGetTTLFromValidityWindow(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 5555)
+	rspBytes := ti.response(t, 5555, time.Now().Add(-time.Hour), time.Now().Add(3*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := storage.NewSerialFromBigInt(req.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Half of the four hour window has passed at the one hour mark
+	life := time.Until(cache.Expirations[storage.ResponseKey(storage.NewIssuerFromRequest(req), serial)])
+	if life < 59*time.Minute || life > time.Hour {
+		t.Errorf("Expected about an hour of cache life, got %v", life)
+	}
+}
+
+func TestGetIssuersDoNotCollide(t *testing.T) {
+	t.Parallel()
+	tiA := newTestIssuer(t)
+	tiB := newTestIssuer(t)
+	reqA, reqBytesA := tiA.request(t, 6666)
+	reqB, reqBytesB := tiB.request(t, 6666)
+	rspBytesA := tiA.response(t, 6666, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	rspBytesB := tiB.response(t, 6666, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tuA := newTestUpstream(t, rspBytesA, false)
+	tuB := newTestUpstream(t, rspBytesB, false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(reqA), tuA)
+	err := store.AddFetcherForIssuer(storage.NewIssuerFromRequest(reqB), tuB.fetcher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		data, _, err := store.Get(context.Background(), reqA, reqBytesA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, rspBytesA) {
+			t.Errorf("Expected issuer A's response on attempt %d", i)
+		}
+		data, _, err = store.Get(context.Background(), reqB, reqBytesB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, rspBytesB) {
+			t.Errorf("Expected issuer B's response on attempt %d", i)
+		}
+	}
+
+	if tuA.Hits() != 1 || tuB.Hits() != 1 {
+		t.Errorf("Expected one fetch from each upstream, got %d and %d", tuA.Hits(), tuB.Hits())
+	}
+}
+
+func TestGetFailsOver(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 6667)
+	issuer := storage.NewIssuerFromRequest(req)
+	rspBytes := ti.response(t, 6667, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tuDown := newTestUpstream(t, rspBytes, false)
+	tuDown.SetFailing(true)
+	tuWrong := newTestUpstream(t, ti.response(t, 6668, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	tuGood := newTestUpstream(t, rspBytes, false)
+
+	store := NewOcspStore(blog.NewMock(), storage.NewMockRemoteCache(), NewTTLPolicy(TTLRule{Fraction: DefaultTTLFraction, MaxLife: 24 * time.Hour, MinLife: time.Hour}))
+	err := store.AddGroupForIssuer(issuer, fetcher.NewUpstreamGroup(fetcher.OrderPriority, fetcher.DefaultHealthOptions))
+	if err == nil {
+		t.Error("Expected an error for a group without endpoints")
+	}
+	group := fetcher.NewUpstreamGroup(fetcher.OrderPriority, fetcher.HealthOptions{Failures: 1, Cooldown: time.Hour})
+	for _, tu := range []*testUpstream{tuDown, tuWrong, tuGood} {
+		err = group.Add(tu.fetcher(t), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.AddGroupForIssuer(issuer, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, rspBytes) {
+		t.Error("Expected the response from the working upstream")
+	}
+	if tuDown.Hits() != 1 || tuWrong.Hits() != 1 || tuGood.Hits() != 1 {
+		t.Errorf("Expected one fetch from each upstream, got %d, %d and %d", tuDown.Hits(), tuWrong.Hits(), tuGood.Hits())
+	}
+
+	status := store.UpstreamStatus()[issuer.String()]
+	if len(status) != 3 {
+		t.Fatalf("Expected 3 endpoints, got %+v", status)
+	}
+	if status[0].Healthy || !strings.Contains(status[0].LastError, "503") {
+		t.Errorf("Expected the failing upstream ejected, got %+v", status[0])
+	}
+	if status[1].Healthy || !strings.Contains(status[1].LastError, InvalidResponseError.Error()) {
+		t.Errorf("Expected the upstream with the wrong response ejected, got %+v", status[1])
+	}
+	if !status[2].Healthy || status[2].LastSuccess == nil {
+		t.Errorf("Expected the working upstream healthy, got %+v", status[2])
+	}
+
+	_, err = store.Refresh(context.Background(), issuer, testSerial(6667))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tuDown.Hits() != 1 || tuGood.Hits() != 2 {
+		t.Errorf("Expected the ejected upstreams to be tried last, got %d and %d fetches", tuDown.Hits(), tuGood.Hits())
+	}
+
+	tuGood.SetFailing(true)
+	_, err = store.Refresh(context.Background(), issuer, testSerial(6667))
+	// The error is the last tried upstream's
+	if err != InvalidResponseError {
+		t.Errorf("Expected InvalidResponseError once every upstream fails, got %v", err)
+	}
+	if tuDown.Hits() != 2 || tuWrong.Hits() != 2 {
+		t.Errorf("Expected the ejected upstreams as a last resort, got %d and %d fetches", tuDown.Hits(), tuWrong.Hits())
+	}
+}
+
+// storeLegacyEntry caches a response under a serial's legacy key, in the
+// encoding of the versions that used those keys.
+func storeLegacyEntry(t *testing.T, cache storage.RemoteCache, serial int64, rspBytes []byte, life time.Duration) {
+	s, err := storage.NewSerialFromBigInt(big.NewInt(serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewCompressedResponse(rspBytes, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := cr.Encode(EncodingGob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Set(context.Background(), storage.LegacyResponseKey(s), encoded, life)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetLegacyKeyFallback(t *testing.T) {
+	t.Parallel()
+	tiA := newTestIssuer(t)
+	tiB := newTestIssuer(t)
+	reqA, reqBytesA := tiA.request(t, 7777)
+	reqB, reqBytesB := tiB.request(t, 7777)
+	legacyBytes := tiA.response(t, 7777, time.Now().Add(-2*time.Hour), time.Now().Add(72*time.Hour))
+	rspBytesA := tiA.response(t, 7777, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	rspBytesB := tiB.response(t, 7777, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tuA := newTestUpstream(t, rspBytesA, false)
+	tuB := newTestUpstream(t, rspBytesB, false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, storage.NewIssuerFromRequest(reqA), tuA)
+	err := store.AddFetcherForIssuer(storage.NewIssuerFromRequest(reqB), tuB.fetcher(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeLegacyEntry(t, cache, 7777, legacyBytes, time.Hour)
+
+	// Without the fallback, the legacy entry is invisible
+	data, _, err := store.Get(context.Background(), reqA, reqBytesA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, rspBytesA) || tuA.Hits() != 1 {
+		t.Errorf("Expected a fetch from upstream A, with %d hits", tuA.Hits())
+	}
+
+	store.EnableLegacyKeyFallback()
+	serial, err := storage.NewSerialFromBigInt(reqA.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Delete(context.Background(), storage.ResponseKey(storage.NewIssuerFromRequest(reqA), serial))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, headers, err := store.Get(context.Background(), reqA, reqBytesA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, legacyBytes) || headers[common.HeaderETag] != etagOf(legacyBytes) {
+		t.Error("Expected the legacy entry for issuer A")
+	}
+	if tuA.Hits() != 1 {
+		t.Errorf("Expected no further fetches from upstream A, got %d", tuA.Hits())
+	}
+
+	// Issuer B has the same serial, but mustn't be served A's legacy entry
+	data, _, err = store.Get(context.Background(), reqB, reqBytesB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, rspBytesB) {
+		t.Error("Expected issuer B's response")
+	}
+	if tuB.Hits() != 1 {
+		t.Errorf("Expected a fetch from upstream B, got %d", tuB.Hits())
+	}
+}
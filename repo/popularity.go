@@ -0,0 +1,350 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"container/heap"
+	"context"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+const (
+	// The count-min sketch's dimensions: estimates overcount by at most
+	// e/popularityWidth of all requests, with probability 1 - e^-popularityDepth.
+	popularityDepth = 4
+	popularityWidth = 1 << 14
+	// popularityHalfLife is how often all counts are halved, in the
+	// background, so that popularity reflects recent requests.
+	popularityHalfLife = time.Hour
+	// popularityTopSize bounds how many of the most requested serials are
+	// listed along with their last access.
+	popularityTopSize = 1024
+	// warmPriorityBatch is how many targets Warm reads ahead to fetch the most
+	// popular first.
+	warmPriorityBatch = 1024
+)
+
+// Popularity is how often a serial was requested, as estimated by this
+// replica, with recent requests weighing more.
+type Popularity struct {
+	Issuer string `json:"issuer"`
+	Serial string `json:"serial"`
+	Count  uint32 `json:"count"`
+	// LastAccess is only known for the most popular serials
+	LastAccess *time.Time `json:"lastAccess,omitempty"`
+}
+
+type popularEntry struct {
+	issuer     storage.Issuer
+	serial     storage.Serial
+	key        string
+	count      uint32
+	lastAccess time.Time
+	// index is the entry's position in the heap
+	index int
+}
+
+// popularHeap keeps the least requested of the top serials at its root.
+type popularHeap []*popularEntry
+
+func (h popularHeap) Len() int           { return len(h) }
+func (h popularHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h popularHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *popularHeap) Push(x interface{}) {
+	entry := x.(*popularEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *popularHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// popularity counts requests per serial in a count-min sketch, which takes
+// fixed memory however many serials there are, and keeps the last access of
+// the most requested. The sketch is updated atomically, without a lock. The
+// list of the most requested is locked, costing O(log n), only for requests
+// whose count is above floor, so could be listed.
+type popularity struct {
+	seeds  [popularityDepth]maphash.Seed
+	sketch [popularityDepth][]uint32
+	// floor is the least count listed once the list is full, and zero until
+	// then. It is read atomically, and written with mu held.
+	floor uint32
+
+	mu  sync.Mutex
+	top map[string]*popularEntry
+	// byCount orders top by count, least first
+	byCount popularHeap
+}
+
+func newPopularity() *popularity {
+	p := &popularity{
+		top: make(map[string]*popularEntry),
+	}
+	for i := range p.sketch {
+		p.seeds[i] = maphash.MakeSeed()
+		p.sketch[i] = make([]uint32, popularityWidth)
+	}
+	return p
+}
+
+func (p *popularity) index(row int, key string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(p.seeds[row])
+	_, _ = h.WriteString(key)
+	return h.Sum64() % popularityWidth
+}
+
+// increment adds one to a cell of the sketch, saturating rather than
+// wrapping around.
+func increment(cell *uint32) uint32 {
+	for {
+		n := atomic.LoadUint32(cell)
+		if n == ^uint32(0) {
+			return n
+		}
+		if atomic.CompareAndSwapUint32(cell, n, n+1) {
+			return n + 1
+		}
+	}
+}
+
+// Record counts a request for the serial, returning its estimated count.
+func (p *popularity) Record(issuer storage.Issuer, serial storage.Serial, now time.Time) uint32 {
+	key := fetchKey(issuer, serial)
+	var count uint32
+	for row := range p.sketch {
+		n := increment(&p.sketch[row][p.index(row, key)])
+		if row == 0 || n < count {
+			count = n
+		}
+	}
+	// A listed serial's count is at least the floor, and this request raised
+	// it, so one no higher isn't listed and wouldn't be
+	if count <= atomic.LoadUint32(&p.floor) {
+		return count
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.updateFloor()
+	if entry, ok := p.top[key]; ok {
+		entry.count = count
+		entry.lastAccess = now
+		heap.Fix(&p.byCount, entry.index)
+		return count
+	}
+	if len(p.byCount) >= popularityTopSize {
+		if count <= p.byCount[0].count {
+			return count
+		}
+		evicted := heap.Pop(&p.byCount).(*popularEntry)
+		delete(p.top, evicted.key)
+	}
+	entry := &popularEntry{issuer: issuer, serial: serial, key: key, count: count, lastAccess: now}
+	p.top[key] = entry
+	heap.Push(&p.byCount, entry)
+	return count
+}
+
+// Decay halves every count, so that popularity reflects recent requests.
+// Requests counted meanwhile may be halved or not.
+func (p *popularity) Decay() {
+	for row := range p.sketch {
+		for i := range p.sketch[row] {
+			cell := &p.sketch[row][i]
+			for {
+				n := atomic.LoadUint32(cell)
+				if n == 0 || atomic.CompareAndSwapUint32(cell, n, n/2) {
+					break
+				}
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, entry := range p.byCount {
+		entry.count /= 2
+	}
+	// Halving keeps the order, so the heap needs no fixing
+	p.updateFloor()
+}
+
+// updateFloor sets floor from the list, with mu held.
+func (p *popularity) updateFloor() {
+	var floor uint32
+	if len(p.byCount) >= popularityTopSize {
+		floor = p.byCount[0].count
+	}
+	atomic.StoreUint32(&p.floor, floor)
+}
+
+// run decays the counts every interval until the context is done.
+func (p *popularity) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Decay()
+		}
+	}
+}
+
+// Estimate returns the serial's estimated count without counting a request.
+func (p *popularity) Estimate(issuer storage.Issuer, serial storage.Serial) Popularity {
+	key := fetchKey(issuer, serial)
+	result := Popularity{Issuer: issuer.String(), Serial: serial.HexString()}
+	for row := range p.sketch {
+		n := atomic.LoadUint32(&p.sketch[row][p.index(row, key)])
+		if row == 0 || n < result.Count {
+			result.Count = n
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if entry, ok := p.top[key]; ok {
+		lastAccess := entry.lastAccess
+		result.LastAccess = &lastAccess
+	}
+	return result
+}
+
+// Top returns up to limit of the most requested serials, most requested first.
+func (p *popularity) Top(limit int) []Popularity {
+	p.mu.Lock()
+	result := make([]Popularity, 0, len(p.top))
+	for _, entry := range p.top {
+		lastAccess := entry.lastAccess
+		result = append(result, Popularity{
+			Issuer:     entry.issuer.String(),
+			Serial:     entry.serial.HexString(),
+			Count:      entry.count,
+			LastAccess: &lastAccess,
+		})
+	}
+	p.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].LastAccess.After(*result[j].LastAccess)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// DisablePopularityTracking stops counting requests per serial. Refreshing
+// and warming then fetch in the order they find serials.
+func (c *OcspStore) DisablePopularityTracking() {
+	c.popularity = nil
+}
+
+// RunPopularityDecay halves the request counts every half-life until the
+// context is done, so that popularity reflects recent requests.
+func (c *OcspStore) RunPopularityDecay(ctx context.Context) {
+	if c.popularity == nil {
+		return
+	}
+	c.popularity.run(ctx, popularityHalfLife)
+}
+
+// Popularity estimates how often the serial was requested from this replica.
+// Without popularity tracking, the count is always zero.
+func (c *OcspStore) Popularity(issuer storage.Issuer, serial storage.Serial) Popularity {
+	if c.popularity == nil {
+		return Popularity{Issuer: issuer.String(), Serial: serial.HexString()}
+	}
+	return c.popularity.Estimate(issuer, serial)
+}
+
+// PopularSerials lists up to limit of the serials most requested from this
+// replica, most requested first. A limit of zero lists all that are tracked.
+func (c *OcspStore) PopularSerials(limit int) []Popularity {
+	if c.popularity == nil {
+		return []Popularity{}
+	}
+	return c.popularity.Top(limit)
+}
+
+// popularFirst reorders the source's targets in batches of up to batch,
+// sending the most popular of each batch first.
+func (c *OcspStore) popularFirst(source WarmSource, batch int) WarmSource {
+	type scored struct {
+		target WarmTarget
+		count  uint32
+	}
+	if c.popularity == nil {
+		return source
+	}
+	return func(ctx context.Context, out chan<- WarmTarget) error {
+		defer close(out)
+
+		targets := make(chan WarmTarget)
+		sourceErr := make(chan error, 1)
+		go func() {
+			sourceErr <- source(ctx, targets)
+		}()
+
+		var pending []scored
+		flush := func() error {
+			sort.SliceStable(pending, func(i, j int) bool {
+				return pending[i].count > pending[j].count
+			})
+			for _, p := range pending {
+				err := sendTarget(ctx, out, p.target)
+				if err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+			return nil
+		}
+
+		var err error
+		for target := range targets {
+			if err != nil {
+				// Drain the source
+				continue
+			}
+			var count uint32
+			if target.Err == nil {
+				count = c.popularity.Estimate(target.Issuer, target.Serial).Count
+			}
+			pending = append(pending, scored{target, count})
+			if len(pending) >= batch {
+				err = flush()
+			}
+		}
+		if err == nil {
+			err = flush()
+		}
+		if sourceErr := <-sourceErr; sourceErr != nil {
+			return sourceErr
+		}
+		return err
+	}
+}
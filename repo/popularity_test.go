@@ -0,0 +1,227 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+func testSerial(serial int64) storage.Serial {
+	s, _ := storage.NewSerialFromBigInt(big.NewInt(serial))
+	return s
+}
+
+func TestPopularityRecord(t *testing.T) {
+	t.Parallel()
+	issuer, err := storage.NewIssuerFromHexKeyId("abcdef0123456789abcdef0123456789abcdef01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p := newPopularity()
+
+	for i := 0; i < 10; i++ {
+		p.Record(*issuer, testSerial(1), now)
+	}
+	for i := 0; i < 3; i++ {
+		p.Record(*issuer, testSerial(2), now.Add(time.Minute))
+	}
+	if count := p.Record(*issuer, testSerial(3), now); count != 1 {
+		t.Errorf("Expected a first request to count 1, got %d", count)
+	}
+
+	estimate := p.Estimate(*issuer, testSerial(1))
+	if estimate.Count != 10 || estimate.LastAccess == nil || !estimate.LastAccess.Equal(now) {
+		t.Errorf("Unexpected estimate %+v", estimate)
+	}
+	if estimate := p.Estimate(*issuer, testSerial(4)); estimate.Count != 0 || estimate.LastAccess != nil {
+		t.Errorf("Expected nothing for an unrequested serial, got %+v", estimate)
+	}
+
+	top := p.Top(2)
+	if len(top) != 2 || top[0].Serial != "01" || top[1].Serial != "02" || top[1].Count != 3 {
+		t.Errorf("Unexpected top serials %+v", top)
+	}
+	if all := p.Top(0); len(all) != 3 {
+		t.Errorf("Expected all 3 serials, got %d", len(all))
+	}
+
+	// Counts halve every half-life
+	p.Decay()
+	p.Decay()
+	p.Record(*issuer, testSerial(1), now.Add(2*popularityHalfLife))
+	if estimate := p.Estimate(*issuer, testSerial(1)); estimate.Count != 3 {
+		t.Errorf("Expected 10 to decay to 2, then count 1 more, got %d", estimate.Count)
+	}
+	if top := p.Top(0); top[0].Count != 3 || top[1].Count != 0 {
+		t.Errorf("Expected the top serials to decay too, got %+v", top)
+	}
+}
+
+func TestPopularityDecaysInBackground(t *testing.T) {
+	t.Parallel()
+	issuer, err := storage.NewIssuerFromHexKeyId("abcdef0123456789abcdef0123456789abcdef01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPopularity()
+	for i := 0; i < 8; i++ {
+		p.Record(*issuer, testSerial(1), time.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Estimate(*issuer, testSerial(1)).Count != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if count := p.Estimate(*issuer, testSerial(1)).Count; count != 0 {
+		t.Errorf("Expected the count to decay away, got %d", count)
+	}
+}
+
+func TestPopularityConcurrentRecords(t *testing.T) {
+	t.Parallel()
+	issuer, err := storage.NewIssuerFromHexKeyId("abcdef0123456789abcdef0123456789abcdef01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPopularity()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				p.Record(*issuer, testSerial(1), time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+	if count := p.Estimate(*issuer, testSerial(1)).Count; count != 800 {
+		t.Errorf("Expected every request counted, got %d", count)
+	}
+}
+
+func TestPopularityDisabled(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 2211)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 2211, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+	store.DisablePopularityTracking()
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate := store.Popularity(issuer, testSerial(2211)); estimate.Count != 0 {
+		t.Errorf("Expected nothing counted, got %+v", estimate)
+	}
+	if popular := store.PopularSerials(0); len(popular) != 0 {
+		t.Errorf("Expected no popular serials, got %+v", popular)
+	}
+
+	targets := []WarmTarget{testTarget(issuer, 2212), testTarget(issuer, 2211)}
+	ordered, err := collectTargets(t, store.popularFirst(testSource(targets, nil), warmPriorityBatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ordered) != 2 || ordered[0].Serial.HexString() != "08a4" {
+		t.Errorf("Expected the source's order, got %+v", ordered)
+	}
+	store.RunPopularityDecay(context.Background())
+}
+
+func TestPopularityTopIsBounded(t *testing.T) {
+	t.Parallel()
+	issuer, err := storage.NewIssuerFromHexKeyId("abcdef0123456789abcdef0123456789abcdef01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p := newPopularity()
+
+	for serial := int64(1); serial <= popularityTopSize+10; serial++ {
+		p.Record(*issuer, testSerial(serial), now)
+	}
+	if len(p.top) != popularityTopSize {
+		t.Fatalf("Expected %d tracked serials, got %d", popularityTopSize, len(p.top))
+	}
+	// Serials counted no more than the least listed are turned away unlocked
+	if floor := atomic.LoadUint32(&p.floor); floor == 0 || floor != p.byCount[0].count {
+		t.Errorf("Expected the floor at the least listed count %d, got %d", p.byCount[0].count, floor)
+	}
+	hot := testSerial(popularityTopSize + 100)
+	p.Record(*issuer, hot, now)
+	p.Record(*issuer, hot, now)
+	if len(p.top) != popularityTopSize {
+		t.Errorf("Expected %d tracked serials, got %d", popularityTopSize, len(p.top))
+	}
+	if top := p.Top(1); top[0].Serial != hot.HexString() {
+		t.Errorf("Expected the hot serial to displace a cold one, got %+v", top[0])
+	}
+}
+
+func TestWarmPopularFirst(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 2201)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 2201, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := store.Get(context.Background(), req, reqBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if estimate := store.Popularity(issuer, testSerial(2201)); estimate.Count != 3 {
+		t.Errorf("Expected 3 requests counted, got %+v", estimate)
+	}
+	if popular := store.PopularSerials(0); len(popular) != 1 || popular[0].Issuer != issuer.String() {
+		t.Errorf("Unexpected popular serials %+v", popular)
+	}
+
+	targets := []WarmTarget{testTarget(issuer, 2202), testTarget(issuer, 2203), testTarget(issuer, 2201)}
+	ordered, err := collectTargets(t, store.popularFirst(testSource(targets, nil), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serials []string
+	for _, target := range ordered {
+		serials = append(serials, target.Serial.HexString())
+	}
+	// Read ahead in batches of 2, the popular serial only leads its batch
+	expected := []string{"089a", "089b", "0899"}
+	for i := range expected {
+		if i >= len(serials) || serials[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, serials)
+		}
+	}
+
+	ordered, err = collectTargets(t, store.popularFirst(testSource(targets, nil), warmPriorityBatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ordered) != 3 || ordered[0].Serial.HexString() != "0899" {
+		t.Errorf("Expected the popular serial first, got %+v", ordered)
+	}
+}
@@ -0,0 +1,233 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+// refreshLeaderKey holds the lease of the replica doing the refreshing.
+const refreshLeaderKey = "refresh/leader"
+
+type RefreshOptions struct {
+	// Interval is how often to look for entries to refresh
+	Interval time.Duration
+	// Ahead is how long before the end of its fresh life an entry is refreshed
+	Ahead time.Duration
+	// Jitter refreshes each entry up to this much earlier still, at random,
+	// so that entries fetched together aren't all refreshed together
+	Jitter time.Duration
+	// Concurrency bounds how many fetches are in flight at once
+	Concurrency int
+	// Rate bounds how many fetches start per second. Only the leader refreshes,
+	// so this is the budget across all replicas.
+	Rate float64
+	// Deadline bounds each fetch
+	Deadline time.Duration
+}
+
+// RefreshScheduler refetches recently requested entries shortly before they go
+// stale, so that clients don't wait on upstream for them. Replicas sharing the
+// cache elect a leader with a lease, and only the leader refreshes.
+type RefreshScheduler struct {
+	store *OcspStore
+	opts  RefreshOptions
+	lease *leaderLease
+}
+
+// NewRefreshScheduler refreshes the store's entries, which requires access
+// tracking. The owner identifies this replica in the leader lease.
+func (c *OcspStore) NewRefreshScheduler(owner string, opts RefreshOptions) (*RefreshScheduler, error) {
+	if c.access == nil {
+		return nil, fmt.Errorf("Refreshing requires access tracking")
+	}
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("Refresh interval must be positive")
+	}
+	lease, err := newLeaderLease(c.cache, refreshLeaderKey, owner, 3*opts.Interval)
+	if err != nil {
+		return nil, err
+	}
+	return &RefreshScheduler{c, opts, lease}, nil
+}
+
+// Run refreshes entries every interval until the context is done, then gives
+// up the leadership, if it held it.
+func (s *RefreshScheduler) Run(ctx context.Context) {
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := s.lease.Release(releaseCtx)
+		if err != nil {
+			s.store.logger.Warningf("Failed giving up the refresh leadership: %v", err)
+		}
+		refreshLeader.Set(0)
+	}()
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		stats, leader, err := s.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.store.logger.Warningf("Refreshing failed: %v", err)
+		}
+		if leader {
+			s.store.logger.Infof("Refreshing read %d, refreshed %d, fresh %d, skipped %d, failed %d",
+				stats.Read, stats.Warmed, stats.Fresh, stats.Skipped, stats.Failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce refreshes the entries that are due, if this replica is the leader,
+// and returns whether it is. The most popular are refreshed first, by the
+// counts of the leader alone, which are a sample of the requests to all
+// replicas.
+func (s *RefreshScheduler) RunOnce(ctx context.Context) (WarmStats, bool, error) {
+	leader, err := s.lease.Hold(ctx)
+	if err != nil || !leader {
+		refreshLeader.Set(0)
+		return WarmStats{}, false, err
+	}
+	refreshLeader.Set(1)
+
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.keepLease(scanCtx, cancel)
+
+	stats, err := s.store.Warm(scanCtx, s.dueSource(), WarmOptions{
+		Concurrency: s.opts.Concurrency,
+		Rate:        s.opts.Rate,
+		Deadline:    s.opts.Deadline,
+		Force:       true,
+		label:       "Refreshing",
+	})
+	refreshResults.WithLabelValues(refreshResultRefreshed).Add(float64(stats.Warmed))
+	refreshResults.WithLabelValues(refreshResultSkipped).Add(float64(stats.Skipped))
+	refreshResults.WithLabelValues(refreshResultFailed).Add(float64(stats.Failed))
+	return stats, true, err
+}
+
+// keepLease renews the lease while a scan runs, stopping the scan if the lease
+// is lost to another replica.
+func (s *RefreshScheduler) keepLease(ctx context.Context, stop context.CancelFunc) {
+	ticker := time.NewTicker(s.lease.life / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		leader, err := s.lease.Hold(ctx)
+		if err == nil && !leader {
+			s.store.logger.Warningf("Lost the refresh leadership, stopping")
+			refreshLeader.Set(0)
+			stop()
+			return
+		}
+	}
+}
+
+// dueSource finds the recently requested entries that are missing, or that go
+// stale within the Ahead period, give or take the jitter.
+func (s *RefreshScheduler) dueSource() WarmSource {
+	return func(ctx context.Context, out chan<- WarmTarget) error {
+		defer close(out)
+
+		keys := make(chan string)
+		scanErr := make(chan error, 1)
+		go func() {
+			scanErr <- s.store.cache.KeysToChan(ctx, allAccessPattern, keys)
+		}()
+
+		var err error
+		for key := range keys {
+			if err != nil {
+				// Drain the scan
+				continue
+			}
+			issuer, serial, parseErr := parseAccessKey(key)
+			if parseErr != nil {
+				s.store.logger.Warningf("Ignoring access marker %q: %v", key, parseErr)
+				continue
+			}
+			var due bool
+			due, err = s.isDue(ctx, issuer, serial, time.Now())
+			if err == nil && due {
+				err = sendTarget(ctx, out, WarmTarget{Issuer: issuer, Serial: serial})
+			}
+		}
+		if scanErr := <-scanErr; err == nil {
+			err = scanErr
+		}
+		return err
+	}
+}
+
+func (s *RefreshScheduler) isDue(ctx context.Context, issuer storage.Issuer, serial storage.Serial, now time.Time) (bool, error) {
+	cacheRsp, found, err := s.store.cache.Get(ctx, storage.ResponseKey(issuer, serial))
+	if err != nil || !found {
+		return !found, err
+	}
+	cr, err := NewCompressedResponseFromBinaryString(cacheRsp, serial)
+	if err != nil {
+		// Refetching replaces it
+		return true, nil
+	}
+	ahead := s.opts.Ahead
+	if s.opts.Jitter > 0 {
+		ahead += time.Duration(mrand.Int63n(int64(s.opts.Jitter)))
+	}
+	return cr.FreshUntil.Sub(now) <= ahead, nil
+}
+
+// leaderLease elects one replica among those sharing the cache. The holder's
+// token is stored at key until it is released or not renewed within life.
+type leaderLease struct {
+	cache storage.RemoteCache
+	key   string
+	token string
+	life  time.Duration
+}
+
+func newLeaderLease(cache storage.RemoteCache, key string, owner string, life time.Duration) (*leaderLease, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &leaderLease{cache, key, owner + "/" + hex.EncodeToString(nonce), life}, nil
+}
+
+// Hold takes the lease if it is free, and renews it if this replica holds it.
+// It returns whether this replica holds it. Renewing only if the lease is
+// still ours, in one step, keeps a lease that expired and was taken by another
+// replica in the meantime from being extended.
+func (ll *leaderLease) Hold(ctx context.Context) (bool, error) {
+	holder, err := ll.cache.SetIfNotExist(ctx, ll.key, ll.token, ll.life)
+	if err != nil || holder != ll.token {
+		return false, err
+	}
+	return ll.cache.ExpireIfEqual(ctx, ll.key, ll.token, time.Now().Add(ll.life))
+}
+
+// Release gives up the lease, if this replica holds it.
+func (ll *leaderLease) Release(ctx context.Context) error {
+	_, err := ll.cache.ExpireIfEqual(ctx, ll.key, ll.token, time.Now())
+	return err
+}
@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewRefreshSchedulerRequiresAccessTracking(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, _ := ti.request(t, 2101)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), newTestUpstream(t, nil, false))
+
+	_, err := store.NewRefreshScheduler("test", RefreshOptions{Interval: time.Minute})
+	if err == nil {
+		t.Error("Expected an error without access tracking")
+	}
+	store.EnableAccessTracking(time.Hour)
+	_, err = store.NewRefreshScheduler("test", RefreshOptions{})
+	if err == nil {
+		t.Error("Expected an error without an interval")
+	}
+}
+
+func TestRefreshRunOnce(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 2102)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 2102, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, issuer, tu)
+	store.EnableAccessTracking(time.Hour)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cached, but never requested
+	_, err = store.Push(context.Background(), issuer, ti.response(t, 2103, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fresh for another 24 hours
+	scheduler, err := store.NewRefreshScheduler("test", RefreshOptions{Interval: time.Minute, Ahead: time.Hour, Jitter: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, leader, err := scheduler.RunOnce(context.Background())
+	if err != nil || !leader {
+		t.Fatalf("Expected to lead, got %v %v", leader, err)
+	}
+	if stats.Read != 0 || tu.Hits() != 1 {
+		t.Errorf("Expected nothing due, got %+v and %d fetches", stats, tu.Hits())
+	}
+
+	refreshed := testutil.ToFloat64(refreshResults.WithLabelValues(refreshResultRefreshed))
+	scheduler.opts.Ahead = 48 * time.Hour
+	stats, _, err = scheduler.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Read != 1 || stats.Warmed != 1 || tu.Hits() != 2 {
+		t.Errorf("Expected the requested serial to be refreshed, got %+v and %d fetches", stats, tu.Hits())
+	}
+	if testutil.ToFloat64(refreshResults.WithLabelValues(refreshResultRefreshed)) < refreshed+1 {
+		t.Error("Expected the refresh to be counted")
+	}
+
+	// Once expired, only a request can bring it back without the issuer's
+	// certificate
+	serial, _ := storage.NewSerialFromBigInt(big.NewInt(2102))
+	_ = store.Purge(context.Background(), issuer, serial)
+	stats, _, err = scheduler.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Skipped != 1 {
+		t.Errorf("Expected the expired serial to be skipped, got %+v", stats)
+	}
+	err = store.AddIssuerCertificate(issuer, ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _, err = scheduler.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Warmed != 1 || tu.Hits() != 3 {
+		t.Errorf("Expected the expired serial to be fetched again, got %+v and %d fetches", stats, tu.Hits())
+	}
+}
+
+func TestRefreshLeadership(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, _ := ti.request(t, 2104)
+	cache := storage.NewMockRemoteCache()
+	var schedulers []*RefreshScheduler
+	for _, owner := range []string{"a", "b"} {
+		store := newTestStore(t, cache, storage.NewIssuerFromRequest(req), newTestUpstream(t, nil, false))
+		store.EnableAccessTracking(time.Hour)
+		scheduler, err := store.NewRefreshScheduler(owner, RefreshOptions{Interval: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedulers = append(schedulers, scheduler)
+	}
+
+	_, leader, err := schedulers[0].RunOnce(context.Background())
+	if err != nil || !leader {
+		t.Fatalf("Expected the first to lead, got %v %v", leader, err)
+	}
+	_, leader, err = schedulers[1].RunOnce(context.Background())
+	if err != nil || leader {
+		t.Fatalf("Expected the second not to lead, got %v %v", leader, err)
+	}
+	_, leader, _ = schedulers[0].RunOnce(context.Background())
+	if !leader {
+		t.Error("Expected the first to keep leading")
+	}
+
+	err = schedulers[0].lease.Release(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, leader, err = schedulers[1].RunOnce(context.Background())
+	if err != nil || !leader {
+		t.Errorf("Expected the second to lead once released, got %v %v", leader, err)
+	}
+
+	// The former leader neither renews nor gives up the new leader's lease
+	err = schedulers[0].lease.Release(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := schedulers[1].lease.Hold(context.Background()); !held {
+		t.Error("Expected the second to keep leading")
+	}
+	before := cache.Expirations[refreshLeaderKey]
+	if renewed, _ := cache.ExpireIfEqual(context.Background(), refreshLeaderKey, schedulers[0].lease.token, time.Now().Add(time.Hour)); renewed || !cache.Expirations[refreshLeaderKey].Equal(before) {
+		t.Error("Expected a stale token not to extend the lease")
+	}
+}
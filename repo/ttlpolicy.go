@@ -0,0 +1,107 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// DefaultTTLFraction is the share of a response's validity window for which it
+// is cached, unless configured otherwise.
+const DefaultTTLFraction = 0.5
+
+// TTLRule decides how long a response stays fresh in the cache.
+type TTLRule struct {
+	// Fraction of the ThisUpdate to NextUpdate window, measured from
+	// ThisUpdate, after which the response is no longer fresh.
+	Fraction float64
+	// MaxLife caps how long the response is fresh once fetched. Responses
+	// without a NextUpdate are fresh for MaxLife after their ThisUpdate.
+	MaxLife time.Duration
+	// MinLife is the least time the response is fresh once fetched, so that
+	// responses close to their end don't hammer the upstream.
+	MinLife time.Duration
+}
+
+// TTLPolicy holds the TTLRule for each certificate status. No rule ever lets a
+// response be fresh past its own NextUpdate.
+type TTLPolicy struct {
+	Good    TTLRule
+	Revoked TTLRule
+	Unknown TTLRule
+}
+
+// NewTTLPolicy returns a policy applying the same rule to every status.
+func NewTTLPolicy(rule TTLRule) TTLPolicy {
+	return TTLPolicy{rule, rule, rule}
+}
+
+func (p TTLPolicy) RuleFor(status int) TTLRule {
+	switch status {
+	case ocsp.Revoked:
+		return p.Revoked
+	case ocsp.Unknown:
+		return p.Unknown
+	default:
+		return p.Good
+	}
+}
+
+// FreshLife returns how long, starting at now, resp should be served from
+// the cache without being refreshed. A result of zero or less means the
+// response is already past its NextUpdate and must not be cached.
+func (p TTLPolicy) FreshLife(resp *ocsp.Response, now time.Time) time.Duration {
+	rule := p.RuleFor(resp.Status)
+
+	var freshEnd time.Time
+	if resp.NextUpdate.IsZero() {
+		freshEnd = resp.ThisUpdate.Add(rule.MaxLife)
+	} else {
+		window := resp.NextUpdate.Sub(resp.ThisUpdate)
+		freshEnd = resp.ThisUpdate.Add(time.Duration(rule.Fraction * float64(window)))
+	}
+
+	life := freshEnd.Sub(now)
+	if rule.MaxLife > 0 && life > rule.MaxLife {
+		life = rule.MaxLife
+	}
+	if life < rule.MinLife {
+		life = rule.MinLife
+	}
+	if !resp.NextUpdate.IsZero() && now.Add(life).After(resp.NextUpdate) {
+		life = resp.NextUpdate.Sub(now)
+	}
+	return life
+}
+
+// ParseTTLRule reads a rule from settings with the keys "fraction", "max" and
+// "min", as produced by common.GetEnvMap. Missing keys keep the value in def.
+func ParseTTLRule(settings map[string]string, def TTLRule) (TTLRule, error) {
+	rule := def
+	for k, v := range settings {
+		var err error
+		switch k {
+		case "fraction":
+			rule.Fraction, err = strconv.ParseFloat(v, 64)
+			if err == nil && (rule.Fraction < 0 || rule.Fraction > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "max":
+			rule.MaxLife, err = time.ParseDuration(v)
+		case "min":
+			rule.MinLife, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return def, fmt.Errorf("TTL rule %s=%s: %v", k, v, err)
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestFreshLifeFraction(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	policy := NewTTLPolicy(TTLRule{Fraction: 0.5, MaxLife: 72 * time.Hour, MinLife: time.Hour})
+
+	resp := &ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: now.Add(-24 * time.Hour),
+		NextUpdate: now.Add(72 * time.Hour),
+	}
+	// Halfway through a 96 hour window is 24 hours from now
+	if life := policy.FreshLife(resp, now); life != 24*time.Hour {
+		t.Errorf("Expected 24h, got %v", life)
+	}
+}
+
+func TestFreshLifeCap(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	policy := NewTTLPolicy(TTLRule{Fraction: 1.0, MaxLife: 6 * time.Hour, MinLife: time.Hour})
+
+	resp := &ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: now,
+		NextUpdate: now.Add(7 * 24 * time.Hour),
+	}
+	if life := policy.FreshLife(resp, now); life != 6*time.Hour {
+		t.Errorf("Expected the 6h cap, got %v", life)
+	}
+}
+
+func TestFreshLifeFloor(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	policy := NewTTLPolicy(TTLRule{Fraction: 0.5, MaxLife: 24 * time.Hour, MinLife: time.Hour})
+
+	resp := &ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: now.Add(-60 * time.Hour),
+		NextUpdate: now.Add(12 * time.Hour),
+	}
+	// The halfway mark is long past, so the floor applies
+	if life := policy.FreshLife(resp, now); life != time.Hour {
+		t.Errorf("Expected the 1h floor, got %v", life)
+	}
+}
+
+func TestFreshLifeNeverPastNextUpdate(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	policy := NewTTLPolicy(TTLRule{Fraction: 0.5, MaxLife: 24 * time.Hour, MinLife: time.Hour})
+
+	resp := &ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: now.Add(-24 * time.Hour),
+		NextUpdate: now.Add(10 * time.Minute),
+	}
+	if life := policy.FreshLife(resp, now); life != 10*time.Minute {
+		t.Errorf("The floor must not extend past NextUpdate, got %v", life)
+	}
+
+	resp.NextUpdate = now.Add(-time.Minute)
+	if life := policy.FreshLife(resp, now); life > 0 {
+		t.Errorf("Expired responses must not be cached, got %v", life)
+	}
+}
+
+func TestFreshLifeWithoutNextUpdate(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	policy := NewTTLPolicy(TTLRule{Fraction: 0.5, MaxLife: 24 * time.Hour, MinLife: time.Hour})
+
+	resp := &ocsp.Response{
+		Status:     ocsp.Good,
+		ThisUpdate: now.Add(-4 * time.Hour),
+	}
+	if life := policy.FreshLife(resp, now); life != 20*time.Hour {
+		t.Errorf("Expected MaxLife after ThisUpdate, got %v", life)
+	}
+}
+
+func TestFreshLifePerStatus(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	policy := NewTTLPolicy(TTLRule{Fraction: 0.5, MaxLife: 24 * time.Hour, MinLife: time.Hour})
+	policy.Revoked = TTLRule{Fraction: 1.0, MaxLife: 96 * time.Hour, MinLife: time.Hour}
+	policy.Unknown = TTLRule{Fraction: 0, MaxLife: 5 * time.Minute, MinLife: 5 * time.Minute}
+
+	resp := &ocsp.Response{
+		ThisUpdate: now,
+		NextUpdate: now.Add(72 * time.Hour),
+	}
+
+	resp.Status = ocsp.Good
+	if life := policy.FreshLife(resp, now); life != 24*time.Hour {
+		t.Errorf("Good: expected 24h, got %v", life)
+	}
+	resp.Status = ocsp.Revoked
+	if life := policy.FreshLife(resp, now); life != 72*time.Hour {
+		t.Errorf("Revoked: expected 72h, got %v", life)
+	}
+	resp.Status = ocsp.Unknown
+	if life := policy.FreshLife(resp, now); life != 5*time.Minute {
+		t.Errorf("Unknown: expected 5m, got %v", life)
+	}
+}
+
+func TestParseTTLRule(t *testing.T) {
+	t.Parallel()
+	def := TTLRule{Fraction: 0.5, MaxLife: 24 * time.Hour, MinLife: time.Hour}
+
+	rule, err := ParseTTLRule(map[string]string{"fraction": "0.25", "min": "5m"}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TTLRule{Fraction: 0.25, MaxLife: 24 * time.Hour, MinLife: 5 * time.Minute}
+	if rule != expected {
+		t.Errorf("Expected %+v, got %+v", expected, rule)
+	}
+
+	for _, bad := range []map[string]string{
+		{"fraction": "1.5"},
+		{"fraction": "half"},
+		{"max": "forever"},
+		{"maximum": "1h"},
+	} {
+		if _, err := ParseTTLRule(bad, def); err == nil {
+			t.Errorf("Expected an error parsing %+v", bad)
+		}
+	}
+}
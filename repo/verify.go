@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// verifyResponse parses an upstream OCSP response for the serial, checking it
+// was signed by the issuer, or by a responder certificate the issuer delegated
+// OCSP signing to, and that it is about a certificate from that issuer.
+func verifyResponse(rspBytes []byte, serial *big.Int, issuer *x509.Certificate, now time.Time) (*ocsp.Response, error) {
+	// Selecting the response by serial rejects responses for other serials.
+	// A nil issuer only checks the signature against an embedded certificate,
+	// which is checked against the real issuer below.
+	resp, err := ocsp.ParseResponseForCert(rspBytes, &x509.Certificate{SerialNumber: serial}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.Certificate == nil:
+		err = resp.CheckSignatureFrom(issuer)
+		if err != nil {
+			return nil, fmt.Errorf("bad signature from issuer: %v", err)
+		}
+	case bytes.Equal(resp.Certificate.Raw, issuer.Raw):
+		// Signed by the issuer, which was included for good measure
+	default:
+		err = checkDelegatedResponder(resp.Certificate, issuer, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := responseCertID(rspBytes, serial)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCertIDIssuer(id, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// checkFreshness makes sure a response is currently valid, tolerating up to
+// maxSkew of difference between our clock and the responder's.
+func checkFreshness(resp *ocsp.Response, now time.Time, maxSkew time.Duration) error {
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(resp.ThisUpdate) {
+		return fmt.Errorf("NextUpdate %s is before ThisUpdate %s", resp.NextUpdate, resp.ThisUpdate)
+	}
+	if resp.ThisUpdate.After(now.Add(maxSkew)) {
+		return fmt.Errorf("ThisUpdate %s is in the future", resp.ThisUpdate)
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now.Add(-maxSkew)) {
+		return fmt.Errorf("NextUpdate %s has passed", resp.NextUpdate)
+	}
+	return nil
+}
+
+func checkDelegatedResponder(responder *x509.Certificate, issuer *x509.Certificate, now time.Time) error {
+	err := responder.CheckSignatureFrom(issuer)
+	if err != nil {
+		return fmt.Errorf("responder certificate not issued by issuer: %v", err)
+	}
+
+	canSign := false
+	for _, eku := range responder.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			canSign = true
+			break
+		}
+	}
+	if !canSign {
+		return fmt.Errorf("responder certificate %s lacks the OCSPSigning EKU", responder.Subject)
+	}
+
+	if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+		return fmt.Errorf("responder certificate %s is valid from %s to %s", responder.Subject, responder.NotBefore, responder.NotAfter)
+	}
+	return nil
+}
+
+// checkCertIDIssuer makes sure a response's CertID names the issuer.
+func checkCertIDIssuer(id certID, issuer *x509.Certificate) error {
+	hash, err := id.Hash()
+	if err != nil {
+		return err
+	}
+	if !hash.Available() {
+		return fmt.Errorf("hash algorithm %v not linked into binary", hash)
+	}
+
+	var publicKeyInfo struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo)
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	if !bytes.Equal(h.Sum(nil), id.IssuerKeyHash) {
+		return fmt.Errorf("response is for another issuer's key")
+	}
+
+	h.Reset()
+	h.Write(issuer.RawSubject)
+	if !bytes.Equal(h.Sum(nil), id.NameHash) {
+		return fmt.Errorf("response is for another issuer's name")
+	}
+	return nil
+}
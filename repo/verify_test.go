@@ -0,0 +1,334 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	"golang.org/x/crypto/ocsp"
+)
+
+// delegate issues an OCSP responder certificate from the issuer
+func (ti testIssuer) delegate(t *testing.T, ekus []x509.ExtKeyUsage, notAfter time.Time) testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  ekus,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ti.cert, key.Public(), ti.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIssuer{cert, key}
+}
+
+// signedResponse creates a response naming the issuer in its CertID, signed
+// by the signer and embedding its certificate if it isn't the issuer
+func signedResponse(t *testing.T, issuer *x509.Certificate, signer testIssuer, serial int64) []byte {
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(serial),
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   time.Now().Add(72 * time.Hour),
+	}
+	if signer.cert != issuer {
+		template.Certificate = signer.cert
+	}
+	rspBytes, err := ocsp.CreateResponse(issuer, signer.cert, template, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rspBytes
+}
+
+func TestVerifySignedByIssuer(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	rspBytes := signedResponse(t, ti.cert, ti, 100)
+
+	resp, err := verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SerialNumber.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("Unexpected serial %v", resp.SerialNumber)
+	}
+}
+
+func TestVerifySignedByDelegate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	responder := ti.delegate(t, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, time.Now().Add(time.Hour))
+	rspBytes := signedResponse(t, ti.cert, responder, 100)
+
+	_, err := verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRejectsDelegateWithoutEKU(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	responder := ti.delegate(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, time.Now().Add(time.Hour))
+	rspBytes := signedResponse(t, ti.cert, responder, 100)
+
+	_, err := verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now())
+	if err == nil {
+		t.Error("Delegated responders need the OCSPSigning EKU")
+	}
+}
+
+func TestVerifyRejectsExpiredDelegate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	responder := ti.delegate(t, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, time.Now().Add(time.Hour))
+	rspBytes := signedResponse(t, ti.cert, responder, 100)
+
+	_, err := verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now().Add(2*time.Hour))
+	if err == nil {
+		t.Error("Expired delegated responders should be rejected")
+	}
+}
+
+func TestVerifyRejectsOtherSigner(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	other := newTestIssuer(t)
+
+	// Claims to be about ti's certificates, but signed by another CA
+	rspBytes := signedResponse(t, ti.cert, other, 100)
+	_, err := verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now())
+	if err == nil {
+		t.Error("Responses signed by another CA's responder should be rejected")
+	}
+
+	// Signed by a responder the other CA delegated to
+	otherResponder := other.delegate(t, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, time.Now().Add(time.Hour))
+	rspBytes = signedResponse(t, ti.cert, otherResponder, 100)
+	_, err = verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now())
+	if err == nil {
+		t.Error("Responses signed by another CA's delegate should be rejected")
+	}
+}
+
+func TestVerifyRejectsOtherIssuer(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	other := newTestIssuer(t)
+
+	// Validly signed by ti, but about a certificate from another issuer
+	rspBytes := signedResponse(t, other.cert, ti, 100)
+	_, err := verifyResponse(rspBytes, big.NewInt(100), ti.cert, time.Now())
+	if err == nil {
+		t.Error("Responses about another issuer's certificates should be rejected")
+	}
+}
+
+func TestVerifyRejectsOtherSerial(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	rspBytes := signedResponse(t, ti.cert, ti, 100)
+
+	_, err := verifyResponse(rspBytes, big.NewInt(101), ti.cert, time.Now())
+	if err == nil {
+		t.Error("Responses for another serial should be rejected")
+	}
+}
+
+func TestAddIssuerCertificateMismatch(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	other := newTestIssuer(t)
+	req, _ := ti.request(t, 1)
+	store := NewOcspStore(nil, storage.NewMockRemoteCache(), NewTTLPolicy(TTLRule{}))
+
+	err := store.AddIssuerCertificate(storage.NewIssuerFromRequest(req), other.cert)
+	if err == nil {
+		t.Error("Should not accept a certificate for a different key ID")
+	}
+	err = store.AddIssuerCertificate(storage.NewIssuerFromRequest(req), ti.cert)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetRejectsUnverifiedResponse(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	other := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 6666)
+	tu := newTestUpstream(t, signedResponse(t, ti.cert, other, 6666), false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+	err := store.AddIssuerCertificate(storage.NewIssuerFromRequest(req), ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != InvalidResponseError {
+		t.Errorf("Expected InvalidResponseError for a forged response, got %v", err)
+	}
+	if len(cache.Data) != 0 {
+		t.Errorf("Forged responses must not be cached: %+v", cache.Data)
+	}
+}
+
+func TestGetRejectsWrongSerial(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 7777)
+	tu := newTestUpstream(t, signedResponse(t, ti.cert, ti, 7778), false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+
+	// Even without an issuer certificate to verify against
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != InvalidResponseError {
+		t.Errorf("Expected InvalidResponseError for the wrong serial, got %v", err)
+	}
+	if len(cache.Data) != 0 {
+		t.Errorf("Responses for other serials must not be cached: %+v", cache.Data)
+	}
+}
+
+func TestGetAcceptsVerifiedResponse(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	responder := ti.delegate(t, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, time.Now().Add(time.Hour))
+	req, reqBytes := ti.request(t, 8888)
+	tu := newTestUpstream(t, signedResponse(t, ti.cert, responder, 8888), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+	err := store.AddIssuerCertificate(storage.NewIssuerFromRequest(req), ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	skew := 5 * time.Minute
+
+	cases := []struct {
+		name       string
+		thisUpdate time.Time
+		nextUpdate time.Time
+		valid      bool
+	}{
+		{"current", now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"no NextUpdate", now.Add(-time.Hour), time.Time{}, true},
+		{"expired", now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"expired within skew", now.Add(-2 * time.Hour), now.Add(-time.Minute), true},
+		{"future", now.Add(time.Hour), now.Add(2 * time.Hour), false},
+		{"future within skew", now.Add(time.Minute), now.Add(2 * time.Hour), true},
+		{"backwards", now.Add(-time.Hour), now.Add(-2 * time.Hour), false},
+	}
+
+	for _, tc := range cases {
+		resp := &ocsp.Response{ThisUpdate: tc.thisUpdate, NextUpdate: tc.nextUpdate}
+		err := checkFreshness(resp, now, skew)
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestGetRejectsExpiredResponse(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 9999)
+	rspBytes := ti.response(t, 9999, time.Now().Add(-72*time.Hour), time.Now().Add(-time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	cache := storage.NewMockRemoteCache()
+	store := newTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != InvalidResponseError {
+		t.Errorf("Expected InvalidResponseError for an expired response, got %v", err)
+	}
+	if len(cache.Data) != 0 {
+		t.Errorf("Expired responses must not be cached: %+v", cache.Data)
+	}
+}
+
+func TestGetRejectsFutureResponse(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 9998)
+	rspBytes := ti.response(t, 9998, time.Now().Add(time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, rspBytes, false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), storage.NewIssuerFromRequest(req), tu)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != InvalidResponseError {
+		t.Errorf("Expected InvalidResponseError for a response from the future, got %v", err)
+	}
+
+	// With enough tolerance, the upstream's clock is simply ahead
+	store.SetMaxClockSkew(2 * time.Hour)
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Errorf("Expected the response to be accepted with a large skew tolerance, got %v", err)
+	}
+}
+
+func TestGetFallsBackToCachedOnInvalidResponse(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 9997)
+	goodBytes := ti.response(t, 9997, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	tu := newTestUpstream(t, goodBytes, false)
+	cache := storage.NewMockRemoteCache()
+	store := newStaleTestStore(t, cache, storage.NewIssuerFromRequest(req), tu)
+	store.EnableStaleServing(time.Hour, false)
+
+	_, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream starts serving an expired response
+	time.Sleep(60 * time.Millisecond)
+	tu.rspBytes = ti.response(t, 9997, time.Now().Add(-72*time.Hour), time.Now().Add(-time.Hour))
+
+	data, _, err := store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatalf("Expected the cached response instead of an error, got %v", err)
+	}
+	if !bytes.Equal(data, goodBytes) {
+		t.Error("Expected the previously cached response")
+	}
+}
@@ -0,0 +1,214 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	"golang.org/x/crypto/ocsp"
+)
+
+// warmProgressInterval is how often warming logs its progress.
+const warmProgressInterval = 10 * time.Second
+
+// WarmTarget is a serial whose response should be cached ahead of requests.
+type WarmTarget struct {
+	Issuer storage.Issuer
+	// IssuerCert builds the OCSP request. If it is nil, the request is built
+	// as Refresh builds it.
+	IssuerCert *x509.Certificate
+	Serial     storage.Serial
+	// Err, if set, is why the source couldn't make a target of what it read.
+	// Such targets are logged and counted as skipped.
+	Err error
+}
+
+// WarmSource sends targets to out until it runs out of them, then closes out.
+// It must give up when the context is done.
+type WarmSource func(ctx context.Context, out chan<- WarmTarget) error
+
+type WarmOptions struct {
+	// Concurrency bounds how many fetches are in flight at once
+	Concurrency int
+	// Rate bounds how many fetches start per second; zero means no bound
+	Rate float64
+	// Deadline bounds each fetch
+	Deadline time.Duration
+	// Force refetches responses that are cached and still fresh
+	Force bool
+	// Progress, if set, is called with the running totals after each target
+	Progress func(WarmStats)
+
+	// label names the run in progress logs
+	label string
+}
+
+type WarmStats struct {
+	// Read counts the targets read from the source.
+	Read int `json:"read"`
+	// Warmed counts responses fetched and cached.
+	Warmed int `json:"warmed"`
+	// Fresh counts targets left alone, their cached response still fresh.
+	Fresh int `json:"fresh"`
+	// Skipped counts targets whose issuer has no upstream responder, for which
+	// no request could be built, or which the source couldn't read.
+	Skipped int `json:"skipped"`
+	// Failed counts targets whose fetch failed or was rejected.
+	Failed int `json:"failed"`
+}
+
+type warmResult int
+
+const (
+	warmWarmed warmResult = iota
+	warmFresh
+	warmSkipped
+	warmFailed
+)
+
+// Warm fetches and caches the responses for the source's targets, so that the
+// first requests for them don't wait on upstream. Of the targets read ahead,
+// those most requested from this replica are fetched first.
+func (c *OcspStore) Warm(ctx context.Context, source WarmSource, opts WarmOptions) (WarmStats, error) {
+	source = c.popularFirst(source, warmPriorityBatch)
+
+	targets := make(chan WarmTarget)
+	sourceErr := make(chan error, 1)
+	go func() {
+		sourceErr <- source(ctx, targets)
+	}()
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	label := opts.label
+	if label == "" {
+		label = "Warming"
+	}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var stats WarmStats
+	snapshot := func() WarmStats {
+		mu.Lock()
+		defer mu.Unlock()
+		return stats
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range targets {
+				result := c.warmOne(ctx, target, opts, tick)
+
+				mu.Lock()
+				stats.Read++
+				switch result {
+				case warmWarmed:
+					stats.Warmed++
+				case warmFresh:
+					stats.Fresh++
+				case warmSkipped:
+					stats.Skipped++
+				case warmFailed:
+					stats.Failed++
+				}
+				current := stats
+				mu.Unlock()
+
+				if opts.Progress != nil {
+					opts.Progress(current)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	progress := time.NewTicker(warmProgressInterval)
+	defer progress.Stop()
+	for {
+		select {
+		case <-done:
+			return snapshot(), <-sourceErr
+		case <-progress.C:
+			s := snapshot()
+			c.logger.Infof("%s: read %d, warmed %d, fresh %d, skipped %d, failed %d", label, s.Read, s.Warmed, s.Fresh, s.Skipped, s.Failed)
+		}
+	}
+}
+
+// warmOne fetches and caches the target's response, unless it is already
+// cached and fresh. Fetches wait for tick, if it is set.
+func (c *OcspStore) warmOne(ctx context.Context, target WarmTarget, opts WarmOptions, tick <-chan time.Time) warmResult {
+	if target.Err != nil {
+		c.logger.Warningf("Not warming an unreadable target: %v", target.Err)
+		return warmSkipped
+	}
+	issuer, serial := target.Issuer, target.Serial
+	group, ok := c.responders[issuer.String()]
+	if !ok {
+		c.logger.Debugf("Not warming issuer %s serial %s, the issuer has no upstream responder", issuer.String(), serial.String())
+		return warmSkipped
+	}
+
+	previous, found, err := c.cache.Get(ctx, storage.ResponseKey(issuer, serial))
+	if err != nil {
+		c.logger.Warningf("Failed warming issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		return warmFailed
+	}
+	if found && !opts.Force {
+		cr, err := NewCompressedResponseFromBinaryString(previous, serial)
+		if err == nil && cr.IsFresh(time.Now()) {
+			return warmFresh
+		}
+	}
+
+	var reqBytes []byte
+	if target.IssuerCert != nil {
+		reqBytes, err = ocsp.CreateRequest(&x509.Certificate{SerialNumber: serial.AsBigInt()}, target.IssuerCert, nil)
+	} else {
+		reqBytes, err = c.buildRequest(issuer, serial, previous)
+	}
+	if err != nil {
+		c.logger.Debugf("Not warming issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		return warmSkipped
+	}
+
+	if tick != nil {
+		select {
+		case <-tick:
+		case <-ctx.Done():
+			return warmFailed
+		}
+	}
+	fetchCtx := ctx
+	if opts.Deadline > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, opts.Deadline)
+		defer cancel()
+	}
+	_, _, err = c.fetch(fetchCtx, group, issuer, serial, reqBytes, previous)
+	if err != nil {
+		c.logger.Warningf("Failed warming issuer %s serial %s: %v", issuer.String(), serial.String(), err)
+		return warmFailed
+	}
+	return warmWarmed
+}
@@ -0,0 +1,168 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+func testSource(targets []WarmTarget, err error) WarmSource {
+	return func(ctx context.Context, out chan<- WarmTarget) error {
+		defer close(out)
+		for _, target := range targets {
+			out <- target
+		}
+		return err
+	}
+}
+
+func testTarget(issuer storage.Issuer, serial int64) WarmTarget {
+	s, _ := storage.NewSerialFromBigInt(big.NewInt(serial))
+	return WarmTarget{Issuer: issuer, Serial: s}
+}
+
+func TestWarm(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, reqBytes := ti.request(t, 1801)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 1801, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+	err := store.AddIssuerCertificate(issuer, ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestIssuer(t)
+	otherReq, _ := other.request(t, 1801)
+
+	targets := []WarmTarget{
+		testTarget(issuer, 1801),
+		// Upstream answers for the wrong serial
+		testTarget(issuer, 1802),
+		testTarget(storage.NewIssuerFromRequest(otherReq), 1801),
+		// The source couldn't read it
+		{Err: errors.New("unreadable")},
+	}
+	var progress []WarmStats
+	stats, err := store.Warm(context.Background(), testSource(targets, nil), WarmOptions{
+		Progress: func(s WarmStats) { progress = append(progress, s) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := WarmStats{Read: 4, Warmed: 1, Skipped: 2, Failed: 1}
+	if stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+	if len(progress) != 4 || progress[3] != expected {
+		t.Errorf("Expected progress after each target, got %+v", progress)
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected 2 upstream fetches, got %d", tu.Hits())
+	}
+
+	_, _, err = store.Get(context.Background(), req, reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tu.Hits() != 2 {
+		t.Errorf("Expected the warmed response to be served from cache, got %d fetches", tu.Hits())
+	}
+
+	stats, err = store.Warm(context.Background(), testSource(targets[:1], nil), WarmOptions{Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Fresh != 1 || tu.Hits() != 2 {
+		t.Errorf("Expected the fresh response to be left alone, got %+v and %d fetches", stats, tu.Hits())
+	}
+
+	stats, err = store.Warm(context.Background(), testSource(targets[:1], nil), WarmOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Warmed != 1 || tu.Hits() != 3 {
+		t.Errorf("Expected a forced refetch, got %+v and %d fetches", stats, tu.Hits())
+	}
+}
+
+func TestWarmWithoutIssuerCertificate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, _ := ti.request(t, 1803)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 1803, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+
+	stats, err := store.Warm(context.Background(), testSource([]WarmTarget{testTarget(issuer, 1803)}, nil), WarmOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Skipped != 1 || tu.Hits() != 0 {
+		t.Errorf("Expected the target to be skipped without a way to build a request, got %+v", stats)
+	}
+
+	target := testTarget(issuer, 1803)
+	target.IssuerCert = ti.cert
+	stats, err = store.Warm(context.Background(), testSource([]WarmTarget{target}, nil), WarmOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Warmed != 1 || tu.Hits() != 1 {
+		t.Errorf("Expected the target's issuer certificate to be used, got %+v", stats)
+	}
+}
+
+func TestWarmRate(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, _ := ti.request(t, 1804)
+	issuer := storage.NewIssuerFromRequest(req)
+	tu := newTestUpstream(t, ti.response(t, 1804, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour)), false)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, tu)
+	err := store.AddIssuerCertificate(issuer, ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var targets []WarmTarget
+	for serial := int64(1804); serial < 1809; serial++ {
+		targets = append(targets, testTarget(issuer, serial))
+	}
+	start := time.Now()
+	stats, err := store.Warm(context.Background(), testSource(targets, nil), WarmOptions{Concurrency: 5, Rate: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Read != 5 || tu.Hits() != 5 {
+		t.Errorf("Expected 5 fetches, got %+v and %d fetches", stats, tu.Hits())
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected 5 fetches at 50/s to take at least 100ms, took %s", elapsed)
+	}
+}
+
+func TestWarmSourceError(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	req, _ := ti.request(t, 1809)
+	issuer := storage.NewIssuerFromRequest(req)
+	store := newTestStore(t, storage.NewMockRemoteCache(), issuer, newTestUpstream(t, nil, false))
+
+	sourceErr := errors.New("bad list")
+	stats, err := store.Warm(context.Background(), testSource(nil, sourceErr), WarmOptions{})
+	if err != sourceErr {
+		t.Errorf("Expected the source's error, got %v", err)
+	}
+	if stats.Read != 0 {
+		t.Errorf("Expected nothing read, got %+v", stats)
+	}
+}
@@ -0,0 +1,220 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	ctclient "github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+// ctLogTimeout bounds each request for entries from a CT log.
+const ctLogTimeout = time.Minute
+
+// precertSigningUsage marks CT precertificate signing certificates, which sign
+// precertificates on behalf of the issuer (RFC 6962 section 3.1).
+var precertSigningUsage = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 4}
+
+func sendTarget(ctx context.Context, out chan<- WarmTarget, target WarmTarget) error {
+	select {
+	case out <- target:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CertificateSource reads PEM certificates, warming each one's serial. The
+// issuer is taken from the certificate's Authority Key Identifier, so it must
+// be the SHA-1 hash of the issuer's key, as most are. Certificates that can't
+// be used are sent as targets with Err set, and the rest still read.
+func CertificateSource(r io.Reader) WarmSource {
+	return func(ctx context.Context, out chan<- WarmTarget) error {
+		defer close(out)
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		for index := 0; ; {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				return nil
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			index++
+			target, err := certificateTarget(block.Bytes)
+			if err != nil {
+				target = WarmTarget{Err: fmt.Errorf("Certificate %d: %v", index, err)}
+			}
+			err = sendTarget(ctx, out, target)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func certificateTarget(der []byte) (WarmTarget, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return WarmTarget{}, err
+	}
+	if len(cert.AuthorityKeyId) == 0 {
+		return WarmTarget{}, fmt.Errorf("serial %x has no Authority Key Identifier", cert.SerialNumber)
+	}
+	issuer, err := storage.NewIssuerFromHexKeyId(hex.EncodeToString(cert.AuthorityKeyId))
+	if err != nil {
+		return WarmTarget{}, fmt.Errorf("serial %x: %v", cert.SerialNumber, err)
+	}
+	// Keyed as OcspStore.Get keys requests, without the DER sign byte
+	serial, err := storage.NewSerialFromBigInt(cert.SerialNumber)
+	if err != nil {
+		return WarmTarget{}, fmt.Errorf("serial %x: %v", cert.SerialNumber, err)
+	}
+	return WarmTarget{Issuer: *issuer, Serial: serial}, nil
+}
+
+// SerialSource reads lines of an issuer key ID and a serial, both in hex and
+// separated by whitespace. Blank lines and lines starting with # are ignored.
+func SerialSource(r io.Reader) WarmSource {
+	return func(ctx context.Context, out chan<- WarmTarget) error {
+		defer close(out)
+
+		scanner := bufio.NewScanner(r)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			fields := strings.Fields(text)
+			if len(fields) != 2 {
+				return fmt.Errorf("Line %d: expected an issuer key ID and a serial", line)
+			}
+			issuer, err := storage.NewIssuerFromHexKeyId(fields[0])
+			if err != nil {
+				return fmt.Errorf("Line %d: invalid issuer key ID: %v", line, err)
+			}
+			n, ok := new(big.Int).SetString(fields[1], 16)
+			if !ok || n.Sign() <= 0 {
+				return fmt.Errorf("Line %d: invalid serial %q, expected positive hex", line, fields[1])
+			}
+			serial, err := storage.NewSerialFromBigInt(n)
+			if err != nil {
+				return fmt.Errorf("Line %d: %v", line, err)
+			}
+			err = sendTarget(ctx, out, WarmTarget{Issuer: *issuer, Serial: serial})
+			if err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+}
+
+// CTLogSource reads the entries from start to end, inclusive, of the CT log at
+// logURL, warming the serial of each certificate and precertificate. Requests
+// are built with the issuer certificate from each entry's chain, so the
+// issuers' certificates needn't be configured. Entries that can't be used are
+// sent as targets with Err set, and the rest still read.
+func CTLogSource(logURL string, start int64, end int64) (WarmSource, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("Invalid CT log range %d to %d", start, end)
+	}
+	client, err := ctclient.New(logURL, &http.Client{Timeout: ctLogTimeout}, jsonclient.Options{UserAgent: "ocsp-l2-cache"})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, out chan<- WarmTarget) error {
+		defer close(out)
+
+		for index := start; index <= end; {
+			// Logs may return fewer entries than asked for
+			rsp, err := client.GetRawEntries(ctx, index, end)
+			if err != nil {
+				return err
+			}
+			if len(rsp.Entries) == 0 {
+				return fmt.Errorf("CT log returned no entries from %d", index)
+			}
+			for i := range rsp.Entries {
+				target, err := logEntryTarget(index, &rsp.Entries[i])
+				if err != nil {
+					target = WarmTarget{Err: fmt.Errorf("CT log entry %d: %v", index, err)}
+				}
+				err = sendTarget(ctx, out, target)
+				if err != nil {
+					return err
+				}
+				index++
+			}
+		}
+		return nil
+	}, nil
+}
+
+func logEntryTarget(index int64, leaf *ct.LeafEntry) (WarmTarget, error) {
+	entry, err := ct.RawLogEntryFromLeaf(index, leaf)
+	if err != nil {
+		return WarmTarget{}, err
+	}
+	cert, err := x509.ParseCertificate(entry.Cert.Data)
+	if err != nil {
+		return WarmTarget{}, err
+	}
+
+	var issuerCert *x509.Certificate
+	for _, chainCert := range entry.Chain {
+		issuerCert, err = x509.ParseCertificate(chainCert.Data)
+		if err != nil {
+			return WarmTarget{}, err
+		}
+		if !isPrecertSigner(issuerCert) {
+			break
+		}
+	}
+	if issuerCert == nil {
+		return WarmTarget{}, fmt.Errorf("No issuer in the chain")
+	}
+	issuer, err := storage.NewIssuerFromCertificate(issuerCert)
+	if err != nil {
+		return WarmTarget{}, err
+	}
+	serial, err := storage.NewSerialFromBigInt(cert.SerialNumber)
+	if err != nil {
+		return WarmTarget{}, err
+	}
+	return WarmTarget{Issuer: *issuer, IssuerCert: issuerCert, Serial: serial}, nil
+}
+
+func isPrecertSigner(cert *x509.Certificate) bool {
+	for _, usage := range cert.UnknownExtKeyUsage {
+		if usage.Equal(precertSigningUsage) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+)
+
+func (ti testIssuer) leaf(t *testing.T, serial int64) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ti.cert, ti.key.Public(), ti.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func collectTargets(t *testing.T, source WarmSource) ([]WarmTarget, error) {
+	out := make(chan WarmTarget)
+	sourceErr := make(chan error, 1)
+	go func() {
+		sourceErr <- source(context.Background(), out)
+	}()
+	var targets []WarmTarget
+	for target := range out {
+		targets = append(targets, target)
+	}
+	return targets, <-sourceErr
+}
+
+func TestCertificateSource(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	issuer, err := storage.NewIssuerFromCertificate(ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certs bytes.Buffer
+	// The high bit of 0x8badf00d takes a sign byte in DER, but not in requests
+	for _, serial := range []int64{1901, 1902, 0x8badf00d} {
+		_ = pem.Encode(&certs, &pem.Block{Type: "CERTIFICATE", Bytes: ti.leaf(t, serial)})
+	}
+	_ = pem.Encode(&certs, &pem.Block{Type: "PRIVATE KEY", Bytes: []byte("ignored")})
+
+	targets, err := collectTargets(t, CertificateSource(&certs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 {
+		t.Fatalf("Expected 3 targets, got %d", len(targets))
+	}
+	for i, serial := range []string{"076d", "076e", "8badf00d"} {
+		if targets[i].Issuer.String() != issuer.String() || targets[i].Serial.HexString() != serial {
+			t.Errorf("Expected issuer %s serial %s, got %+v", issuer, serial, targets[i])
+		}
+	}
+
+	// One bad certificate doesn't stop the rest
+	var mixed bytes.Buffer
+	_ = pem.Encode(&mixed, &pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")})
+	_ = pem.Encode(&mixed, &pem.Block{Type: "CERTIFICATE", Bytes: ti.leaf(t, 1901)})
+	targets, err = collectTargets(t, CertificateSource(&mixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].Err == nil || targets[1].Err != nil || targets[1].Serial.HexString() != "076d" {
+		t.Errorf("Expected an unreadable target, then serial 076d, got %+v", targets)
+	}
+}
+
+func TestSerialSource(t *testing.T) {
+	t.Parallel()
+	keyId := strings.Repeat("ab", 20)
+	list := "# issuer serial\n\n" + keyId + " 2e\n  " + keyId + "\t00ff  \n"
+
+	targets, err := collectTargets(t, SerialSource(strings.NewReader(list)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(targets))
+	}
+	for i, serial := range []string{"2e", "ff"} {
+		if targets[i].Issuer.String() != keyId || targets[i].Serial.HexString() != serial {
+			t.Errorf("Expected issuer %s serial %s, got %+v", keyId, serial, targets[i])
+		}
+	}
+
+	for _, bad := range []string{"2e", keyId + " 2e extra", "abcd 2e", keyId + " nothex", keyId + " 0"} {
+		_, err := collectTargets(t, SerialSource(strings.NewReader(bad)))
+		if err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+// newTestCTLog serves the chains as the entries of a CT log, one entry per
+// get-entries request.
+func newTestCTLog(t *testing.T, chains [][][]byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ct/v1/get-entries" {
+			http.NotFound(w, r)
+			return
+		}
+		start, err := strconv.Atoi(r.URL.Query().Get("start"))
+		if err != nil || start >= len(chains) {
+			http.Error(w, "bad start", http.StatusBadRequest)
+			return
+		}
+
+		chain := chains[start]
+		leaf := ct.MerkleTreeLeaf{
+			Version:  ct.V1,
+			LeafType: ct.TimestampedEntryLeafType,
+			TimestampedEntry: &ct.TimestampedEntry{
+				Timestamp: uint64(time.Now().Unix() * 1000),
+				EntryType: ct.X509LogEntryType,
+				X509Entry: &ct.ASN1Cert{Data: chain[0]},
+			},
+		}
+		var extra ct.CertificateChain
+		for _, der := range chain[1:] {
+			extra.Entries = append(extra.Entries, ct.ASN1Cert{Data: der})
+		}
+		leafInput, err := cttls.Marshal(leaf)
+		if err != nil {
+			t.Error(err)
+		}
+		extraData, err := cttls.Marshal(extra)
+		if err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(ct.GetEntriesResponse{
+			Entries: []ct.LeafEntry{{LeafInput: leafInput, ExtraData: extraData}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCTLogSource(t *testing.T) {
+	t.Parallel()
+	ti := newTestIssuer(t)
+	issuer, err := storage.NewIssuerFromCertificate(ti.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := newTestCTLog(t, [][][]byte{
+		{ti.leaf(t, 1903), ti.cert.Raw},
+		{ti.leaf(t, 1904), ti.cert.Raw},
+		{ti.leaf(t, 1905), ti.cert.Raw},
+		{ti.leaf(t, 1906)},
+		{ti.leaf(t, 0x8badf00d), ti.cert.Raw},
+	})
+
+	source, err := CTLogSource(log.URL, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := collectTargets(t, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(targets))
+	}
+	for i, serial := range []string{"0770", "0771"} {
+		if targets[i].Issuer.String() != issuer.String() || targets[i].Serial.HexString() != serial {
+			t.Errorf("Expected issuer %s serial %s, got %+v", issuer, serial, targets[i])
+		}
+		if targets[i].IssuerCert == nil || !targets[i].IssuerCert.Equal(ti.cert) {
+			t.Errorf("Expected the issuer's certificate from the chain")
+		}
+	}
+
+	source, err = CTLogSource(log.URL, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err = collectTargets(t, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Serial.HexString() != "8badf00d" {
+		t.Errorf("Expected serial 8badf00d without a sign byte, got %+v", targets)
+	}
+
+	// An entry without a chain doesn't stop the rest
+	source, err = CTLogSource(log.URL, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err = collectTargets(t, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].Err == nil || targets[1].Err != nil || targets[1].Serial.HexString() != "8badf00d" {
+		t.Errorf("Expected an unreadable target, then serial 8badf00d, got %+v", targets)
+	}
+
+	_, err = CTLogSource(log.URL, 2, 1)
+	if err == nil {
+		t.Error("Expected an error for an empty range")
+	}
+}
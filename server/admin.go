@@ -0,0 +1,388 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+// maxPushedResponse bounds the size of responses pushed through the admin API.
+const maxPushedResponse = 1 << 16
+
+// maxWarmList bounds the size of certificate and serial lists posted to warm
+// the cache.
+const maxWarmList = 64 << 20
+
+// AdminAPI lets operators inspect and manage cached responses over HTTP. Every
+// request must carry the token as "Authorization: Bearer <token>". Entries are
+// addressed by issuer key ID and serial, both in hex:
+//
+//	GET    /entries/<issuer>/<serial>          describe the cached response
+//	DELETE /entries/<issuer>/<serial>          purge it
+//	POST   /entries/<issuer>/<serial>/refresh  fetch it again from upstream
+//	DELETE /entries/<issuer>                   purge all of the issuer's
+//	POST   /entries/<issuer>                   cache the DER response in the body
+//	POST   /warm                               start warming the cache
+//	GET    /warm                               report on the warming
+//	DELETE /warm                               stop the warming
+//
+// Only one warming runs at a time. Its targets are the PEM certificates in the
+// body with ?source=pem, the "<issuer> <serial>" lines in the body with
+// ?source=serials, or the entries of a CT log with
+// ?source=ct&log=<url>&start=<index>&end=<index>. The concurrency, rate and
+// force parameters override the configured warming options.
+type AdminAPI struct {
+	logger   blog.Logger
+	store    *repo.OcspStore
+	token    string
+	deadline time.Duration
+
+	warmOpts repo.WarmOptions
+	warmMu   sync.Mutex
+	warm     *warmJob
+}
+
+// warmJob reports on a warming started through the admin API.
+type warmJob struct {
+	Source   string         `json:"source"`
+	Running  bool           `json:"running"`
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Stats    repo.WarmStats `json:"stats"`
+	Error    string         `json:"error,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// NewAdminAPI serves the admin API for the store to holders of the token.
+// Upstream fetches are bounded by deadline.
+func NewAdminAPI(logger blog.Logger, store *repo.OcspStore, token string, deadline time.Duration) (*AdminAPI, error) {
+	if token == "" {
+		return nil, fmt.Errorf("Admin API token must not be empty")
+	}
+	return &AdminAPI{
+		logger:   logger,
+		store:    store,
+		token:    token,
+		deadline: deadline,
+		warmOpts: repo.WarmOptions{Concurrency: 1, Deadline: deadline},
+	}, nil
+}
+
+// SetWarmOptions sets the default options for warmings started through the
+// admin API.
+func (a *AdminAPI) SetWarmOptions(opts repo.WarmOptions) {
+	a.warmOpts = opts
+}
+
+// authorized checks that the request carries the token as a bearer token,
+// answering with a 401 if it doesn't.
+func authorized(response http.ResponseWriter, request *http.Request, token string) bool {
+	auth := request.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		presented := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			return true
+		}
+	}
+	response.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(response, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (a *AdminAPI) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if !authorized(response, request, a.token) {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "warm" {
+		a.handleWarm(response, request)
+		return
+	}
+	if parts[0] != "entries" || len(parts) < 2 || len(parts) > 4 {
+		http.NotFound(response, request)
+		return
+	}
+	issuer, err := storage.NewIssuerFromHexKeyId(parts[1])
+	if err != nil {
+		http.Error(response, fmt.Sprintf("Invalid issuer key ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 2 {
+		a.handleIssuer(response, request, *issuer)
+		return
+	}
+	serial, err := parseHexSerial(parts[2])
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 4 {
+		if parts[3] != "refresh" {
+			http.NotFound(response, request)
+			return
+		}
+		if request.Method != "POST" {
+			methodNotAllowed(response, "POST")
+			return
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), a.deadline)
+		defer cancel()
+		entry, err := a.store.Refresh(ctx, *issuer, serial)
+		a.logger.Infof("Admin refresh of issuer %s serial %s: %v", issuer, serial, err)
+		a.writeEntry(response, entry, err)
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		entry, err := a.store.Lookup(request.Context(), *issuer, serial)
+		a.writeEntry(response, entry, err)
+	case "DELETE":
+		err := a.store.Purge(request.Context(), *issuer, serial)
+		a.logger.Infof("Admin purge of issuer %s serial %s: %v", issuer, serial, err)
+		if err != nil {
+			a.writeError(response, err)
+			return
+		}
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(response, "GET, DELETE")
+	}
+}
+
+func (a *AdminAPI) handleIssuer(response http.ResponseWriter, request *http.Request, issuer storage.Issuer) {
+	switch request.Method {
+	case "POST":
+		rspBytes, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, maxPushedResponse))
+		if err != nil {
+			http.Error(response, fmt.Sprintf("Reading response: %v", err), http.StatusBadRequest)
+			return
+		}
+		entry, err := a.store.Push(request.Context(), issuer, rspBytes)
+		a.logger.Infof("Admin push for issuer %s: %v", issuer, err)
+		a.writeEntry(response, entry, err)
+	case "DELETE":
+		purged, err := a.store.PurgeIssuer(request.Context(), issuer)
+		a.logger.Infof("Admin purge of issuer %s removed %d responses: %v", issuer, purged, err)
+		if err != nil {
+			a.writeError(response, err)
+			return
+		}
+		a.writeJSON(response, map[string]int{"purged": purged})
+	default:
+		methodNotAllowed(response, "POST, DELETE")
+	}
+}
+
+func (a *AdminAPI) handleWarm(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "POST":
+		a.startWarm(response, request)
+	case "GET":
+		a.warmMu.Lock()
+		defer a.warmMu.Unlock()
+		if a.warm == nil {
+			http.Error(response, "No warming has been started", http.StatusNotFound)
+			return
+		}
+		a.writeJSON(response, a.warm)
+	case "DELETE":
+		a.warmMu.Lock()
+		defer a.warmMu.Unlock()
+		if a.warm == nil || !a.warm.Running {
+			http.Error(response, "No warming is running", http.StatusNotFound)
+			return
+		}
+		a.logger.Infof("Admin stopped warming from %s", a.warm.Source)
+		a.warm.cancel()
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(response, "GET, POST, DELETE")
+	}
+}
+
+func (a *AdminAPI) startWarm(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	opts := a.warmOpts
+	var err error
+	if v := query.Get("concurrency"); v != "" {
+		opts.Concurrency, err = strconv.Atoi(v)
+		if err != nil || opts.Concurrency < 1 {
+			http.Error(response, fmt.Sprintf("Invalid concurrency %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("rate"); v != "" {
+		opts.Rate, err = strconv.ParseFloat(v, 64)
+		if err != nil || opts.Rate < 0 {
+			http.Error(response, fmt.Sprintf("Invalid rate %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("force"); v != "" {
+		opts.Force, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(response, fmt.Sprintf("Invalid force %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var source repo.WarmSource
+	var description string
+	switch query.Get("source") {
+	case "pem", "serials":
+		list, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, maxWarmList))
+		if err != nil {
+			http.Error(response, fmt.Sprintf("Reading list: %v", err), http.StatusBadRequest)
+			return
+		}
+		if query.Get("source") == "pem" {
+			source = repo.CertificateSource(bytes.NewReader(list))
+			description = "posted certificates"
+		} else {
+			source = repo.SerialSource(bytes.NewReader(list))
+			description = "posted serials"
+		}
+	case "ct":
+		start, startErr := strconv.ParseInt(query.Get("start"), 10, 64)
+		end, endErr := strconv.ParseInt(query.Get("end"), 10, 64)
+		if startErr != nil || endErr != nil {
+			http.Error(response, "Expected start and end indexes for the CT log", http.StatusBadRequest)
+			return
+		}
+		logURL := query.Get("log")
+		source, err = repo.CTLogSource(logURL, start, end)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		description = fmt.Sprintf("CT log %s entries %d to %d", logURL, start, end)
+	default:
+		http.Error(response, "Expected a source of pem, serials or ct", http.StatusBadRequest)
+		return
+	}
+
+	a.warmMu.Lock()
+	defer a.warmMu.Unlock()
+	if a.warm != nil && a.warm.Running {
+		http.Error(response, "Already warming from "+a.warm.Source, http.StatusConflict)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &warmJob{
+		Source:  description,
+		Running: true,
+		Started: time.Now(),
+		cancel:  cancel,
+	}
+	a.warm = job
+	opts.Progress = func(stats repo.WarmStats) {
+		a.warmMu.Lock()
+		defer a.warmMu.Unlock()
+		job.Stats = stats
+	}
+	a.logger.Infof("Admin started warming from %s", description)
+
+	go func() {
+		defer cancel()
+		stats, err := a.store.Warm(ctx, source, opts)
+		a.logger.Infof("Admin warming from %s read %d, warmed %d, fresh %d, skipped %d, failed %d: %v",
+			description, stats.Read, stats.Warmed, stats.Fresh, stats.Skipped, stats.Failed, err)
+
+		a.warmMu.Lock()
+		defer a.warmMu.Unlock()
+		finished := time.Now()
+		job.Running = false
+		job.Finished = &finished
+		job.Stats = stats
+		if err != nil {
+			job.Error = err.Error()
+		}
+	}()
+
+	writeJSONStatus(a.logger, response, http.StatusAccepted, job)
+}
+
+func (a *AdminAPI) writeEntry(response http.ResponseWriter, entry repo.Entry, err error) {
+	if err != nil {
+		a.writeError(response, err)
+		return
+	}
+	a.writeJSON(response, entry)
+}
+
+func (a *AdminAPI) writeJSON(response http.ResponseWriter, v interface{}) {
+	writeJSON(a.logger, response, v)
+}
+
+func writeJSON(logger blog.Logger, response http.ResponseWriter, v interface{}) {
+	writeJSONStatus(logger, response, http.StatusOK, v)
+}
+
+// writeJSONStatus answers with v in JSON and the status, or with an error if v
+// can't be encoded, which is known before any header is sent.
+func writeJSONStatus(logger blog.Logger, response http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		logger.Warningf("Failure encoding response: %v", err)
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	_, err = response.Write(body)
+	if err != nil {
+		logger.Warningf("Failure writing response: %v", err)
+	}
+}
+
+func (a *AdminAPI) writeError(response http.ResponseWriter, err error) {
+	switch {
+	case err == repo.NotCachedError, err == repo.UnknownIssuerError:
+		http.Error(response, err.Error(), http.StatusNotFound)
+	case err == repo.UpstreamError, err == repo.InvalidResponseError:
+		// From upstream, while refreshing
+		http.Error(response, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, repo.InvalidResponseError):
+		// Pushed responses explain why they were rejected
+		http.Error(response, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		a.logger.Warningf("Admin request failed: %v", err)
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func methodNotAllowed(response http.ResponseWriter, allowed string) {
+	response.Header().Set("Allow", allowed)
+	http.Error(response, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// parseHexSerial reads a serial number in hex, with or without leading zeros,
+// as it appears in cache keys.
+func parseHexSerial(s string) (storage.Serial, error) {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok || n.Sign() <= 0 {
+		return storage.Serial{}, fmt.Errorf("Invalid serial %q, expected positive hex", s)
+	}
+	return storage.NewSerialFromBigInt(n)
+}
@@ -0,0 +1,240 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+const testAdminToken = "let me in"
+
+func adminRequest(api *AdminAPI, method string, path string, body io.Reader) *http.Response {
+	request := httptest.NewRequest(method, path, body)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+func TestNewAdminAPIWithoutToken(t *testing.T) {
+	t.Parallel()
+	_, err := NewAdminAPI(blog.NewMock(), nil, "", time.Second)
+	if err == nil {
+		t.Error("Expected an error without a token")
+	}
+}
+
+func TestAdminAPIUnauthorized(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 46, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	api, err := NewAdminAPI(blog.NewMock(), ocs.store, testAdminToken, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/entries/" + requestIssuer(t, reqBytes)
+	for _, auth := range []string{"", testAdminToken, "Bearer", "Bearer let me", "Basic " + testAdminToken} {
+		request := httptest.NewRequest("DELETE", path, nil)
+		if auth != "" {
+			request.Header.Set("Authorization", auth)
+		}
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected a 401, got %d", auth, recorder.Code)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, rspBytes := newTestFrontEnd(t, 46, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	api, err := NewAdminAPI(blog.NewMock(), ocs.store, testAdminToken, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerPath := "/entries/" + requestIssuer(t, reqBytes)
+	entryPath := issuerPath + "/2e"
+
+	response := adminRequest(api, "GET", entryPath, nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 before caching, got %d", response.StatusCode)
+	}
+
+	ocs.HandleQuery(httptest.NewRecorder(), getRequest(reqBytes, "GET"))
+	response = adminRequest(api, "GET", issuerPath+"/002E", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a 200 once cached, got %d", response.StatusCode)
+	}
+	var entry repo.Entry
+	err = json.NewDecoder(response.Body).Decode(&entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Serial != "2e" || entry.Status != "good" || !entry.Fresh || entry.TTL <= 0 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+
+	response = adminRequest(api, "POST", entryPath+"/refresh", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200 refreshing, got %d", response.StatusCode)
+	}
+
+	response = adminRequest(api, "DELETE", entryPath, nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected a 204 purging, got %d", response.StatusCode)
+	}
+	response = adminRequest(api, "GET", entryPath, nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 after purging, got %d", response.StatusCode)
+	}
+
+	response = adminRequest(api, "POST", issuerPath, bytes.NewReader(rspBytes))
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200 pushing, got %d", response.StatusCode)
+	}
+	response = adminRequest(api, "POST", issuerPath, bytes.NewReader([]byte("garbage")))
+	if response.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a 422 pushing garbage, got %d", response.StatusCode)
+	}
+
+	response = adminRequest(api, "DELETE", issuerPath, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a 200 purging the issuer, got %d", response.StatusCode)
+	}
+	var purged map[string]int
+	err = json.NewDecoder(response.Body).Decode(&purged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged["purged"] != 1 {
+		t.Errorf("Expected the pushed response to be purged, got %+v", purged)
+	}
+}
+
+func TestAdminAPIBadRequests(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 47, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	api, err := NewAdminAPI(blog.NewMock(), ocs.store, testAdminToken, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerPath := "/entries/" + requestIssuer(t, reqBytes)
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{"GET", "/", http.StatusNotFound},
+		{"GET", "/entries", http.StatusNotFound},
+		{"GET", "/entries/nothex", http.StatusBadRequest},
+		{"GET", "/entries/abcd", http.StatusBadRequest},
+		{"GET", issuerPath + "/nothex", http.StatusBadRequest},
+		{"GET", issuerPath + "/0", http.StatusBadRequest},
+		{"GET", issuerPath + "/2f/purge", http.StatusNotFound},
+		{"GET", issuerPath + "/2f/refresh", http.StatusMethodNotAllowed},
+		{"PUT", issuerPath + "/2f", http.StatusMethodNotAllowed},
+		{"GET", issuerPath, http.StatusMethodNotAllowed},
+		{"POST", "/entries/0000000000000000000000000000000000000000", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		response := adminRequest(api, tt.method, tt.path, bytes.NewReader(nil))
+		if response.StatusCode != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.expected, response.StatusCode)
+		}
+	}
+}
+
+func TestAdminAPIWarm(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 48, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	api, err := NewAdminAPI(blog.NewMock(), ocs.store, testAdminToken, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := adminRequest(api, "GET", "/warm", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 before warming, got %d", response.StatusCode)
+	}
+	response = adminRequest(api, "DELETE", "/warm", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 stopping without warming, got %d", response.StatusCode)
+	}
+
+	// Without the issuer's certificate, only cached serials can be warmed
+	ocs.HandleQuery(httptest.NewRecorder(), getRequest(reqBytes, "GET"))
+	list := "# issuer serial\n" + requestIssuer(t, reqBytes) + " 30\n"
+	response = adminRequest(api, "POST", "/warm?source=serials&force=true&rate=100", bytes.NewReader([]byte(list)))
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected a 202 starting to warm, got %d", response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected the 202 in JSON, got %q", contentType)
+	}
+
+	var job warmJob
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		response = adminRequest(api, "GET", "/warm", nil)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected a 200 reporting on warming, got %d", response.StatusCode)
+		}
+		err = json.NewDecoder(response.Body).Decode(&job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !job.Running {
+			break
+		}
+	}
+	if job.Running || job.Finished == nil || job.Error != "" {
+		t.Fatalf("Expected warming to finish, got %+v", job)
+	}
+	expected := repo.WarmStats{Read: 1, Warmed: 1}
+	if job.Stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, job.Stats)
+	}
+}
+
+func TestAdminAPIWarmBadRequests(t *testing.T) {
+	t.Parallel()
+	ocs, _, _ := newTestFrontEnd(t, 49, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	api, err := NewAdminAPI(blog.NewMock(), ocs.store, testAdminToken, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{"PUT", "/warm", http.StatusMethodNotAllowed},
+		{"POST", "/warm", http.StatusBadRequest},
+		{"POST", "/warm?source=zone", http.StatusBadRequest},
+		{"POST", "/warm?source=pem&concurrency=0", http.StatusBadRequest},
+		{"POST", "/warm?source=pem&rate=fast", http.StatusBadRequest},
+		{"POST", "/warm?source=pem&force=please", http.StatusBadRequest},
+		{"POST", "/warm?source=ct&log=http://ct.example", http.StatusBadRequest},
+		{"POST", "/warm?source=ct&log=http://ct.example&start=10&end=1", http.StatusBadRequest},
+		{"GET", "/warm/now", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		response := adminRequest(api, tt.method, tt.path, bytes.NewReader(nil))
+		if response.StatusCode != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.expected, response.StatusCode)
+		}
+	}
+}
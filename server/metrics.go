@@ -0,0 +1,45 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of OCSP requests, as counted in the requests metric.
+const (
+	outcomeOK               = "ok"
+	outcomeNotModified      = "not_modified"
+	outcomeMalformed        = "malformed"
+	outcomeMethodNotAllowed = "method_not_allowed"
+	outcomeUnknownIssuer    = "unknown_issuer"
+	outcomeUpstreamError    = "upstream_error"
+	outcomeInvalidResponse  = "invalid_response"
+	outcomeError            = "error"
+)
+
+var (
+	requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_requests_total",
+		Help: "OCSP requests by method, outcome and issuer key ID, which is empty for requests that couldn't be parsed or whose issuer isn't configured.",
+	}, []string{"method", "outcome", "issuer"})
+
+	responseSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ocsp_l2_cache_response_size_bytes",
+		Help:    "Sizes of the OCSP responses served.",
+		Buckets: prometheus.ExponentialBuckets(128, 2, 8),
+	})
+)
+
+// methodLabel limits the method label to the methods that are served, so
+// that arbitrary methods can't each add a time series.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST":
+		return method
+	}
+	return "other"
+}
@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+// defaultPopularLimit is how many serials are listed unless asked otherwise.
+const defaultPopularLimit = 100
+
+// PopularityAPI reports how often serials were requested from this replica, to
+// clients presenting the token as "Authorization: Bearer <token>":
+//
+//	GET ?limit=<n>                          the most requested serials
+//	GET ?issuer=<issuer>&serial=<serial>    one serial, both in hex
+//
+// Counts aren't shared between replicas: behind a load balancer, each one
+// reports only the share of the traffic it was sent.
+type PopularityAPI struct {
+	logger blog.Logger
+	store  *repo.OcspStore
+	token  string
+}
+
+// NewPopularityAPI serves the store's popularity to holders of the token.
+func NewPopularityAPI(logger blog.Logger, store *repo.OcspStore, token string) (*PopularityAPI, error) {
+	if token == "" {
+		return nil, fmt.Errorf("Popularity API token must not be empty")
+	}
+	return &PopularityAPI{logger, store, token}, nil
+}
+
+func (p *PopularityAPI) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if !authorized(response, request, p.token) {
+		return
+	}
+	if request.Method != "GET" {
+		methodNotAllowed(response, "GET")
+		return
+	}
+
+	query := request.URL.Query()
+	if query.Get("issuer") != "" || query.Get("serial") != "" {
+		issuer, err := storage.NewIssuerFromHexKeyId(query.Get("issuer"))
+		if err != nil {
+			http.Error(response, fmt.Sprintf("Invalid issuer key ID: %v", err), http.StatusBadRequest)
+			return
+		}
+		serial, err := parseHexSerial(query.Get("serial"))
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(p.logger, response, p.store.Popularity(*issuer, serial))
+		return
+	}
+
+	limit := defaultPopularLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(response, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(p.logger, response, map[string][]repo.Popularity{"serials": p.store.PopularSerials(limit)})
+}
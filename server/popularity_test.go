@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+func popularityRequest(api *PopularityAPI, method string, path string) *http.Response {
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+func TestPopularityAPI(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 50, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	_, err := NewPopularityAPI(blog.NewMock(), ocs.store, "")
+	if err == nil {
+		t.Error("Expected an error without a token")
+	}
+	api, err := NewPopularityAPI(blog.NewMock(), ocs.store, testAdminToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ocs.HandleQuery(httptest.NewRecorder(), getRequest(reqBytes, "GET"))
+	}
+	issuer := requestIssuer(t, reqBytes)
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", "/popularity", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 without the token, got %d", recorder.Code)
+	}
+
+	response := popularityRequest(api, "GET", "/popularity?limit=10")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a 200, got %d", response.StatusCode)
+	}
+	var list map[string][]repo.Popularity
+	err = json.NewDecoder(response.Body).Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serials := list["serials"]
+	if len(serials) != 1 || serials[0].Issuer != issuer || serials[0].Serial != "32" || serials[0].Count != 2 || serials[0].LastAccess == nil {
+		t.Errorf("Unexpected popular serials %+v", serials)
+	}
+
+	response = popularityRequest(api, "GET", "/popularity?issuer="+issuer+"&serial=32")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a 200, got %d", response.StatusCode)
+	}
+	var one repo.Popularity
+	err = json.NewDecoder(response.Body).Decode(&one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one.Count != 2 {
+		t.Errorf("Unexpected popularity %+v", one)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{"POST", "/popularity", http.StatusMethodNotAllowed},
+		{"GET", "/popularity?limit=0", http.StatusBadRequest},
+		{"GET", "/popularity?issuer=abcd&serial=32", http.StatusBadRequest},
+		{"GET", "/popularity?issuer=" + issuer, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		response := popularityRequest(api, tt.method, tt.path)
+		if response.StatusCode != tt.expected {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.expected, response.StatusCode)
+		}
+	}
+}
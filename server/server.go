@@ -11,10 +11,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jcjones/ocsp-l2-cache/common"
 	"github.com/jcjones/ocsp-l2-cache/repo"
+	"github.com/jcjones/ocsp-l2-cache/storage"
 	"golang.org/x/crypto/ocsp"
 
 	blog "github.com/letsencrypt/boulder/log"
@@ -22,11 +25,11 @@ import (
 
 type OcspFrontEnd struct {
 	logger   blog.Logger
-	store    repo.OcspStore
+	store    *repo.OcspStore
 	deadline time.Duration
 }
 
-func NewOcspFrontEnd(logger blog.Logger, store repo.OcspStore, deadline time.Duration) (*OcspFrontEnd, error) {
+func NewOcspFrontEnd(logger blog.Logger, store *repo.OcspStore, deadline time.Duration) (*OcspFrontEnd, error) {
 	return &OcspFrontEnd{logger, store, deadline}, nil
 }
 
@@ -34,6 +37,11 @@ func (ocs *OcspFrontEnd) HandleQuery(response http.ResponseWriter, request *http
 	ctx, cancelFunc := context.WithTimeout(context.Background(), ocs.deadline)
 	defer cancelFunc()
 
+	outcome, issuer := outcomeError, ""
+	defer func() {
+		requestCount.WithLabelValues(methodLabel(request.Method), outcome, issuer).Inc()
+	}()
+
 	// By default we set a 'max-age=0, no-cache' Cache-Control header, this
 	// is only returned to the client if a valid authorized OCSP response
 	// is not found or an error is returned. If a response if found the header
@@ -46,9 +54,10 @@ func (ocs *OcspFrontEnd) HandleQuery(response http.ResponseWriter, request *http
 	var err error
 
 	switch request.Method {
-	case "GET":
+	case "GET", "HEAD":
 		base64Request, err := url.QueryUnescape(request.URL.Path)
 		if err != nil {
+			outcome = outcomeMalformed
 			response.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -71,16 +80,19 @@ func (ocs *OcspFrontEnd) HandleQuery(response http.ResponseWriter, request *http
 		}
 		requestBody, err = base64.StdEncoding.DecodeString(string(base64RequestBytes))
 		if err != nil {
+			outcome = outcomeMalformed
 			ocs.malformedRequest(response)
 			return
 		}
 	case "POST":
 		requestBody, err = ioutil.ReadAll(http.MaxBytesReader(nil, request.Body, 10000))
 		if err != nil {
+			outcome = outcomeMalformed
 			ocs.malformedRequest(response)
 			return
 		}
 	default:
+		outcome = outcomeMethodNotAllowed
 		response.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -88,18 +100,30 @@ func (ocs *OcspFrontEnd) HandleQuery(response http.ResponseWriter, request *http
 	req, err := ocsp.ParseRequest(requestBody)
 	if err != nil {
 		ocs.logger.Debugf("Unable to parse: %v\n%s", err, hex.Dump(requestBody))
+		outcome = outcomeMalformed
 		ocs.malformedRequest(response)
 		return
 	}
 
 	responseBody, headers, err := ocs.store.Get(ctx, req, requestBody)
+	if err == repo.UnknownIssuerError {
+		ocs.logger.Debugf("Unknown issuer: %s {%+v}", req.IssuerKeyHash, req)
+		outcome = outcomeUnknownIssuer
+		ocs.unknownIssuer(response)
+		return
+	}
+	// Only configured issuers are labelled, so that requests for arbitrary
+	// ones can't each add a time series
+	issuer = storage.NewIssuerFromRequest(req).String()
 	if err == repo.UpstreamError {
 		ocs.logger.Errf("Upstream error: %s {%+v}", err, req)
+		outcome = outcomeUpstreamError
 		ocs.upstreamError(response)
 		return
-	} else if err == repo.UnknownIssuerError {
-		ocs.logger.Debugf("Unknown issuer: %s {%+v}", req.IssuerKeyHash, req)
-		ocs.unknownIssuer(response)
+	} else if err == repo.InvalidResponseError {
+		ocs.logger.Errf("Invalid upstream response: %s {%+v}", err, req)
+		outcome = outcomeInvalidResponse
+		ocs.invalidResponse(response)
 		return
 	} else if err != nil {
 		ocs.logger.Debugf("Unable to obtain response: %v", err)
@@ -111,12 +135,60 @@ func (ocs *OcspFrontEnd) HandleQuery(response http.ResponseWriter, request *http
 		response.Header().Set(k, v)
 	}
 
+	if request.Method != "POST" && notModified(request, headers) {
+		outcome = outcomeNotModified
+		response.Header().Del(common.HeaderContentType)
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	outcome = outcomeOK
+	if request.Method == "HEAD" {
+		response.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+
+	responseSize.Observe(float64(len(responseBody)))
+
 	_, err = response.Write(responseBody)
 	if err != nil {
 		ocs.logger.Warningf("Failure writing response body: %v", err)
 	}
 }
 
+// notModified evaluates the request's If-None-Match against the response's
+// ETag, or failing that its If-Modified-Since against the Last-Modified, as
+// RFC 7232 describes.
+func notModified(request *http.Request, headers map[string]string) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag, ok := headers[common.HeaderETag]
+		return ok && etagListMatches(ifNoneMatch, etag)
+	}
+
+	ifModifiedSince, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(headers[common.HeaderLastModified])
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// etagListMatches reports whether any entity tag in the list, or "*", matches
+// etag under the weak comparison used for If-None-Match.
+func etagListMatches(list string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (ocs *OcspFrontEnd) malformedRequest(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusBadRequest)
 	_, err := w.Write(ocsp.MalformedRequestErrorResponse)
@@ -140,3 +212,11 @@ func (ocs *OcspFrontEnd) upstreamError(w http.ResponseWriter) {
 		ocs.logger.Warningf("Failure writing upstreamError error: %v", err)
 	}
 }
+
+func (ocs *OcspFrontEnd) invalidResponse(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadGateway)
+	_, err := w.Write(ocsp.InternalErrorErrorResponse)
+	if err != nil {
+		ocs.logger.Warningf("Failure writing invalidResponse error: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/common"
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	"github.com/jcjones/ocsp-l2-cache/storage"
+	blog "github.com/letsencrypt/boulder/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestFrontEnd returns a front end whose only issuer's upstream answers
+// every request with a response for serial, valid from thisUpdate to
+// nextUpdate, along with a POST body requesting it.
+func newTestFrontEnd(t *testing.T, serial int64, thisUpdate time.Time, nextUpdate time.Time) (*OcspFrontEnd, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqBytes, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: big.NewInt(serial)}, issuerCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := ocsp.ParseRequest(reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rspBytes, err := ocsp.CreateResponse(issuerCert, issuerCert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(serial),
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(common.HeaderContentType, common.MimeOcspResponse)
+		w.Header().Set(common.HeaderCacheControl, "max-age=3600")
+		w.Header().Set(common.HeaderETag, "\"etag\"")
+		w.Header().Set(common.HeaderLastModified, thisUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set(common.HeaderExpires, nextUpdate.UTC().Format(http.TimeFormat))
+		_, _ = w.Write(rspBytes)
+	}))
+	t.Cleanup(upstream.Close)
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf, err := fetcher.NewUpstreamFetcher(*u, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := repo.NewOcspStore(blog.NewMock(), storage.NewMockRemoteCache(), repo.NewTTLPolicy(repo.TTLRule{Fraction: repo.DefaultTTLFraction, MaxLife: 24 * time.Hour, MinLife: time.Hour}))
+	err = store.AddFetcherForIssuer(storage.NewIssuerFromRequest(req), uf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ocs, err := NewOcspFrontEnd(blog.NewMock(), store, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ocs, reqBytes, rspBytes
+}
+
+func TestQueryPost(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, rspBytes := newTestFrontEnd(t, 42, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+
+	recorder := httptest.NewRecorder()
+	ocs.HandleQuery(recorder, httptest.NewRequest("POST", "/", bytes.NewReader(reqBytes)))
+	response := recorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200, got %+v", response)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, rspBytes) {
+		t.Error("Expected the upstream's response")
+	}
+}
+
+func TestQueryInvalidUpstreamResponse(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 42, time.Now().Add(-72*time.Hour), time.Now().Add(-time.Hour))
+
+	recorder := httptest.NewRecorder()
+	ocs.HandleQuery(recorder, httptest.NewRequest("POST", "/", bytes.NewReader(reqBytes)))
+	response := recorder.Result()
+
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a 502 for an expired upstream response, got %+v", response)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, ocsp.InternalErrorErrorResponse) {
+		t.Errorf("Expected an OCSP internal error, got %x", body)
+	}
+	if count := testutil.ToFloat64(requestCount.WithLabelValues("POST", outcomeInvalidResponse, requestIssuer(t, reqBytes))); count != 1 {
+		t.Errorf("Expected the invalid response to be counted, got %f", count)
+	}
+}
+
+func getRequest(reqBytes []byte, method string) *http.Request {
+	return httptest.NewRequest(method, "/"+url.PathEscape(base64.StdEncoding.EncodeToString(reqBytes)), nil)
+}
+
+func TestQueryGetAndHead(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, rspBytes := newTestFrontEnd(t, 43, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+
+	recorder := httptest.NewRecorder()
+	ocs.HandleQuery(recorder, getRequest(reqBytes, "GET"))
+	response := recorder.Result()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || !bytes.Equal(body, rspBytes) {
+		t.Errorf("Expected the upstream's response, got %+v", response)
+	}
+
+	recorder = httptest.NewRecorder()
+	ocs.HandleQuery(recorder, getRequest(reqBytes, "HEAD"))
+	head := recorder.Result()
+	body, err = ioutil.ReadAll(head.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Errorf("Expected a bodiless 200, got %+v", head)
+	}
+	if head.Header.Get("Content-Length") != strconv.Itoa(len(rspBytes)) {
+		t.Errorf("Expected a Content-Length of %d, got %s", len(rspBytes), head.Header.Get("Content-Length"))
+	}
+	if head.Header.Get(common.HeaderETag) != response.Header.Get(common.HeaderETag) {
+		t.Errorf("Expected the same headers as for GET, got %+v", head.Header)
+	}
+}
+
+func TestQueryConditional(t *testing.T) {
+	t.Parallel()
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ocs, reqBytes, _ := newTestFrontEnd(t, 44, thisUpdate, time.Now().Add(72*time.Hour))
+
+	recorder := httptest.NewRecorder()
+	ocs.HandleQuery(recorder, getRequest(reqBytes, "GET"))
+	etag := recorder.Result().Header.Get(common.HeaderETag)
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+
+	before := thisUpdate.Add(-time.Minute).UTC().Format(http.TimeFormat)
+	after := thisUpdate.Add(time.Minute).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		method   string
+		headers  map[string]string
+		expected int
+	}{
+		{"GET", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"GET", map[string]string{"If-Modified-Since": after}, http.StatusNotModified},
+		{"GET", map[string]string{"If-Modified-Since": before}, http.StatusOK},
+		{"GET", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		// If-None-Match takes precedence
+		{"GET", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, http.StatusOK},
+		{"HEAD", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"POST", map[string]string{"If-None-Match": etag}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		request := getRequest(reqBytes, tt.method)
+		if tt.method == "POST" {
+			request = httptest.NewRequest("POST", "/", bytes.NewReader(reqBytes))
+		}
+		for k, v := range tt.headers {
+			request.Header.Set(k, v)
+		}
+
+		recorder := httptest.NewRecorder()
+		ocs.HandleQuery(recorder, request)
+		response := recorder.Result()
+		if response.StatusCode != tt.expected {
+			t.Errorf("%s %+v: expected %d, got %d", tt.method, tt.headers, tt.expected, response.StatusCode)
+		}
+		if response.StatusCode == http.StatusNotModified {
+			body, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body) != 0 || response.Header.Get(common.HeaderETag) != etag || response.Header.Get(common.HeaderCacheControl) == "" {
+				t.Errorf("%s %+v: expected a bodiless 304 with caching headers, got %+v", tt.method, tt.headers, response.Header)
+			}
+		}
+	}
+}
+
+// requestIssuer returns the issuer label of the OCSP request.
+func requestIssuer(t *testing.T, reqBytes []byte) string {
+	req, err := ocsp.ParseRequest(reqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage.NewIssuerFromRequest(req).String()
+}
+
+func TestQueryMetrics(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 45, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	issuer := requestIssuer(t, reqBytes)
+
+	recorder := httptest.NewRecorder()
+	ocs.HandleQuery(recorder, getRequest(reqBytes, "GET"))
+	etag := recorder.Result().Header.Get(common.HeaderETag)
+	ocs.HandleQuery(httptest.NewRecorder(), getRequest(reqBytes, "HEAD"))
+	ocs.HandleQuery(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewReader(reqBytes)))
+	conditional := getRequest(reqBytes, "GET")
+	conditional.Header.Set("If-None-Match", etag)
+	ocs.HandleQuery(httptest.NewRecorder(), conditional)
+
+	notAllowed := testutil.ToFloat64(requestCount.WithLabelValues("other", outcomeMethodNotAllowed, ""))
+	ocs.HandleQuery(httptest.NewRecorder(), getRequest(reqBytes, "PUT"))
+
+	tests := []struct {
+		method   string
+		outcome  string
+		issuer   string
+		expected float64
+	}{
+		{"GET", outcomeOK, issuer, 1},
+		{"HEAD", outcomeOK, issuer, 1},
+		{"POST", outcomeOK, issuer, 1},
+		{"GET", outcomeNotModified, issuer, 1},
+		{"other", outcomeMethodNotAllowed, "", notAllowed + 1},
+	}
+	for _, tt := range tests {
+		count := testutil.ToFloat64(requestCount.WithLabelValues(tt.method, tt.outcome, tt.issuer))
+		if count != tt.expected {
+			t.Errorf("%s %s: expected a count of %f, got %f", tt.method, tt.outcome, tt.expected, count)
+		}
+	}
+}
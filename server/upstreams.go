@@ -0,0 +1,34 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+	"github.com/jcjones/ocsp-l2-cache/repo"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+// UpstreamsHandler reports the health of each issuer's upstream responders,
+// as JSON keyed by issuer, on GET.
+type UpstreamsHandler struct {
+	logger blog.Logger
+	store  *repo.OcspStore
+}
+
+func NewUpstreamsHandler(logger blog.Logger, store *repo.OcspStore) *UpstreamsHandler {
+	return &UpstreamsHandler{logger, store}
+}
+
+func (u *UpstreamsHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		methodNotAllowed(response, "GET")
+		return
+	}
+	writeJSON(u.logger, response, map[string]map[string][]fetcher.EndpointStatus{
+		"issuers": u.store.UpstreamStatus(),
+	})
+}
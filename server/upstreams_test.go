@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jcjones/ocsp-l2-cache/fetcher"
+	blog "github.com/letsencrypt/boulder/log"
+)
+
+func TestUpstreamsHandler(t *testing.T) {
+	t.Parallel()
+	ocs, reqBytes, _ := newTestFrontEnd(t, 51, time.Now().Add(-time.Hour), time.Now().Add(72*time.Hour))
+	handler := NewUpstreamsHandler(blog.NewMock(), ocs.store)
+	ocs.HandleQuery(httptest.NewRecorder(), getRequest(reqBytes, "GET"))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/upstreams", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %d", recorder.Code)
+	}
+	var status map[string]map[string][]fetcher.EndpointStatus
+	err := json.NewDecoder(recorder.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := status["issuers"][requestIssuer(t, reqBytes)]
+	if len(endpoints) != 1 || !endpoints[0].Healthy || endpoints[0].LastSuccess == nil || endpoints[0].URL == "" {
+		t.Errorf("Unexpected upstream status %+v", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/upstreams", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a 405 for POST, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// invalidationChannel is the Redis channel replicas announce changed
+// responses on.
+const invalidationChannel = "ocsp-l2-cache/invalidations"
+
+// InvalidationBus carries messages between the replicas sharing a cache, so
+// that they can tell each other which responses changed. Messages may be lost,
+// such as while a replica reconnects.
+type InvalidationBus interface {
+	PublishInvalidation(ctx context.Context, message string) error
+	// SubscribeInvalidations returns the messages published from now on, until
+	// the context is done, when the channel is closed.
+	SubscribeInvalidations(ctx context.Context) (<-chan string, error)
+}
+
+func (rc *RedisCache) PublishInvalidation(ctx context.Context, message string) error {
+	defer observeRedis("publish", time.Now())
+	return rc.client.Publish(ctx, invalidationChannel, message).Err()
+}
+
+func (rc *RedisCache) SubscribeInvalidations(ctx context.Context) (<-chan string, error) {
+	pubsub := rc.client.Subscribe(ctx, invalidationChannel)
+	// Wait for the subscription to be confirmed, so that nothing published
+	// after this returns is missed
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		_ = pubsub.Close()
+		return nil, DescribeRedisError(err)
+	}
+
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case out <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,58 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Cached responses are stored under ResponseKeyPrefix + issuer key ID in hex
+// + "/" + serial in hex. Serials alone collide across issuers, so both are
+// needed. Hex keeps the keys printable and free of glob metacharacters.
+const (
+	ResponseKeyVersion = "v1"
+	ResponseKeyPrefix  = "ocsp/" + ResponseKeyVersion + "/"
+	// AllResponsesPattern matches every response key, for KeysToChan.
+	AllResponsesPattern = ResponseKeyPrefix + "*"
+)
+
+// ResponseKey returns the cache key for an issuer's response for a serial.
+func ResponseKey(issuer Issuer, serial Serial) string {
+	return ResponseKeyPrefix + issuer.String() + "/" + serial.HexString()
+}
+
+// IssuerResponsesPattern matches the keys of all of an issuer's responses,
+// for KeysToChan.
+func IssuerResponsesPattern(issuer Issuer) string {
+	return ResponseKeyPrefix + issuer.String() + "/*"
+}
+
+// ParseResponseKey returns the issuer and serial a response key is for.
+func ParseResponseKey(key string) (Issuer, Serial, error) {
+	if !strings.HasPrefix(key, ResponseKeyPrefix) {
+		return Issuer{}, Serial{}, fmt.Errorf("not a %s response key: %q", ResponseKeyVersion, key)
+	}
+	parts := strings.Split(strings.TrimPrefix(key, ResponseKeyPrefix), "/")
+	if len(parts) != 2 {
+		return Issuer{}, Serial{}, fmt.Errorf("malformed response key: %q", key)
+	}
+	issuer, err := NewIssuerFromHexKeyId(parts[0])
+	if err != nil {
+		return Issuer{}, Serial{}, fmt.Errorf("malformed issuer in response key %q: %v", key, err)
+	}
+	serialBytes, err := hex.DecodeString(parts[1])
+	if err != nil || len(serialBytes) == 0 {
+		return Issuer{}, Serial{}, fmt.Errorf("malformed serial in response key %q", key)
+	}
+	return *issuer, NewSerialFromBytes(serialBytes), nil
+}
+
+// LegacyResponseKey returns the key responses were stored under before the
+// key schema was versioned: the serial's raw bytes, without the issuer.
+func LegacyResponseKey(serial Serial) string {
+	return serial.BinaryString()
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storage
+
+import (
+	"testing"
+)
+
+func keyMatches(t *testing.T, pattern string, key string) bool {
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re.MatchString(key)
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		pattern, key string
+		matches      bool
+	}{
+		{"*", "lease/a/b", true},
+		{"ocsp/*", "ocsp/v1/a/b", true},
+		{"ocsp/*", "lease/a", false},
+		{"a?c", "abc", true},
+		{"a?c", "a/c", true},
+		{"a?c", "abbc", false},
+		{"h[ae]llo", "hello", true},
+		{"h[^e]llo", "hello", false},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"a.b", "axb", false},
+		{"*", "\x00\xff", true},
+	}
+	for _, tc := range cases {
+		if keyMatches(t, tc.pattern, tc.key) != tc.matches {
+			t.Errorf("Pattern %q against %q: expected %v", tc.pattern, tc.key, tc.matches)
+		}
+	}
+}
+
+func TestResponseKeyRoundTrip(t *testing.T) {
+	t.Parallel()
+	issuer, err := NewIssuerFromHexKeyId("a84a6a63047dddbae6d139b7a64565eff3a8eca1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := NewSerialFromHex("0300fe2f6c2ac6ca12c9b0aad1c5f86c5e15")
+
+	key := ResponseKey(*issuer, serial)
+	if key != "ocsp/v1/a84a6a63047dddbae6d139b7a64565eff3a8eca1/0300fe2f6c2ac6ca12c9b0aad1c5f86c5e15" {
+		t.Errorf("Unexpected key %s", key)
+	}
+
+	parsedIssuer, parsedSerial, err := ParseResponseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedIssuer.String() != issuer.String() || parsedSerial.Cmp(serial) != 0 {
+		t.Errorf("Expected %s %s, got %s %s", issuer, serial, parsedIssuer, parsedSerial)
+	}
+
+	for _, pattern := range []string{AllResponsesPattern, IssuerResponsesPattern(*issuer)} {
+		if !keyMatches(t, pattern, key) {
+			t.Errorf("Pattern %s should match %s", pattern, key)
+		}
+	}
+	other, err := NewIssuerFromHexKeyId("c5b1ab4e4cb1cd6430937ec1849905abe603e225")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyMatches(t, IssuerResponsesPattern(*other), key) {
+		t.Errorf("Another issuer's pattern should not match %s", key)
+	}
+}
+
+func TestParseResponseKeyErrors(t *testing.T) {
+	t.Parallel()
+	for _, key := range []string{
+		LegacyResponseKey(NewSerialFromHex("0a0b")),
+		"ocsp/v0/a84a6a63047dddbae6d139b7a64565eff3a8eca1/0a0b",
+		"ocsp/v1/a84a6a63047dddbae6d139b7a64565eff3a8eca1",
+		"ocsp/v1/a84a6a63047dddbae6d139b7a64565eff3a8eca1/",
+		"ocsp/v1/a84a6a63047dddbae6d139b7a64565eff3a8eca1/zz",
+		"ocsp/v1/a84a/0a0b",
+		"ocsp/v1/a84a6a63047dddbae6d139b7a64565eff3a8eca1/0a0b/0c",
+	} {
+		if _, _, err := ParseResponseKey(key); err == nil {
+			t.Errorf("Expected an error parsing %q", key)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryCache is a size-bounded, least-recently-used in-process cache in front
+// of another RemoteCache. Only response keys are kept in memory; everything
+// else, like fetch leases, must stay consistent across replicas and always
+// goes to the inner cache. Writes go through to the inner cache.
+type MemoryCache struct {
+	inner      RemoteCache
+	maxEntries int
+	maxLife    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   MemoryCacheStats
+	// writes counts changes to keys, so that a value read from the inner cache
+	// isn't stored if it may have been replaced in the meantime
+	writes uint64
+
+	// bus, if set, announces changed responses to other replicas, tagged with
+	// id so that our own announcements are ignored
+	bus InvalidationBus
+	id  string
+}
+
+type memoryEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// MemoryCacheStats counts lookups of response keys in memory (L1) and in the
+// inner cache (L2), which is only consulted after an L1 miss.
+type MemoryCacheStats struct {
+	Entries     int
+	L1Hits      uint64
+	L1Misses    uint64
+	L2Hits      uint64
+	L2Misses    uint64
+	Evictions   uint64
+	Expirations uint64
+}
+
+// NewMemoryCache keeps up to maxEntries responses from inner in memory. They
+// are dropped when they expire in the inner cache, or after maxLife if that is
+// set and sooner. A short maxLife bounds how long other replicas' writes go
+// unnoticed.
+func NewMemoryCache(inner RemoteCache, maxEntries int, maxLife time.Duration) (*MemoryCache, error) {
+	if inner == nil {
+		return nil, fmt.Errorf("Inner cache must not be nil")
+	}
+	if maxEntries < 1 {
+		return nil, fmt.Errorf("Memory cache must hold at least one entry")
+	}
+	return &MemoryCache{
+		inner:      inner,
+		maxEntries: maxEntries,
+		maxLife:    maxLife,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}, nil
+}
+
+// ShareInvalidations announces the responses this replica changes on the bus,
+// and drops those other replicas announce from memory, until the context is
+// done. Announcements lost on the way leave stale responses in memory until
+// maxLife. Call it before the cache is in use.
+func (mc *MemoryCache) ShareInvalidations(ctx context.Context, bus InvalidationBus) error {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	messages, err := bus.SubscribeInvalidations(ctx)
+	if err != nil {
+		return err
+	}
+	mc.bus = bus
+	mc.id = hex.EncodeToString(nonce)
+
+	go func() {
+		for message := range messages {
+			parts := strings.SplitN(message, " ", 2)
+			if len(parts) != 2 || parts[0] == mc.id {
+				continue
+			}
+			cacheInvalidations.WithLabelValues("received").Inc()
+			mc.forget(parts[1])
+		}
+	}()
+	return nil
+}
+
+// announce tells other replicas that the key changed, if it is kept in
+// memory. Failing only delays them, so it isn't an error of the write.
+func (mc *MemoryCache) announce(ctx context.Context, key string) {
+	if mc.bus == nil || !cachedInMemory(key) {
+		return
+	}
+	err := mc.bus.PublishInvalidation(ctx, mc.id+" "+key)
+	if err != nil {
+		cacheInvalidations.WithLabelValues("failed").Inc()
+		return
+	}
+	cacheInvalidations.WithLabelValues("sent").Inc()
+}
+
+func cachedInMemory(key string) bool {
+	return strings.HasPrefix(key, ResponseKeyPrefix)
+}
+
+func (mc *MemoryCache) lookup(key string, now time.Time) (string, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	elem, ok := mc.entries[key]
+	if !ok {
+		mc.stats.L1Misses++
+		return "", false
+	}
+	entry := elem.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && !now.Before(entry.expires) {
+		mc.removeElement(elem)
+		mc.stats.Expirations++
+		mc.stats.L1Misses++
+		return "", false
+	}
+	mc.lru.MoveToFront(elem)
+	mc.stats.L1Hits++
+	return entry.value, true
+}
+
+func (mc *MemoryCache) writeCount() uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.writes
+}
+
+// store keeps value in memory until it would expire after life in the inner
+// cache, or maxLife, whichever is sooner. If the write count no longer matches
+// writesSeen, the value may be outdated, so the key is dropped instead. Values
+// just written to the inner cache count as a write themselves.
+func (mc *MemoryCache) store(key string, value string, life time.Duration, now time.Time, writesSeen uint64, isWrite bool) {
+	if life == NO_EXPIRATION || (mc.maxLife > 0 && life > mc.maxLife) {
+		life = mc.maxLife
+	}
+	var expires time.Time
+	if life > 0 {
+		expires = now.Add(life)
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.writes != writesSeen {
+		mc.writes++
+		if elem, ok := mc.entries[key]; ok {
+			mc.removeElement(elem)
+		}
+		return
+	}
+	if isWrite {
+		mc.writes++
+	}
+	if elem, ok := mc.entries[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		entry.value = value
+		entry.expires = expires
+		mc.lru.MoveToFront(elem)
+		return
+	}
+	mc.entries[key] = mc.lru.PushFront(&memoryEntry{key, value, expires})
+	for mc.lru.Len() > mc.maxEntries {
+		mc.removeElement(mc.lru.Back())
+		mc.stats.Evictions++
+	}
+}
+
+func (mc *MemoryCache) forget(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.writes++
+	if elem, ok := mc.entries[key]; ok {
+		mc.removeElement(elem)
+	}
+}
+
+func (mc *MemoryCache) removeElement(elem *list.Element) {
+	mc.lru.Remove(elem)
+	delete(mc.entries, elem.Value.(*memoryEntry).key)
+}
+
+func (mc *MemoryCache) countL2(hit bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if hit {
+		mc.stats.L2Hits++
+	} else {
+		mc.stats.L2Misses++
+	}
+}
+
+// Stats returns the lookup counts so far.
+func (mc *MemoryCache) Stats() MemoryCacheStats {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	stats := mc.stats
+	stats.Entries = mc.lru.Len()
+	return stats
+}
+
+func (mc *MemoryCache) Get(ctx context.Context, k string) (string, bool, error) {
+	if !cachedInMemory(k) {
+		return mc.inner.Get(ctx, k)
+	}
+
+	now := time.Now()
+	writesSeen := mc.writeCount()
+	if v, ok := mc.lookup(k, now); ok {
+		cacheLookups.WithLabelValues("l1", "hit").Inc()
+		return v, true, nil
+	}
+	cacheLookups.WithLabelValues("l1", "miss").Inc()
+
+	// Without the inner TTL, the entry could outlive its expiry upstairs
+	v, ttl, found, err := mc.getWithTTL(ctx, k)
+	if err != nil {
+		return v, found, err
+	}
+	mc.countL2(found)
+	if !found {
+		cacheLookups.WithLabelValues("l2", "miss").Inc()
+		return v, found, nil
+	}
+	cacheLookups.WithLabelValues("l2", "hit").Inc()
+	if ttl >= 0 {
+		mc.store(k, v, ttl, now, writesSeen, false)
+	}
+	return v, true, nil
+}
+
+// ttlGetter is an inner cache that reads a value with its TTL in one
+// round-trip.
+type ttlGetter interface {
+	GetWithTTL(ctx context.Context, k string) (string, time.Duration, bool, error)
+}
+
+// getWithTTL reads a value from the inner cache with its TTL, in one
+// round-trip if the inner cache can. A negative TTL means it isn't known, and
+// the value mustn't be kept.
+func (mc *MemoryCache) getWithTTL(ctx context.Context, k string) (string, time.Duration, bool, error) {
+	if inner, ok := mc.inner.(ttlGetter); ok {
+		return inner.GetWithTTL(ctx, k)
+	}
+	v, found, err := mc.inner.Get(ctx, k)
+	if err != nil || !found {
+		return v, 0, found, err
+	}
+	ttl, exists, err := mc.inner.TTL(ctx, k)
+	if err != nil || !exists {
+		return v, -1, true, nil
+	}
+	return v, ttl, true, nil
+}
+
+func (mc *MemoryCache) Set(ctx context.Context, k string, v string, life time.Duration) error {
+	writesSeen := mc.writeCount()
+	err := mc.inner.Set(ctx, k, v, life)
+	if err != nil || !cachedInMemory(k) {
+		mc.forget(k)
+		return err
+	}
+	mc.store(k, v, life, time.Now(), writesSeen, true)
+	mc.announce(ctx, k)
+	return nil
+}
+
+func (mc *MemoryCache) SetIfNotExist(ctx context.Context, k string, v string, life time.Duration) (string, error) {
+	mc.forget(k)
+	return mc.inner.SetIfNotExist(ctx, k, v, life)
+}
+
+func (mc *MemoryCache) Exists(ctx context.Context, key string) (bool, error) {
+	return mc.inner.Exists(ctx, key)
+}
+
+func (mc *MemoryCache) ExpireAt(ctx context.Context, key string, aExpTime time.Time) error {
+	mc.forget(key)
+	err := mc.inner.ExpireAt(ctx, key, aExpTime)
+	if err == nil {
+		mc.announce(ctx, key)
+	}
+	return err
+}
+
+func (mc *MemoryCache) ExpireIfEqual(ctx context.Context, key string, v string, aExpTime time.Time) (bool, error) {
+	mc.forget(key)
+	return mc.inner.ExpireIfEqual(ctx, key, v, aExpTime)
+}
+
+func (mc *MemoryCache) TTL(ctx context.Context, k string) (time.Duration, bool, error) {
+	return mc.inner.TTL(ctx, k)
+}
+
+func (mc *MemoryCache) Delete(ctx context.Context, k string) error {
+	mc.forget(k)
+	err := mc.inner.Delete(ctx, k)
+	if err == nil {
+		mc.announce(ctx, k)
+	}
+	return err
+}
+
+func (mc *MemoryCache) KeysToChan(ctx context.Context, pattern string, c chan<- string) error {
+	return mc.inner.KeysToChan(ctx, pattern, c)
+}
+
+func (mc *MemoryCache) Info(ctx context.Context) (string, error) {
+	info, err := mc.inner.Info(ctx)
+	if err != nil {
+		return info, err
+	}
+	stats := mc.Stats()
+	return fmt.Sprintf("# Memory\nl1_entries:%d\nl1_max_entries:%d\nl1_hits:%d\nl1_misses:%d\nl2_hits:%d\nl2_misses:%d\nl1_evictions:%d\nl1_expirations:%d\n\n%s",
+		stats.Entries, mc.maxEntries, stats.L1Hits, stats.L1Misses, stats.L2Hits, stats.L2Misses, stats.Evictions, stats.Expirations, info), nil
+}
@@ -0,0 +1,308 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func responseKey(t *testing.T, serialHex string) string {
+	issuer, err := NewIssuerFromHexKeyId("a84a6a63047dddbae6d139b7a64565eff3a8eca1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ResponseKey(*issuer, NewSerialFromHex(serialHex))
+}
+
+func newTestMemoryCache(t *testing.T, maxEntries int, maxLife time.Duration) (*MemoryCache, *MockRemoteCache) {
+	inner := NewMockRemoteCache()
+	mc, err := NewMemoryCache(inner, maxEntries, maxLife)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mc, inner
+}
+
+func TestMemoryCacheHitsAndMisses(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, inner := newTestMemoryCache(t, 10, 0)
+	key := responseKey(t, "0a")
+
+	if _, found, err := mc.Get(ctx, key); found || err != nil {
+		t.Fatalf("Expected a miss: %v %v", found, err)
+	}
+	if err := inner.Set(ctx, key, "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		v, found, err := mc.Get(ctx, key)
+		if err != nil || !found || v != "data" {
+			t.Errorf("Expected data, got %s %v %v", v, found, err)
+		}
+	}
+
+	expected := MemoryCacheStats{Entries: 1, L1Hits: 2, L1Misses: 2, L2Hits: 1, L2Misses: 1}
+	if stats := mc.Stats(); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestMemoryCacheHonorsInnerTTL(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, inner := newTestMemoryCache(t, 10, 0)
+	key := responseKey(t, "0b")
+
+	if err := inner.Set(ctx, key, "data", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := mc.Get(ctx, key); !found {
+		t.Fatal("Expected to find data")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, found, _ := mc.Get(ctx, key); found {
+		t.Error("The entry should have expired along with the inner one")
+	}
+	if stats := mc.Stats(); stats.Expirations != 1 {
+		t.Errorf("Expected an expiration, got %+v", stats)
+	}
+}
+
+// countingCache counts separate reads of values and TTLs.
+type countingCache struct {
+	*MockRemoteCache
+	gets int
+	ttls int
+}
+
+func (cc *countingCache) Get(ctx context.Context, k string) (string, bool, error) {
+	cc.gets++
+	return cc.MockRemoteCache.Get(ctx, k)
+}
+
+func (cc *countingCache) TTL(ctx context.Context, k string) (time.Duration, bool, error) {
+	cc.ttls++
+	return cc.MockRemoteCache.TTL(ctx, k)
+}
+
+func TestMemoryCacheReadsTTLWithValue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, inner := newTestMemoryCache(t, 10, 0)
+	counting := &countingCache{MockRemoteCache: inner}
+	mc.inner = counting
+	key := responseKey(t, "0f")
+	if err := inner.Set(ctx, key, "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mock reads both at once, as Redis does
+	if _, found, _ := mc.Get(ctx, key); !found {
+		t.Fatal("Expected to find data")
+	}
+	if counting.gets != 0 || counting.ttls != 0 {
+		t.Errorf("Expected one combined read, got %d gets and %d TTLs", counting.gets, counting.ttls)
+	}
+
+	// Inner caches without GetWithTTL take two reads
+	mc, _ = newTestMemoryCache(t, 10, 0)
+	mc.inner = struct{ RemoteCache }{counting}
+	if _, found, _ := mc.Get(ctx, key); !found {
+		t.Fatal("Expected to find data")
+	}
+	if counting.gets != 1 || counting.ttls != 1 {
+		t.Errorf("Expected a get and a TTL, got %d gets and %d TTLs", counting.gets, counting.ttls)
+	}
+	if _, ok := mc.lookup(key, time.Now()); !ok {
+		t.Error("Expected the entry kept in memory")
+	}
+}
+
+func TestMemoryCacheMaxLife(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, inner := newTestMemoryCache(t, 10, 30*time.Millisecond)
+	key := responseKey(t, "0c")
+
+	if err := mc.Set(ctx, key, "first", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Another replica replaces the entry
+	if err := inner.Set(ctx, key, "second", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := mc.Get(ctx, key); v != "first" {
+		t.Errorf("Expected the in-memory value, got %s", v)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if v, _, _ := mc.Get(ctx, key); v != "second" {
+		t.Errorf("Expected the other replica's value after the L1 life, got %s", v)
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, _ := newTestMemoryCache(t, 2, 0)
+	a, b, c := responseKey(t, "01"), responseKey(t, "02"), responseKey(t, "03")
+
+	for _, k := range []string{a, b} {
+		if err := mc.Set(ctx, k, k, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Touching a makes b the least recently used
+	if _, found, _ := mc.Get(ctx, a); !found {
+		t.Fatal("Expected to find a")
+	}
+	if err := mc.Set(ctx, c, c, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := mc.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Expected 2 entries after 1 eviction, got %+v", stats)
+	}
+	mc.mu.Lock()
+	_, hasA := mc.entries[a]
+	_, hasB := mc.entries[b]
+	mc.mu.Unlock()
+	if !hasA || hasB {
+		t.Errorf("Expected b to be evicted, not a")
+	}
+}
+
+func TestMemoryCacheInvalidation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, _ := newTestMemoryCache(t, 10, 0)
+	key := responseKey(t, "0d")
+
+	if err := mc.Set(ctx, key, "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := mc.Get(ctx, key); found {
+		t.Error("Deleted entries must not be served from memory")
+	}
+
+	if err := mc.Set(ctx, key, "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.ExpireAt(ctx, key, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := mc.Get(ctx, key); found {
+		t.Error("Expired entries must not be served from memory")
+	}
+}
+
+func TestMemoryCacheSharedInvalidation(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := NewMockRemoteCache()
+	var replicas []*MemoryCache
+	for i := 0; i < 2; i++ {
+		mc, err := NewMemoryCache(inner, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mc.ShareInvalidations(ctx, inner); err != nil {
+			t.Fatal(err)
+		}
+		replicas = append(replicas, mc)
+	}
+	a, b := replicas[0], replicas[1]
+	key := responseKey(t, "0e")
+	eventually := func(expected string, found bool) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			v, ok, _ := b.Get(ctx, key)
+			if ok == found && v == expected {
+				return
+			}
+		}
+		t.Errorf("Expected the other replica to see %q, %v", expected, found)
+	}
+
+	if err := a.Set(ctx, key, "old", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	eventually("old", true)
+	if err := a.Set(ctx, key, "new", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	eventually("new", true)
+	if err := a.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	eventually("", false)
+
+	// Its own announcements don't drop what it just wrote
+	if err := a.Set(ctx, key, "mine", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := a.lookup(key, time.Now()); !ok {
+		t.Error("Expected the writer to keep its own write in memory")
+	}
+}
+
+func TestMemoryCacheOnlyKeepsResponses(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mc, inner := newTestMemoryCache(t, 10, 0)
+
+	if _, err := mc.SetIfNotExist(ctx, "lease/x", "me", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := mc.Get(ctx, "lease/x"); v != "me" {
+		t.Errorf("Expected me, got %s", v)
+	}
+	if err := inner.Set(ctx, "lease/x", "you", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := mc.Get(ctx, "lease/x"); v != "you" {
+		t.Errorf("Leases must always come from the inner cache, got %s", v)
+	}
+	if stats := mc.Stats(); stats != (MemoryCacheStats{}) {
+		t.Errorf("Expected no L1 activity, got %+v", stats)
+	}
+}
+
+func TestMemoryCacheInfo(t *testing.T) {
+	t.Parallel()
+	mc, inner := newTestMemoryCache(t, 10, 0)
+
+	info, err := mc.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(info, "l1_max_entries:10") || !strings.Contains(info, "entries: 0") {
+		t.Errorf("Expected both tiers' info, got %s", info)
+	}
+
+	inner.Alive = false
+	if _, err := mc.Info(context.Background()); err == nil {
+		t.Error("Expected the inner cache's failure")
+	}
+}
+
+func TestNewMemoryCacheErrors(t *testing.T) {
+	t.Parallel()
+	if _, err := NewMemoryCache(nil, 10, 0); err == nil {
+		t.Error("Expected an error without an inner cache")
+	}
+	if _, err := NewMemoryCache(NewMockRemoteCache(), 0, 0); err == nil {
+		t.Error("Expected an error without room for entries")
+	}
+}
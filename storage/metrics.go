@@ -0,0 +1,36 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ocsp_l2_cache_redis_operation_duration_seconds",
+		Help:    "Time taken by Redis operations, successful or not.",
+		Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"operation"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_memory_cache_lookups_total",
+		Help: "Lookups of responses in memory (l1) and, after an l1 miss, in Redis (l2).",
+	}, []string{"tier", "result"})
+
+	cacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_l2_cache_memory_cache_invalidations_total",
+		Help: "Changed responses announced to other replicas (sent, or failed to send), and announcements received from them.",
+	}, []string{"result"})
+)
+
+// observeRedis records how long the Redis operation took since start; defer it
+// at the top of the operation.
+func observeRedis(operation string, start time.Time) {
+	redisDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -7,15 +7,19 @@ package storage
 import (
 	"context"
 	"fmt"
-	"path/filepath" // used for glob-like matching in Keys
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
 type MockRemoteCache struct {
+	mu          sync.Mutex
 	Data        map[string]string
 	Expirations map[string]time.Time
 	Duplicate   int
 	Alive       bool
+	subscribers []chan string
 }
 
 func NewMockRemoteCache() *MockRemoteCache {
@@ -28,6 +32,12 @@ func NewMockRemoteCache() *MockRemoteCache {
 }
 
 func (ec *MockRemoteCache) CleanupExpiry() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
+}
+
+func (ec *MockRemoteCache) cleanupExpiry() {
 	now := time.Now()
 	for key, timestamp := range ec.Expirations {
 		if timestamp.Before(now) {
@@ -38,25 +48,47 @@ func (ec *MockRemoteCache) CleanupExpiry() {
 }
 
 func (ec *MockRemoteCache) Exists(ctx context.Context, key string) (bool, error) {
-	ec.CleanupExpiry()
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
 	_, ok := ec.Data[key]
 	return ok, nil
 }
 
 func (ec *MockRemoteCache) ExpireAt(ctx context.Context, key string, expTime time.Time) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
 	ec.Expirations[key] = expTime
 	return nil
 }
 
+func (ec *MockRemoteCache) ExpireIfEqual(ctx context.Context, key string, v string, expTime time.Time) (bool, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
+	if val, ok := ec.Data[key]; !ok || val != v {
+		return false, nil
+	}
+	ec.Expirations[key] = expTime
+	return true, nil
+}
+
 func (ec *MockRemoteCache) KeysToChan(ctx context.Context, pattern string, c chan<- string) error {
 	defer close(c)
 
+	ec.mu.Lock()
+	keys := make([]string, 0, len(ec.Data))
 	for key := range ec.Data {
-		matched, err := filepath.Match(pattern, key)
-		if err != nil {
-			return err
-		}
-		if matched {
+		keys = append(keys, key)
+	}
+	ec.mu.Unlock()
+
+	re, err := globToRegexp(pattern)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if re.MatchString(key) {
 			c <- key
 		}
 	}
@@ -64,28 +96,163 @@ func (ec *MockRemoteCache) KeysToChan(ctx context.Context, pattern string, c cha
 	return nil
 }
 
+// globToRegexp translates a Redis glob-style pattern, where "*" also matches
+// "/", into a regular expression.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case inClass:
+			if ch == ']' {
+				inClass = false
+			}
+			expr.WriteByte(ch)
+		case ch == '*':
+			expr.WriteString("(?s:.*)")
+		case ch == '?':
+			expr.WriteString("(?s:.)")
+		case ch == '[':
+			inClass = true
+			expr.WriteByte(ch)
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
 func (ec *MockRemoteCache) SetIfNotExist(ctx context.Context, key string, v string, life time.Duration) (string, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
 	val, ok := ec.Data[key]
 	if ok {
 		return val, nil
 	}
 	ec.Data[key] = v
-	err := ec.ExpireAt(ctx, key, time.Now().Add(life))
-	return v, err
+	ec.setExpiry(key, life)
+	return v, nil
 }
 
 func (ec *MockRemoteCache) Set(ctx context.Context, k string, v string, life time.Duration) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
 	ec.Data[k] = v
-	return ec.ExpireAt(ctx, k, time.Now().Add(life))
+	ec.setExpiry(k, life)
+	return nil
+}
+
+func (ec *MockRemoteCache) setExpiry(k string, life time.Duration) {
+	if life == NO_EXPIRATION {
+		delete(ec.Expirations, k)
+		return
+	}
+	ec.Expirations[k] = time.Now().Add(life)
 }
 
 func (ec *MockRemoteCache) Get(ctx context.Context, k string) (string, bool, error) {
-	ec.CleanupExpiry()
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
 	v, ok := ec.Data[k]
 	return v, ok, nil
 }
 
+func (ec *MockRemoteCache) GetWithTTL(ctx context.Context, k string) (string, time.Duration, bool, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
+	v, ok := ec.Data[k]
+	if !ok {
+		return "", 0, false, nil
+	}
+	expiry, ok := ec.Expirations[k]
+	if !ok {
+		return v, NO_EXPIRATION, true, nil
+	}
+	return v, time.Until(expiry), true, nil
+}
+
+func (ec *MockRemoteCache) TTL(ctx context.Context, k string) (time.Duration, bool, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.cleanupExpiry()
+	if _, ok := ec.Data[k]; !ok {
+		return 0, false, nil
+	}
+	expiry, ok := ec.Expirations[k]
+	if !ok {
+		return NO_EXPIRATION, true, nil
+	}
+	return time.Until(expiry), true, nil
+}
+
+func (ec *MockRemoteCache) Delete(ctx context.Context, k string) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	delete(ec.Data, k)
+	delete(ec.Expirations, k)
+	return nil
+}
+
+func (ec *MockRemoteCache) PublishInvalidation(ctx context.Context, message string) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	for _, sub := range ec.subscribers {
+		select {
+		case sub <- message:
+		default:
+			// Lost, as Redis may lose it
+		}
+	}
+	return nil
+}
+
+func (ec *MockRemoteCache) SubscribeInvalidations(ctx context.Context) (<-chan string, error) {
+	sub := make(chan string, 64)
+	ec.mu.Lock()
+	ec.subscribers = append(ec.subscribers, sub)
+	ec.mu.Unlock()
+
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer func() {
+			ec.mu.Lock()
+			defer ec.mu.Unlock()
+			for i, s := range ec.subscribers {
+				if s == sub {
+					ec.subscribers = append(ec.subscribers[:i], ec.subscribers[i+1:]...)
+					break
+				}
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-sub:
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
 func (ec *MockRemoteCache) Info(ctx context.Context) (string, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
 	if ec.Alive {
 		return fmt.Sprintf("entries: %d\nok: true\n", len(ec.Data)), nil
 	}
@@ -6,52 +6,186 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/armon/go-metrics"
 	"github.com/go-redis/redis/v8"
 )
 
 const NO_EXPIRATION time.Duration = 0
 
+// RedisCache is a RemoteCache backed by a single Redis server, a Redis Cluster,
+// or a Sentinel-managed master.
 type RedisCache struct {
-	client *redis.Client
+	client redis.UniversalClient
+	// masterName is set when the master is found through Sentinel
+	masterName string
 }
 
-func NewRedisCache(ctx context.Context, addr string, cacheTxTimeout time.Duration) (*RedisCache, error) {
+// RedisOptions are the connection settings common to every kind of RedisCache.
+type RedisOptions struct {
+	// TxTimeout bounds each read and write on a connection
+	TxTimeout time.Duration
+	// Username selects a Redis 6 ACL user; leave it empty for the default user
+	Username string
+	Password string
+	// DB selects a database; Redis Cluster only has database 0
+	DB int
+	// SentinelPassword authenticates to the Sentinels, which may differ from
+	// the master's password
+	SentinelPassword string
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+}
+
+func NewRedisCache(ctx context.Context, addr string, opts RedisOptions) (*RedisCache, error) {
 	rdb := redis.NewClient(&redis.Options{
 		Addr:            addr,
+		Username:        opts.Username,
+		Password:        opts.Password,
+		DB:              opts.DB,
+		TLSConfig:       opts.TLSConfig,
+		MaxRetries:      10,
+		MaxRetryBackoff: 5 * time.Second,
+		ReadTimeout:     opts.TxTimeout,
+		WriteTimeout:    opts.TxTimeout,
+	})
+
+	return newRedisCache(ctx, rdb, "")
+}
+
+// NewRedisClusterCache connects to a Redis Cluster through any of its nodes'
+// addresses; the rest of the cluster is discovered from them.
+func NewRedisClusterCache(ctx context.Context, addrs []string, opts RedisOptions) (*RedisCache, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("Redis Cluster needs at least one node address")
+	}
+	if opts.DB != 0 {
+		return nil, fmt.Errorf("Redis Cluster only supports database 0, not %d", opts.DB)
+	}
+	rdb := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:           addrs,
+		Username:        opts.Username,
+		Password:        opts.Password,
+		TLSConfig:       opts.TLSConfig,
 		MaxRetries:      10,
 		MaxRetryBackoff: 5 * time.Second,
-		ReadTimeout:     cacheTxTimeout,
-		WriteTimeout:    cacheTxTimeout,
+		ReadTimeout:     opts.TxTimeout,
+		WriteTimeout:    opts.TxTimeout,
 	})
 
+	return newRedisCache(ctx, rdb, "")
+}
+
+// NewRedisSentinelCache connects to the master named masterName, as reported
+// by the Sentinels at sentinelAddrs, and follows it across failovers.
+func NewRedisSentinelCache(ctx context.Context, masterName string, sentinelAddrs []string, opts RedisOptions) (*RedisCache, error) {
+	if masterName == "" || len(sentinelAddrs) == 0 {
+		return nil, fmt.Errorf("Redis Sentinel needs a master name and at least one sentinel address")
+	}
+	rdb := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:       masterName,
+		SentinelAddrs:    sentinelAddrs,
+		SentinelPassword: opts.SentinelPassword,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		DB:               opts.DB,
+		TLSConfig:        opts.TLSConfig,
+		MaxRetries:       10,
+		MaxRetryBackoff:  5 * time.Second,
+		ReadTimeout:      opts.TxTimeout,
+		WriteTimeout:     opts.TxTimeout,
+	})
+
+	return newRedisCache(ctx, rdb, masterName)
+}
+
+// NewRedisTLSConfig returns a TLS configuration trusting the PEM-encoded CA
+// certificates in caPem, or the system roots if it's empty, and presenting the
+// client certificate in certPem and keyPem if they're set.
+func NewRedisTLSConfig(caPem []byte, certPem []byte, keyPem []byte) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(caPem) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("No CA certificates found in PEM")
+		}
+	}
+	if len(certPem) > 0 || len(keyPem) > 0 {
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func newRedisCache(ctx context.Context, rdb redis.UniversalClient, masterName string) (*RedisCache, error) {
 	statusr := rdb.Ping(ctx)
 	if statusr.Err() != nil {
-		return nil, statusr.Err()
+		_ = rdb.Close()
+		return nil, DescribeRedisError(statusr.Err())
 	}
 
-	return &RedisCache{rdb}, nil
+	return &RedisCache{rdb, masterName}, nil
 }
 
 func (rc *RedisCache) Exists(ctx context.Context, key string) (bool, error) {
-	defer metrics.MeasureSince([]string{"Exists"}, time.Now())
+	defer observeRedis("exists", time.Now())
 	ir := rc.client.Exists(ctx, key)
 	count, err := ir.Result()
 	return count == 1, err
 }
 
 func (rc *RedisCache) ExpireAt(ctx context.Context, key string, aExpTime time.Time) error {
-	defer metrics.MeasureSince([]string{"ExpireAt"}, time.Now())
+	defer observeRedis("expire_at", time.Now())
 	br := rc.client.ExpireAt(ctx, key, aExpTime)
 	return br.Err()
 }
 
+// expireIfEqualScript compares and expires in one step, so that a lease that
+// changed hands in between isn't expired.
+var expireIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIREAT", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func (rc *RedisCache) ExpireIfEqual(ctx context.Context, key string, v string, aExpTime time.Time) (bool, error) {
+	defer observeRedis("expire_if_equal", time.Now())
+	ir := expireIfEqualScript.Run(ctx, rc.client, []string{key}, v, aExpTime.UnixNano()/int64(time.Millisecond))
+	n, err := ir.Int64()
+	return n == 1, err
+}
+
 func (rc *RedisCache) KeysToChan(ctx context.Context, pattern string, c chan<- string) error {
 	defer close(c)
-	defer metrics.MeasureSince([]string{"KeysToChan"}, time.Now())
-	scanres := rc.client.Scan(ctx, 0, pattern, 0)
+	defer observeRedis("keys_to_chan", time.Now())
+
+	// A cluster's keys are spread over its masters, which each have to be
+	// scanned on their own
+	if cluster, ok := rc.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return scanToChan(ctx, master, pattern, c)
+		})
+	}
+	return scanToChan(ctx, rc.client, pattern, c)
+}
+
+func scanToChan(ctx context.Context, client redis.Cmdable, pattern string, c chan<- string) error {
+	scanres := client.Scan(ctx, 0, pattern, 0)
 	err := scanres.Err()
 	if err != nil {
 		return err
@@ -60,13 +194,18 @@ func (rc *RedisCache) KeysToChan(ctx context.Context, pattern string, c chan<- s
 	iter := scanres.Iterator()
 
 	for iter.Next(ctx) {
-		c <- iter.Val()
+		select {
+		case c <- iter.Val():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	return iter.Err()
 }
 
 func (rc *RedisCache) SetIfNotExist(ctx context.Context, k string, v string, life time.Duration) (string, error) {
+	defer observeRedis("set_if_not_exist", time.Now())
 	br := rc.client.SetNX(ctx, k, v, life)
 	if br.Err() != nil {
 		return "", br.Err()
@@ -76,11 +215,13 @@ func (rc *RedisCache) SetIfNotExist(ctx context.Context, k string, v string, lif
 }
 
 func (rc *RedisCache) Set(ctx context.Context, k string, v string, life time.Duration) error {
+	defer observeRedis("set", time.Now())
 	br := rc.client.SetEX(ctx, k, v, life)
 	return br.Err()
 }
 
 func (rc *RedisCache) Get(ctx context.Context, k string) (string, bool, error) {
+	defer observeRedis("get", time.Now())
 	sr := rc.client.Get(ctx, k)
 	v, err := sr.Result()
 	if err == redis.Nil {
@@ -89,7 +230,178 @@ func (rc *RedisCache) Get(ctx context.Context, k string) (string, bool, error) {
 	return v, true, err
 }
 
+// GetWithTTL returns a key's value along with how long until it expires, or
+// NO_EXPIRATION if it doesn't, in one round-trip.
+func (rc *RedisCache) GetWithTTL(ctx context.Context, k string) (string, time.Duration, bool, error) {
+	defer observeRedis("get_with_ttl", time.Now())
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+	_, err := rc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, k)
+		pttl = pipe.PTTL(ctx, k)
+		return nil
+	})
+	if err == redis.Nil {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	ttl := pttl.Val()
+	// Redis answers -2 for missing keys and -1 for keys without an expiry
+	switch ttl {
+	case -2:
+		return "", 0, false, nil
+	case -1:
+		ttl = NO_EXPIRATION
+	}
+	return get.Val(), ttl, true, nil
+}
+
+func (rc *RedisCache) TTL(ctx context.Context, k string) (time.Duration, bool, error) {
+	defer observeRedis("ttl", time.Now())
+	dr := rc.client.TTL(ctx, k)
+	ttl, err := dr.Result()
+	if err != nil {
+		return 0, false, err
+	}
+	// Redis answers -2 for missing keys and -1 for keys without an expiry
+	switch ttl {
+	case -2:
+		return 0, false, nil
+	case -1:
+		return NO_EXPIRATION, true, nil
+	}
+	return ttl, true, nil
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, k string) error {
+	defer observeRedis("delete", time.Now())
+	ir := rc.client.Del(ctx, k)
+	return ir.Err()
+}
+
 func (rc *RedisCache) Info(ctx context.Context) (string, error) {
-	sr := rc.client.Info(ctx)
-	return sr.Result()
+	defer observeRedis("info", time.Now())
+	cluster, ok := rc.client.(*redis.ClusterClient)
+	if !ok {
+		info, err := rc.client.Info(ctx).Result()
+		if err != nil {
+			return info, DescribeRedisError(err)
+		}
+		if rc.masterName == "" {
+			return info, nil
+		}
+		return fmt.Sprintf("# Sentinel\nmaster_name:%s\n\n%s", rc.masterName, info), nil
+	}
+
+	// The full INFO of every node would be unreadable, so summarize them
+	var mu sync.Mutex
+	summaries := make(map[string]string)
+	err := cluster.ForEachShard(ctx, func(ctx context.Context, node *redis.Client) error {
+		info, err := node.Info(ctx).Result()
+		if err != nil {
+			return fmt.Errorf("node %s: %v", node.Options().Addr, DescribeRedisError(err))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		summaries[node.Options().Addr] = summarizeInfo(info)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	addrs := make([]string, 0, len(summaries))
+	for addr := range summaries {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Cluster\nnodes:%d\n", len(addrs))
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "\n# Node %s\n%s", addr, summaries[addr])
+	}
+	return b.String(), nil
+}
+
+// DescribeRedisError adds what kind of problem err points to, when it is clear,
+// so that misconfigurations are obvious from logs and the health check.
+func DescribeRedisError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+
+	var kind string
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var netErr net.Error
+	switch {
+	case strings.HasPrefix(msg, "WRONGPASS"), strings.HasPrefix(msg, "NOAUTH"),
+		strings.HasPrefix(msg, "NOPERM"), strings.Contains(msg, "invalid password"),
+		strings.Contains(msg, "without any password configured"):
+		kind = "authentication failed"
+	case errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalid),
+		strings.HasPrefix(msg, "tls:"), strings.Contains(msg, "remote error: tls"):
+		kind = "TLS handshake failed"
+	case strings.Contains(msg, "DB index"):
+		kind = "database selection failed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		kind = "timed out"
+	case errors.As(err, &netErr), err == io.EOF, strings.Contains(msg, "connection reset"):
+		kind = "connection failed"
+	default:
+		return err
+	}
+	return &RedisError{kind, err}
+}
+
+// RedisError is a Redis error along with what kind of problem it points to.
+type RedisError struct {
+	Kind string
+	Err  error
+}
+
+func (e *RedisError) Error() string {
+	return fmt.Sprintf("redis %s: %v", e.Kind, e.Err)
+}
+
+func (e *RedisError) Unwrap() error {
+	return e.Err
+}
+
+// summaryInfoFields are the INFO fields reported for each node of a cluster.
+var summaryInfoFields = []string{
+	"role",
+	"redis_version",
+	"uptime_in_seconds",
+	"connected_clients",
+	"used_memory_human",
+	"maxmemory_human",
+	"evicted_keys",
+	"keyspace_hits",
+	"keyspace_misses",
+	"db0",
+}
+
+// summarizeInfo picks the summaryInfoFields out of the output of INFO.
+func summarizeInfo(info string) string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range summaryInfoFields {
+		if v, ok := fields[name]; ok {
+			fmt.Fprintf(&b, "%s:%s\n", name, v)
+		}
+	}
+	return b.String()
 }
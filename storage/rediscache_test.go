@@ -6,7 +6,12 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,7 +25,7 @@ func getRedisCache(tb testing.TB) *RedisCache {
 	}
 	tb.Logf("Connecting to Redis instance at %s", setting)
 
-	rc, err := NewRedisCache(context.TODO(), setting, time.Second)
+	rc, err := NewRedisCache(context.TODO(), setting, RedisOptions{TxTimeout: time.Second})
 	if err != nil {
 		tb.Fatalf("Couldn't construct RedisCache: %v", err)
 	}
@@ -29,7 +34,7 @@ func getRedisCache(tb testing.TB) *RedisCache {
 
 func Test_RedisInvalidHost(t *testing.T) {
 	t.Parallel()
-	_, err := NewRedisCache(context.TODO(), "unknown_host:999999", time.Second)
+	_, err := NewRedisCache(context.TODO(), "unknown_host:999999", RedisOptions{TxTimeout: time.Second})
 	if err == nil {
 		t.Error("Should have failed to construct invalid redis cache host")
 	}
@@ -100,6 +105,38 @@ func Test_RedisSetIfNotExist(t *testing.T) {
 	}
 }
 
+func Test_RedisExpireIfEqual(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+	rc := getRedisCache(t)
+
+	q := "Test_RedisExpireIfEqual"
+	defer rc.client.Del(ctx, q)
+
+	err := rc.Set(ctx, q, "me", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired, err := rc.ExpireIfEqual(ctx, q, "you", time.Now()); expired || err != nil {
+		t.Errorf("Should not have expired someone else's value: %v %v", expired, err)
+	}
+	if ttl, _, _ := rc.TTL(ctx, q); ttl < 50*time.Second {
+		t.Errorf("Should have kept its TTL, got %s", ttl)
+	}
+	if expired, err := rc.ExpireIfEqual(ctx, q, "me", time.Now().Add(time.Hour)); !expired || err != nil {
+		t.Errorf("Should have extended its own value: %v %v", expired, err)
+	}
+	if ttl, _, _ := rc.TTL(ctx, q); ttl < 59*time.Minute {
+		t.Errorf("Should have extended the TTL, got %s", ttl)
+	}
+	if expired, err := rc.ExpireIfEqual(ctx, q, "me", time.Now().Add(-time.Second)); !expired || err != nil {
+		t.Errorf("Should have expired its own value: %v %v", expired, err)
+	}
+	if exists, err := rc.Exists(ctx, q); exists || err != nil {
+		t.Errorf("Should not exist anymore: %v %v", exists, err)
+	}
+}
+
 func Test_RedisGetSet(t *testing.T) {
 	ctx := context.TODO()
 	t.Parallel()
@@ -133,6 +170,84 @@ func Test_RedisGetSet(t *testing.T) {
 	}
 }
 
+func Test_RedisGetWithTTL(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+	rc := getRedisCache(t)
+
+	k := "Test_RedisGetWithTTL"
+	defer rc.client.Del(ctx, k)
+
+	_, _, ok, err := rc.GetWithTTL(ctx, k)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected no answer for missing %s", k)
+	}
+
+	err = rc.Set(ctx, k, "data", NO_EXPIRATION)
+	if err != nil {
+		t.Error(err)
+	}
+	v, ttl, ok, err := rc.GetWithTTL(ctx, k)
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok || v != "data" || ttl != NO_EXPIRATION {
+		t.Errorf("Expected data without expiration, got %q %v %v", v, ttl, ok)
+	}
+
+	err = rc.Set(ctx, k, "data", time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+	v, ttl, ok, err = rc.GetWithTTL(ctx, k)
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok || v != "data" || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected data for about an hour, got %q %v %v", v, ttl, ok)
+	}
+}
+
+func Test_RedisTTLDelete(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+	rc := getRedisCache(t)
+
+	k := "Test_RedisTTLDelete"
+	defer rc.client.Del(ctx, k)
+
+	_, ok, err := rc.TTL(ctx, k)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected no TTL for missing %s", k)
+	}
+
+	err = rc.Set(ctx, k, "data", time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+	ttl, ok, err := rc.TTL(ctx, k)
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected about an hour, got %v %v", ttl, ok)
+	}
+
+	err = rc.Delete(ctx, k)
+	if err != nil {
+		t.Error(err)
+	}
+	if exists, err := rc.Exists(ctx, k); exists || err != nil {
+		t.Errorf("Should not exist anymore: %v %v", exists, err)
+	}
+}
+
 func Test_Info(t *testing.T) {
 	ctx := context.TODO()
 	t.Parallel()
@@ -146,3 +261,227 @@ func Test_Info(t *testing.T) {
 		t.Error("Expected informational output")
 	}
 }
+
+var kRedisClusterHosts = "RedisClusterHosts"
+var kRedisSentinelHosts = "RedisSentinelHosts"
+var kRedisSentinelMaster = "RedisSentinelMaster"
+
+func getRedisClusterCache(tb testing.TB) *RedisCache {
+	setting, ok := os.LookupEnv(kRedisClusterHosts)
+	if !ok {
+		tb.Skipf("%s is not set, unable to run %s. Skipping.", kRedisClusterHosts, tb.Name())
+	}
+	tb.Logf("Connecting to Redis Cluster at %s", setting)
+
+	rc, err := NewRedisClusterCache(context.TODO(), strings.Split(setting, ","), RedisOptions{TxTimeout: time.Second})
+	if err != nil {
+		tb.Fatalf("Couldn't construct cluster RedisCache: %v", err)
+	}
+	return rc
+}
+
+func Test_RedisClusterSentinelMissingAddrs(t *testing.T) {
+	t.Parallel()
+	if _, err := NewRedisClusterCache(context.TODO(), nil, RedisOptions{TxTimeout: time.Second}); err == nil {
+		t.Error("Should have failed to construct a cluster without nodes")
+	}
+	if _, err := NewRedisSentinelCache(context.TODO(), "", []string{"localhost:26379"}, RedisOptions{TxTimeout: time.Second}); err == nil {
+		t.Error("Should have failed to construct a sentinel cache without a master name")
+	}
+	if _, err := NewRedisSentinelCache(context.TODO(), "mymaster", nil, RedisOptions{TxTimeout: time.Second}); err == nil {
+		t.Error("Should have failed to construct a sentinel cache without sentinels")
+	}
+	if _, err := NewRedisClusterCache(context.TODO(), []string{"localhost:6379"}, RedisOptions{TxTimeout: time.Second, DB: 2}); err == nil {
+		t.Error("Should have failed to construct a cluster with a database other than 0")
+	}
+}
+
+func Test_RedisClusterKeysToChan(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+	rc := getRedisClusterCache(t)
+
+	// Enough keys to land in every master's slots
+	expected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("Test_RedisClusterKeysToChan/%d", i)
+		expected[k] = true
+		if err := rc.Set(ctx, k, "data", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		defer rc.client.Del(ctx, k)
+	}
+
+	keys := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- rc.KeysToChan(ctx, "Test_RedisClusterKeysToChan/*", keys)
+	}()
+	found := make(map[string]bool)
+	for k := range keys {
+		found[k] = true
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %d keys, found %d", len(expected), len(found))
+	}
+}
+
+func Test_RedisClusterInfo(t *testing.T) {
+	t.Parallel()
+	rc := getRedisClusterCache(t)
+
+	data, err := rc.Info(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(data, "# Cluster\nnodes:") || !strings.Contains(data, "role:master") {
+		t.Errorf("Expected a cluster summary, got %s", data)
+	}
+}
+
+func Test_RedisSentinel(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+	setting, ok := os.LookupEnv(kRedisSentinelHosts)
+	if !ok {
+		t.Skipf("%s is not set, unable to run %s. Skipping.", kRedisSentinelHosts, t.Name())
+	}
+	rc, err := NewRedisSentinelCache(ctx, os.Getenv(kRedisSentinelMaster), strings.Split(setting, ","), RedisOptions{TxTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("Couldn't construct sentinel RedisCache: %v", err)
+	}
+
+	k := "Test_RedisSentinel"
+	defer rc.client.Del(ctx, k)
+	if err := rc.Set(ctx, k, "data", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if v, ok, err := rc.Get(ctx, k); v != "data" || !ok || err != nil {
+		t.Errorf("Expected data, got %s %v %v", v, ok, err)
+	}
+
+	data, err := rc.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(data, "# Sentinel\nmaster_name:") {
+		t.Errorf("Expected the master name, got %s", data)
+	}
+}
+
+func Test_SummarizeInfo(t *testing.T) {
+	t.Parallel()
+	info := "# Server\r\nredis_version:6.0.9\r\nuptime_in_seconds:42\r\n\r\n" +
+		"# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\n\r\n" +
+		"# Keyspace\r\ndb0:keys=12,expires=12,avg_ttl=3600\r\n"
+
+	expected := "role:slave\nredis_version:6.0.9\nuptime_in_seconds:42\ndb0:keys=12,expires=12,avg_ttl=3600\n"
+	if summary := summarizeInfo(info); summary != expected {
+		t.Errorf("Expected %q, got %q", expected, summary)
+	}
+}
+
+// fakeRedis accepts connections and answers every command with reply, like a
+// Redis server rejecting our credentials.
+func fakeRedis(t *testing.T, reply string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func Test_RedisConnectionErrorsDescribed(t *testing.T) {
+	t.Parallel()
+	ctx := context.TODO()
+
+	addr := fakeRedis(t, "-WRONGPASS invalid username-password pair\r\n")
+	tlsConfig, err := NewRedisTLSConfig(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		addr     string
+		opts     RedisOptions
+		expected string
+	}{
+		{"auth", addr, RedisOptions{TxTimeout: time.Second, Username: "cache", Password: "wrong"}, "redis authentication failed: WRONGPASS"},
+		{"tls", addr, RedisOptions{TxTimeout: time.Second, TLSConfig: tlsConfig}, "redis TLS handshake failed"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewRedisCache(ctx, tc.addr, tc.opts)
+			if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+				t.Errorf("Expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func Test_DescribeRedisError(t *testing.T) {
+	t.Parallel()
+	if DescribeRedisError(nil) != nil {
+		t.Error("nil should stay nil")
+	}
+	plain := fmt.Errorf("something else")
+	if DescribeRedisError(plain) != plain {
+		t.Error("Unclassified errors should be returned as they are")
+	}
+	described := DescribeRedisError(fmt.Errorf("ERR DB index is out of range"))
+	if described.Error() != "redis database selection failed: ERR DB index is out of range" {
+		t.Errorf("Unexpected description %v", described)
+	}
+	var redisErr *RedisError
+	if !errors.As(described, &redisErr) || redisErr.Kind != "database selection failed" {
+		t.Errorf("Expected a RedisError, got %T", described)
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connect: connection refused")}
+	if described := DescribeRedisError(refused); !strings.HasPrefix(described.Error(), "redis connection failed: dial tcp") {
+		t.Errorf("Unexpected description %v", described)
+	}
+}
+
+func Test_NewRedisTLSConfig(t *testing.T) {
+	t.Parallel()
+	if _, err := NewRedisTLSConfig([]byte("not a certificate"), nil, nil); err == nil {
+		t.Error("Expected an error for a CA bundle without certificates")
+	}
+	if _, err := NewRedisTLSConfig(nil, []byte(kLeadingZeroes), nil); err == nil {
+		t.Error("Expected an error for a client certificate without its key")
+	}
+
+	config, err := NewRedisTLSConfig([]byte(kLeadingZeroes), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 0 {
+		t.Errorf("Expected only custom roots, got %+v", config)
+	}
+}
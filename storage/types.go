@@ -7,6 +7,7 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
@@ -24,9 +25,16 @@ type DocumentType int
 type RemoteCache interface {
 	Exists(ctx context.Context, key string) (bool, error)
 	ExpireAt(ctx context.Context, key string, aExpTime time.Time) error
+	// ExpireIfEqual sets when a key expires only if it holds v, in one atomic
+	// step, and returns whether it did.
+	ExpireIfEqual(ctx context.Context, key string, v string, aExpTime time.Time) (bool, error)
 	SetIfNotExist(ctx context.Context, k string, v string, life time.Duration) (string, error)
 	Set(ctx context.Context, k string, v string, life time.Duration) error
 	Get(ctx context.Context, k string) (string, bool, error)
+	// TTL returns how long until a key expires, or NO_EXPIRATION if it
+	// doesn't, and whether it exists at all.
+	TTL(ctx context.Context, k string) (time.Duration, bool, error)
+	Delete(ctx context.Context, k string) error
 	KeysToChan(ctx context.Context, pattern string, c chan<- string) error
 	Info(ctx context.Context) (string, error)
 }
@@ -46,6 +54,23 @@ func NewIssuerFromRequest(aReq *ocsp.Request) Issuer {
 	return obj
 }
 
+// NewIssuerFromCertificate identifies an issuer by the SHA-1 hash of its
+// public key, as in OCSP requests and the Subject Key Identifier.
+func NewIssuerFromCertificate(aCert *x509.Certificate) (*Issuer, error) {
+	var publicKeyInfo struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(aCert.RawSubjectPublicKeyInfo, &publicKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := sha1.Sum(publicKeyInfo.PublicKey.RightAlign()) // #nosec G401 -- OCSP key hashes are SHA-1
+	return &Issuer{
+		spki: SPKI(keyHash[:]),
+	}, nil
+}
+
 func NewIssuerFromHexKeyId(s string) (*Issuer, error) {
 	decoded, err := hex.DecodeString(s)
 	if err != nil {
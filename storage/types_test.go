@@ -60,6 +60,32 @@ func TestIssuerHex(t *testing.T) {
 	}
 }
 
+func TestIssuerFromCertificate(t *testing.T) {
+	t.Parallel()
+	b, _ := pem.Decode([]byte(kLeadingZeroes))
+
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewIssuerFromCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(i.spki) != 20 {
+		t.Errorf("Expected a 20 byte key hash, got %d", len(i.spki))
+	}
+
+	fromHex, err := NewIssuerFromHexKeyId(i.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromHex.String() != i.String() {
+		t.Errorf("Expected %s, got %s", i.String(), fromHex.String())
+	}
+}
+
 func TestSerial(t *testing.T) {
 	t.Parallel()
 	x := NewSerialFromHex("DEADBEEF")
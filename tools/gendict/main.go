@@ -0,0 +1,217 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command gendict writes the deflate dictionary for cached OCSP responses,
+// repo/dictionary.go, from a corpus of DER-encoded responses:
+//
+//	go run ./tools/gendict -corpus tools/gendict/testdata/corpus -o repo/dictionary.go
+//
+// which is what go generate runs in repo. The dictionary is the usual HTTP
+// header text, then every byte run shared by more than -share of the corpus,
+// the most common last, where they are cheapest to refer to.
+//
+// The corpus is committed, since responses carry random signatures. With
+// -synthesize, gendict instead writes a fresh corpus to the directory: for
+// issuers with RSA-2048 and ECDSA P-384 keys, signing directly or through
+// delegated P-256 responders, responses for good, revoked and unknown serials.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// headerText is what the HTTP caching headers served with responses are made
+// of, for entries that keep the upstream's.
+const headerText = "public, no-transform, must-revalidate, max-age= GMT" +
+	"Mon, Tue, Wed, Thu, Fri, Sat, Sun, " +
+	"Jan Feb Mar Apr May Jun Jul Aug Sep Oct Nov Dec "
+
+func main() {
+	corpusDir := flag.String("corpus", "", "directory of DER-encoded OCSP responses, named *.der")
+	output := flag.String("o", "dictionary.go", "Go file to write")
+	varName := flag.String("var", "responseDictionaryV1", "variable to hold the dictionary")
+	share := flag.Float64("share", 0.25, "share of the corpus a byte run must be in")
+	minLen := flag.Int("min", 4, "shortest byte run to include")
+	synthesize := flag.String("synthesize", "", "write a fresh corpus to this directory instead")
+	flag.Parse()
+
+	if *synthesize != "" {
+		err := synthesizeCorpus(*synthesize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *corpusDir == "" {
+		log.Fatal("Set -corpus or -synthesize")
+	}
+	corpus, err := readCorpus(*corpusDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dict := buildDictionary(corpus, *share, *minLen)
+	src, err := dictionarySource(*varName, filepath.ToSlash(*corpusDir), dict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(*output, src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote a %d-byte dictionary from %d responses to %s", len(dict), len(corpus), *output)
+}
+
+func readCorpus(dir string) ([][]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.der"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No responses in %s", dir)
+	}
+	sort.Strings(paths)
+	corpus := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		der, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		corpus = append(corpus, der)
+	}
+	return corpus, nil
+}
+
+// sharedRuns returns the byte runs of at least minLen bytes which are in more
+// than share of the corpus, and which can't be extended either way and stay
+// so, with how many responses they are in.
+func sharedRuns(corpus [][]byte, share float64, minLen int) map[string]int {
+	isShared := func(count int) bool {
+		return float64(count) > share*float64(len(corpus))
+	}
+	count := func(runAt func(doc []byte, i int) (string, bool), length int) map[string]int {
+		counts := make(map[string]int)
+		for _, doc := range corpus {
+			seen := make(map[string]bool)
+			for i := 0; i+length <= len(doc); i++ {
+				run, ok := runAt(doc, i)
+				if ok && !seen[run] {
+					seen[run] = true
+					counts[run]++
+				}
+			}
+		}
+		for run, c := range counts {
+			if !isShared(c) {
+				delete(counts, run)
+			}
+		}
+		return counts
+	}
+
+	level := count(func(doc []byte, i int) (string, bool) {
+		return string(doc[i : i+minLen]), true
+	}, minLen)
+	runs := make(map[string]int)
+	for length := minLen; len(level) > 0; length++ {
+		// Every part of a shared run is shared, so only runs made of two
+		// overlapping shared runs one shorter can be
+		shorter := level
+		level = count(func(doc []byte, i int) (string, bool) {
+			_, head := shorter[string(doc[i:i+length])]
+			_, tail := shorter[string(doc[i+1:i+length+1])]
+			return string(doc[i : i+length+1]), head && tail
+		}, length+1)
+
+		extended := make(map[string]bool)
+		for run := range level {
+			extended[run[:length]] = true
+			extended[run[1:]] = true
+		}
+		for run, c := range shorter {
+			if !extended[run] {
+				runs[run] = c
+			}
+		}
+	}
+	return runs
+}
+
+// buildDictionary is the header text followed by the corpus's shared runs,
+// the most common last.
+func buildDictionary(corpus [][]byte, share float64, minLen int) []byte {
+	counts := sharedRuns(corpus, share, minLen)
+	runs := make([]string, 0, len(counts))
+	for run := range counts {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if counts[runs[i]] != counts[runs[j]] {
+			return counts[runs[i]] < counts[runs[j]]
+		}
+		return runs[i] < runs[j]
+	})
+
+	var dict bytes.Buffer
+	dict.WriteString(headerText)
+	for _, run := range runs {
+		dict.WriteString(run)
+	}
+	return dict.Bytes()
+}
+
+func dictionarySource(varName, corpusDir string, dict []byte) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `// Code generated by gendict from %s. DO NOT EDIT.
+
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package repo
+
+import "encoding/hex"
+
+// %s primes the deflate compressor with what cached OCSP
+// responses have in common, since on their own they are too short to compress
+// well. It starts with the usual HTTP header text, followed by every byte run
+// shared by more than a quarter of a corpus of responses from RSA-2048 and
+// ECDSA P-384 issuers, signing directly or through delegated P-256 responders,
+// for good, revoked and unknown serials. That covers the DER framing, OIDs,
+// algorithm identifiers and extensions, with the most common runs last, where
+// they are cheapest to refer to. See tools/gendict.
+//
+// Entries compressed with it can only be decompressed with these exact bytes,
+// so it must never change. Add a new dictionary, and an encoding using it,
+// instead.
+var %s = mustDecodeHex("" +
+`, corpusDir, varName, varName)
+	encoded := hex.EncodeToString(dict)
+	var lines []string
+	for len(encoded) > 64 {
+		lines = append(lines, fmt.Sprintf("\t%q +\n", encoded[:64]))
+		encoded = encoded[64:]
+	}
+	lines = append(lines, fmt.Sprintf("\t%q)\n", encoded))
+	b.WriteString(strings.Join(lines, ""))
+	b.WriteString(`
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+`)
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSharedRuns(t *testing.T) {
+	t.Parallel()
+	corpus := [][]byte{
+		[]byte("xxframingyyheader"),
+		[]byte("zzframingwwheader"),
+		[]byte("framingheaderqq"),
+		[]byte("nothing in common"),
+	}
+	expected := map[string]int{"framing": 3, "header": 3}
+	runs := sharedRuns(corpus, 0.5, 4)
+	if !reflect.DeepEqual(runs, expected) {
+		t.Errorf("Expected %v, got %v", expected, runs)
+	}
+}
+
+func TestBuildDictionaryOrder(t *testing.T) {
+	t.Parallel()
+	corpus := [][]byte{
+		[]byte("rare1common"),
+		[]byte("rare2common"),
+		[]byte("common"),
+		[]byte("common"),
+	}
+	dict := buildDictionary(corpus, 0.25, 4)
+	if !bytes.Equal(dict, []byte(headerText+"rarecommon")) {
+		t.Errorf("Expected the header text, then the most common run last, got %q", dict)
+	}
+}
+
+func TestDictionarySource(t *testing.T) {
+	t.Parallel()
+	src, err := dictionarySource("testDictionary", "corpus", bytes.Repeat([]byte{0xab}, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(src), "// Code generated by gendict from corpus. DO NOT EDIT.") {
+		t.Errorf("Expected the generated code marker, got %s", src)
+	}
+	if !strings.Contains(string(src), "var testDictionary = mustDecodeHex(\"\" +\n\t\""+strings.Repeat("ab", 32)+"\" +\n\t\""+strings.Repeat("ab", 8)+"\")") {
+		t.Errorf("Expected the dictionary in lines of 32 bytes, got %s", src)
+	}
+}
@@ -0,0 +1,314 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// The structures of RFC 6960. These are written here, rather than with
+// ocsp.CreateResponse, which sets ProducedAt to the current minute, which
+// every response would then share.
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type singleResponse struct {
+	CertID     certID
+	Good       asn1.Flag   `asn1:"tag:0,optional"`
+	Revoked    revokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag   `asn1:"tag:2,optional"`
+	ThisUpdate time.Time   `asn1:"generalized"`
+	NextUpdate time.Time   `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []singleResponse
+}
+
+type basicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+var (
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidBasicResponse     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNoCheck       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+	corpusIssuers        = []string{"R3", "R4", "R5", "R6", "E1", "E2", "E3", "E4"}
+	responsesPerStatus   = 2
+	corpusSeed           = int64(6960)
+	corpusEarliestUpdate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// signer is an issuer, or its delegated responder, and what identifies the
+// issuer in requests.
+type signer struct {
+	cert       *x509.Certificate
+	key        crypto.Signer
+	delegated  bool
+	nameHash   []byte
+	keyHash    []byte
+	algorithm  pkix.AlgorithmIdentifier
+	hashFunc   crypto.Hash
+	issuerCert *x509.Certificate
+}
+
+// synthesizeCorpus writes responses from every issuer, with the serials and
+// times from a fixed seed. Keys and signatures are random regardless.
+func synthesizeCorpus(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	rnd := mathrand.New(mathrand.NewSource(corpusSeed))
+	for i, name := range corpusIssuers {
+		s, err := newSigner(rnd, name, i%2 == 1)
+		if err != nil {
+			return err
+		}
+		for _, status := range []int{ocsp.Good, ocsp.Revoked, ocsp.Unknown} {
+			for n := 0; n < responsesPerStatus; n++ {
+				der, err := s.respond(rnd, status)
+				if err != nil {
+					return err
+				}
+				// Check the response is one clients would accept
+				_, err = ocsp.ParseResponse(der, s.issuerCert)
+				if err != nil {
+					return fmt.Errorf("Synthesized an invalid response: %v", err)
+				}
+				path := filepath.Join(dir, fmt.Sprintf("%s-%s-%d.der", name, statusName(status), n))
+				err = ioutil.WriteFile(path, der, 0644)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func statusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// newSigner makes an issuer named like Let's Encrypt's, with an RSA key for
+// names starting with R and an ECDSA one otherwise, and perhaps a responder
+// for it.
+func newSigner(rnd *mathrand.Rand, name string, delegated bool) (*signer, error) {
+	var issuerKey crypto.Signer
+	var err error
+	if name[0] == 'R' {
+		issuerKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		issuerKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	notBefore := randomTime(rnd)
+	issuerCert, err := createCertificate(&x509.Certificate{
+		SerialNumber:          randomSerial(rnd),
+		Subject:               pkix.Name{Country: []string{"US"}, Organization: []string{"Let's Encrypt"}, CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, issuerKey, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(issuerCert.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return nil, err
+	}
+	nameHash := sha1.Sum(issuerCert.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	s := &signer{
+		cert:       issuerCert,
+		key:        issuerKey,
+		nameHash:   nameHash[:],
+		keyHash:    keyHash[:],
+		issuerCert: issuerCert,
+	}
+
+	if delegated {
+		responderKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		s.cert, err = createCertificate(&x509.Certificate{
+			SerialNumber:    randomSerial(rnd),
+			Subject:         pkix.Name{Country: []string{"US"}, Organization: []string{"Let's Encrypt"}, CommonName: name + " OCSP"},
+			NotBefore:       notBefore,
+			NotAfter:        notBefore.AddDate(0, 3, 0),
+			KeyUsage:        x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+			ExtraExtensions: []pkix.Extension{{Id: oidOCSPNoCheck, Value: asn1.NullBytes}},
+		}, issuerCert, responderKey, issuerKey)
+		if err != nil {
+			return nil, err
+		}
+		s.key = responderKey
+		s.delegated = true
+	}
+
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm = pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+		s.hashFunc = crypto.SHA256
+	case *ecdsa.PrivateKey:
+		if key.Curve == elliptic.P384() {
+			s.algorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384}
+			s.hashFunc = crypto.SHA384
+		} else {
+			s.algorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+			s.hashFunc = crypto.SHA256
+		}
+	}
+	return s, nil
+}
+
+// createCertificate signs the template with the parent's key, or self-signs
+// it without a parent.
+func createCertificate(template, parent *x509.Certificate, key crypto.Signer, parentKey crypto.Signer) (*x509.Certificate, error) {
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// respond signs a response for a random serial, updated at a random time and
+// valid for a week, as Let's Encrypt's are.
+func (s *signer) respond(rnd *mathrand.Rand, status int) ([]byte, error) {
+	thisUpdate := randomTime(rnd)
+	single := singleResponse{
+		CertID: certID{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+			NameHash:      s.nameHash,
+			IssuerKeyHash: s.keyHash,
+			SerialNumber:  randomSerial(rnd),
+		},
+		ThisUpdate: thisUpdate,
+		NextUpdate: thisUpdate.AddDate(0, 0, 7),
+	}
+	switch status {
+	case ocsp.Good:
+		single.Good = true
+	case ocsp.Revoked:
+		single.Revoked = revokedInfo{
+			RevocationTime: thisUpdate.Add(-time.Duration(rnd.Int63n(int64(90 * 24 * time.Hour)))).Truncate(time.Second),
+			Reason:         asn1.Enumerated(rnd.Intn(2)),
+		}
+	default:
+		single.Unknown = true
+	}
+
+	tbs, err := asn1.Marshal(responseData{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: s.cert.RawSubject},
+		ProducedAt:     thisUpdate,
+		Responses:      []singleResponse{single},
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := s.hashFunc.New()
+	h.Write(tbs)
+	signature, err := s.key.Sign(rand.Reader, h.Sum(nil), s.hashFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	basic := basicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: s.algorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	}
+	if s.delegated {
+		basic.Certificates = []asn1.RawValue{{FullBytes: s.cert.Raw}}
+	}
+	basicDER, err := asn1.Marshal(basic)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspResponse{
+		Status:   asn1.Enumerated(ocsp.Success),
+		Response: responseBytes{ResponseType: oidBasicResponse, Response: basicDER},
+	})
+}
+
+// randomSerial is 128 random bits, never starting with a zero byte.
+func randomSerial(rnd *mathrand.Rand) *big.Int {
+	b := make([]byte, 16)
+	rnd.Read(b)
+	b[0] |= 1
+	return new(big.Int).SetBytes(b)
+}
+
+// randomTime is a second in the ten years from corpusEarliestUpdate.
+func randomTime(rnd *mathrand.Rand) time.Time {
+	return corpusEarliestUpdate.Add(time.Duration(rnd.Int63n(10*365*24*3600)) * time.Second)
+}